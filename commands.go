@@ -0,0 +1,224 @@
+// Copyright (C) 2019 Tim Waugh
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/release-engineering/retrodep/v2/retrodep"
+)
+
+// A command is a retrodep subcommand.
+type command struct {
+	name    string
+	summary string
+
+	// flags names the flags, from the legacy command line, which
+	// the command accepts. They share their values with it.
+	flags []string
+
+	// setFlags defines any additional flags in fs.
+	setFlags func(fs *flag.FlagSet)
+
+	// run carries out the command for each Go source tree and
+	// returns the exit code.
+	run func(srcs []*retrodep.GoSource) int
+}
+
+// Flags common to all commands which examine Go source trees.
+var sourceFlags = []string{
+	"config", "debug", "exclude-from", "import-map", "importpath",
+	"rules",
+}
+
+// Flags common to all commands which consult upstream repositories.
+var upstreamFlags = []string{
+	"progress", "progress-json", "project-timeout", "timeout",
+}
+
+// Flags common to all commands which display projects.
+var outputFlags = []string{"o", "x"}
+
+// legacyCommand handles the original, flag-based, command line.
+var legacyCommand = &command{
+	run: runLegacy,
+}
+
+// commands holds the subcommands, in alphabetical order.
+var commands []*command
+
+func init() {
+	commands = []*command{
+		{
+			name:    "check",
+			summary: "check vendored projects against a saved baseline",
+			flags: joinFlags(sourceFlags, upstreamFlags, outputFlags,
+				[]string{"normalise"}),
+			setFlags: func(fs *flag.FlagSet) {
+				fs.StringVar(checkArg, "baseline", "",
+					"read the baseline from `file` (default PATH/"+
+						retrodep.DefaultBaselineFile+")")
+			},
+			run: runCheck,
+		},
+		{
+			name:    "contains",
+			summary: "show whether upstream commits are included in the project",
+			flags: joinFlags(sourceFlags, upstreamFlags,
+				[]string{"normalise"}),
+			setFlags: func(fs *flag.FlagSet) {
+				fs.StringVar(containsArg, "commits", "",
+					"show whether the comma-separated upstream `commits` are included (required)")
+				fs.StringVar(diffVendoredArg, "vendored", "",
+					"examine the vendored project `importpath` instead")
+			},
+			run: runContains,
+		},
+		{
+			name:    "describe",
+			summary: "identify the versions of the project and its vendored projects",
+			flags: joinFlags(sourceFlags, upstreamFlags, outputFlags,
+				[]string{"combined", "deps", "normalise", "osv",
+					"osv-severity", "provenance", "save-baseline"}),
+			run: runDescribe,
+		},
+		{
+			name:    "diff",
+			summary: "compare the project with an upstream ref",
+			flags:   joinFlags(sourceFlags, upstreamFlags, []string{"o"}),
+			setFlags: func(fs *flag.FlagSet) {
+				fs.StringVar(diffArg, "ref", "",
+					"compare with upstream `ref` (required for the top-level project)")
+				fs.StringVar(diffVendoredArg, "vendored", "",
+					"compare the vendored project `importpath` instead, by default with its closest upstream ref")
+				fs.IntVar(diffContextArg, "context", retrodep.DefaultDiffContext,
+					"show `lines` of context around each change")
+				fs.StringVar(diffRemovedArg, "removed", "",
+					"also show the upstream files missing locally which match `files`, a comma-separated list of: "+
+						strings.Join(retrodep.RemovedFilesNames(), ", "))
+			},
+			run: runDiff,
+		},
+		{
+			name:    "help",
+			summary: "show help for a command",
+		},
+		{
+			name:    "importpath",
+			summary: "show the import path of the project",
+			flags:   sourceFlags,
+			run:     runImportPath(""),
+		},
+		{
+			name:    "list",
+			summary: "list the vendored projects without identifying them",
+			flags:   joinFlags(sourceFlags, []string{"o"}),
+			run:     runList,
+		},
+		{
+			name:    "patches",
+			summary: "write patches of the local changes to vendored projects",
+			flags:   joinFlags(sourceFlags, upstreamFlags),
+			setFlags: func(fs *flag.FlagSet) {
+				fs.StringVar(patchesArg, "dir", "",
+					"write the patches into `directory` (required)")
+				fs.StringVar(diffRemovedArg, "removed", "",
+					"also show the upstream files missing locally which match `files`, a comma-separated list of: "+
+						strings.Join(retrodep.RemovedFilesNames(), ", "))
+			},
+			run: runPatches,
+		},
+	}
+}
+
+// joinFlags returns the concatenation of the lists of flag names.
+func joinFlags(lists ...[]string) []string {
+	var names []string
+	for _, list := range lists {
+		names = append(names, list...)
+	}
+	return names
+}
+
+// lookupCommand returns the named command, or nil if there is none.
+func lookupCommand(name string) *command {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd
+		}
+	}
+	return nil
+}
+
+// flagSet returns a new flag.FlagSet for the command.
+func (cmd *command) flagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+	for _, name := range cmd.flags {
+		f := flag.CommandLine.Lookup(name)
+		fs.Var(f.Value, f.Name, f.Usage)
+	}
+	if cmd.setFlags != nil {
+		cmd.setFlags(fs)
+	}
+	return fs
+}
+
+// usage returns the usage message for the command.
+func (cmd *command) usage(progName string) string {
+	if cmd.name == "help" {
+		return fmt.Sprintf("usage: %s help [COMMAND]", progName)
+	}
+	return fmt.Sprintf("usage: %s %s [OPTION]... PATH...", progName, cmd.name)
+}
+
+// legacyUsage returns the usage message for the legacy command line.
+func legacyUsage(progName string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "usage: %s [OPTION]... PATH...\n", progName)
+	fmt.Fprintf(&b, "   or: %s COMMAND [OPTION]... PATH...\n", progName)
+	b.WriteString("\nCommands:\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(&b, "  %-11s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintf(&b, "\nRun '%s help COMMAND' for a command's options.\n", progName)
+	b.WriteString("\nOptions:")
+	return b.String()
+}
+
+// showHelp writes help for the named command, or for the legacy
+// command line if name is "", to w.
+func showHelp(w io.Writer, progName, name string) error {
+	if name == "" {
+		fmt.Fprintln(w, legacyUsage(progName))
+		flag.CommandLine.SetOutput(w)
+		flag.PrintDefaults()
+		return nil
+	}
+
+	cmd := lookupCommand(name)
+	if cmd == nil {
+		return fmt.Errorf("unknown command %q", name)
+	}
+	summary := strings.ToUpper(cmd.summary[:1]) + cmd.summary[1:]
+	fmt.Fprintf(w, "%s\n%s.\n", cmd.usage(progName), summary)
+	fs := cmd.flagSet()
+	fs.SetOutput(w)
+	fs.PrintDefaults()
+	return nil
+}
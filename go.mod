@@ -1,5 +1,7 @@
 module github.com/release-engineering/retrodep/v2
 
+go 1.16
+
 require (
 	github.com/Masterminds/semver v1.4.2
 	github.com/kr/pretty v0.1.0 // indirect
@@ -16,25 +16,44 @@
 package main
 
 import (
-	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"sort"
 	"strings"
+	"syscall"
 	"text/template"
 
 	"github.com/op/go-logging"
 	"github.com/release-engineering/retrodep/v2/retrodep"
+	"github.com/release-engineering/retrodep/v2/retrodep/config"
 	"golang.org/x/tools/go/vcs"
 )
 
 const defaultTemplate string = `
   {{- if .TopPkg -}}
 	{{.TopPkg}}:{{or .TopVer "?"}} {{ end -}}
-  {{.Pkg}}:{{or .Ver "?"}}`
+  {{range .Chain}}{{.}} -> {{end -}}
+  {{.Pkg}}:{{or .Ver "?"}}
+  {{- if .Rule}} (rule {{.Rule}}){{end}}
+  {{- if .Normalised}} (modulo {{range $i, $n := .Normalised}}{{if $i}}, {{end}}{{$n}}{{end}}){{end}}
+  {{- range .OmittedPackages}}
+  omitted: {{.}}{{end}}
+  {{- range .Binaries}}
+  binary: {{.}}{{end}}
+  {{- range .MissingLicenseFiles}}
+  missing license: {{.}}{{end}}`
+
+const listTemplate string = `
+  {{- range .Chain}}{{.}} -> {{end -}}
+  {{.Pkg}}
+  {{- if .Rule}} (rule {{.Rule}}){{end}}`
 
 var log = logging.MustGetLogger("retrodep")
 
@@ -43,37 +62,261 @@ var importPath = flag.String("importpath", "", "top-level import path")
 var onlyImportPath = flag.Bool("only-importpath", false, "only show the top-level import path")
 var depsFlag = flag.Bool("deps", true, "show vendored dependencies")
 var diffArg = flag.String("diff", "", "compare with upstream ref (implies -deps=false)")
-var excludeFrom = flag.String("exclude-from", "", "ignore directory entries matching globs in `exclusions`")
+var patchesArg = flag.String("patches", "", "write a patch of the local changes to each vendored project into `directory`")
+var diffRemovedArg = flag.String("diff-removed", "", "when comparing, also show the upstream files missing locally which match `files`, a comma-separated list of: "+strings.Join(retrodep.RemovedFilesNames(), ", "))
+var diffVendoredArg = flag.String("diff-vendored", "", "compare the vendored project `importpath`, with its closest upstream ref unless -diff is given")
+var diffContextArg = flag.Int("diff-context", retrodep.DefaultDiffContext, "show `lines` of context around each change when comparing")
+var excludeFrom = flag.String("exclude-from", "", "ignore files matching gitignore-style patterns in `exclusions`")
 var debugFlag = flag.Bool("debug", false, "show debugging output")
-var outputArg = flag.String("o", "", "output format, one of: go-template=...")
+var outputArg = flag.String("o", "", "output format, one of: go-template=..., or json when comparing")
 var templateArg = flag.String("template", "", "go template to use for output with Pkg, Repo, Rev, Tag and Ver (deprecated)")
 var exitFirst = flag.Bool("x", false, "exit on the first failure")
+var provenanceFlag = flag.Bool("provenance", false, "show where each file came from")
+var saveBaselineArg = flag.String("save-baseline", "", "save vendored project versions and file hashes to `file`")
+var importMapArg = flag.String("import-map", "", "resolve import paths using the `mapping` file first")
+var rulesArg = flag.String("rules", "", "rewrite import paths to repositories using rules from `file`")
+var checkArg = flag.String("check", "", "check vendored projects against the baseline in `file`")
+var timeoutArg = flag.Duration("timeout", 0, "give up after `duration`")
+var projectTimeoutArg = flag.Duration("project-timeout", 0, "give up on each project after `duration`")
+var progressFlag = flag.Bool("progress", true, "show progress on stderr when it is a terminal")
+var progressJSONArg = flag.String("progress-json", "", "write progress events to `file` as JSON lines")
+var combinedFlag = flag.Bool("combined", false, "show each project once, with the versions used by each PATH")
+var normaliseArg = flag.String("normalise", "", "compare files which differ modulo `changes`, a comma-separated list of: "+strings.Join(retrodep.NormalisationNames(), ", "))
+var osvArg = flag.String("osv", "", "check identified versions against the OSV advisories in `database`, a directory or zip file")
+var osvSeverityArg = flag.String("osv-severity", "low", "with -osv, exit with code 7 if an advisory of at least `level` matches, one of: "+strings.Join(retrodep.SeverityNames(), ", "))
+var configArg = flag.String("config", "", "read settings from `file` as well as PATH/"+config.DefaultFile)
 
 var errorShown = false
 var usage func(string)
 
+// configOutput is the output format from the configuration, used
+// when -o is not given.
+var configOutput string
+
+// containsArg holds the upstream commits given to the contains
+// command, which has no equivalent on the legacy command line.
+var containsArg = new(string)
+
+// advisories holds the advisories loaded for -osv, if given.
+var advisories *retrodep.AdvisoryDB
+
+// severityThreshold is the severity of matching advisories, from
+// -osv-severity, at which the exit code is 7.
+var severityThreshold retrodep.Severity
+
+// vulnerable is true if an advisory meeting severityThreshold
+// matched.
+var vulnerable = false
+
+// sourcePaths maps each Go source tree to the PATH it was found in.
+var sourcePaths = make(map[*retrodep.GoSource]string)
+
+// runContext is done when the run is interrupted or -timeout
+// expires.
+var runContext = context.Background()
+
+// maxWorkingTrees is the number of working trees kept for sharing
+// between projects. Each is a clone of an upstream repository, so
+// keeping them all could use a great deal of disk space.
+const maxWorkingTrees = 8
+
+// workingTreeCache holds working trees, indexed by VCS and
+// repository, for sharing between projects. Once it is full the
+// least recently used is removed.
+type workingTreeCache struct {
+	max   int
+	trees map[string]retrodep.WorkingTree
+
+	// keys holds the keys of trees, least recently used first
+	keys []string
+}
+
+// newWorkingTreeCache returns a workingTreeCache holding up to max
+// working trees.
+func newWorkingTreeCache(max int) *workingTreeCache {
+	return &workingTreeCache{
+		max:   max,
+		trees: make(map[string]retrodep.WorkingTree),
+	}
+}
+
+// touch marks the working tree for key as the most recently used.
+func (c *workingTreeCache) touch(key string) {
+	for i, k := range c.keys {
+		if k == key {
+			c.keys = append(c.keys[:i], c.keys[i+1:]...)
+			break
+		}
+	}
+	c.keys = append(c.keys, key)
+}
+
+// get returns the working tree for key, if present.
+func (c *workingTreeCache) get(key string) (retrodep.WorkingTree, bool) {
+	wt, ok := c.trees[key]
+	if ok {
+		c.touch(key)
+	}
+	return wt, ok
+}
+
+// add stores the working tree for key, removing the least recently
+// used if the cache is full.
+func (c *workingTreeCache) add(key string, wt retrodep.WorkingTree) {
+	c.trees[key] = wt
+	c.touch(key)
+	for len(c.keys) > c.max {
+		oldest := c.keys[0]
+		c.keys = c.keys[1:]
+		log.Debugf("removing working tree for %s", oldest)
+		c.trees[oldest].Close()
+		delete(c.trees, oldest)
+	}
+}
+
+// closeAll removes all the working trees.
+func (c *workingTreeCache) closeAll() {
+	for _, wt := range c.trees {
+		wt.Close()
+	}
+	c.trees = make(map[string]retrodep.WorkingTree)
+	c.keys = nil
+}
+
+// workingTrees holds the working trees shared between projects.
+// They are removed before exiting.
+var workingTrees = newWorkingTreeCache(maxWorkingTrees)
+
+// exit removes any working trees and exits with the status code.
+func exit(code int) {
+	workingTrees.closeAll()
+	os.Exit(code)
+}
+
+// fatal logs a critical error and exits, like log.Fatal.
+func fatal(args ...interface{}) {
+	log.Critical(args...)
+	exit(1)
+}
+
+// fatalf logs a critical error and exits, like log.Fatalf.
+func fatalf(format string, args ...interface{}) {
+	log.Criticalf(format, args...)
+	exit(1)
+}
+
+// newRunContext returns the Context for the whole run. It is
+// cancelled on the first SIGINT or SIGTERM, and limited by -timeout.
+func newRunContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	if *timeoutArg > 0 {
+		ctx, cancel = context.WithTimeout(ctx, *timeoutArg)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-signals:
+			// A second signal is not caught.
+			signal.Stop(signals)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// projectContext returns a Context for working on a single
+// project, limited by -project-timeout.
+func projectContext() (context.Context, context.CancelFunc) {
+	if *projectTimeoutArg > 0 {
+		return context.WithTimeout(runContext, *projectTimeoutArg)
+	}
+	return context.WithCancel(runContext)
+}
+
+// checkInterrupted exits if the run has been interrupted or -timeout
+// has expired.
+func checkInterrupted() {
+	switch runContext.Err() {
+	case nil:
+	case context.DeadlineExceeded:
+		fatalf("timed out after %s", *timeoutArg)
+	default:
+		fatal("interrupted")
+	}
+}
+
+// timedOut reports whether the failure to describe root happened
+// because -project-timeout expired for ctx. If the whole run has
+// been interrupted it exits instead.
+func timedOut(ctx context.Context, root string) bool {
+	checkInterrupted()
+	if ctx.Err() == nil {
+		return false
+	}
+	log.Errorf("%s: timed out after %s", root, *projectTimeoutArg)
+	return true
+}
+
 func displayUnknown(tmpl *template.Template, topLevelMarker string, ref *retrodep.Reference, projectRoot string) {
+	clearProgress()
 	if ref == nil || *templateArg != "" {
 		fmt.Printf("%s%s ?\n", topLevelMarker, projectRoot)
 	} else {
 		display(tmpl, topLevelMarker, ref)
 	}
+	versionMissing()
+}
+
+// versionMissing notes that a version was not identified.
+func versionMissing() {
 	if !errorShown {
 		errorShown = true
 		fmt.Fprintln(os.Stderr, "error: not all versions identified")
 		if *exitFirst {
-			os.Exit(2)
+			exit(2)
 		}
 	}
 }
 
+// showRef displays the Reference for a project in src, or records it
+// in the combined report. Whether its version was identified is
+// given by found.
+func showRef(tmpl *template.Template, src *retrodep.GoSource, topLevelMarker string, ref *retrodep.Reference, projectRoot string, found bool) {
+	switch {
+	case report != nil:
+		report.add(src.Path, ref, projectRoot)
+		if !found {
+			versionMissing()
+		}
+	case found:
+		display(tmpl, topLevelMarker, ref)
+	default:
+		displayUnknown(tmpl, topLevelMarker, ref, projectRoot)
+	}
+}
+
+// showSkipped displays a project in src which the configuration says
+// not to identify, or records it in the combined report.
+func showSkipped(src *retrodep.GoSource, projectRoot string) {
+	if report != nil {
+		report.addVersion(src.Path, projectRoot, "skipped")
+		return
+	}
+	clearProgress()
+	fmt.Printf("%s skipped\n", projectRoot)
+}
+
 func display(tmpl *template.Template, topLevelMarker string, ref *retrodep.Reference) {
 	var builder strings.Builder
 	builder.WriteString(topLevelMarker)
 	err := tmpl.Execute(&builder, ref)
 	if err != nil {
-		log.Fatalf("Error generating output. %s", err)
+		fatalf("Error generating output. %s", err)
 	}
+	clearProgress()
 	fmt.Println(builder.String())
 }
 
@@ -84,24 +327,92 @@ func getProject(src *retrodep.GoSource, importPath string) *retrodep.RepoPath {
 			log.Errorf("%s: %s", src.Path, err)
 			fmt.Fprintln(os.Stderr,
 				"Provide import path with -importpath")
-			os.Exit(3)
+			exit(3)
 		}
-		log.Fatalf("%s: %s", src.Path, err)
+		fatalf("%s: %s", src.Path, err)
 	}
 
 	return main
 }
 
-// newWorkingTree creates a new retrodep.WorkingTree for the path.
-func newWorkingTree(path string, project *vcs.RepoRoot) (wt retrodep.WorkingTree, err error) {
-	wt, err = retrodep.NewWorkingTree(project)
-	if err != nil {
+// openWorkingTree returns a retrodep.WorkingTree for the repository
+// root, shared in the same way as those from newWorkingTree.
+func openWorkingTree(ctx context.Context, root *vcs.RepoRoot) (retrodep.WorkingTree, error) {
+	return newWorkingTree(ctx, root.Root, root)
+}
+
+// newWorkingTree returns a retrodep.WorkingTree for the path, which
+// is removed on exit. Working trees are shared between projects from
+// the same repository.
+func newWorkingTree(ctx context.Context, path string, project *vcs.RepoRoot) (wt retrodep.WorkingTree, err error) {
+	key := project.VCS.Cmd + " " + project.Repo
+	if wt, ok := workingTrees.get(key); ok {
+		return retrodep.WorkingTreeWithContext(ctx, wt), nil
+	}
+
+	wt, err = retrodep.NewWorkingTreeContext(ctx, project)
+	if err != nil && ctx.Err() == nil {
 		log.Errorf("%s: %s, retrying", path, err)
-		wt, err = retrodep.NewWorkingTree(project)
+		wt, err = retrodep.NewWorkingTreeContext(ctx, project)
 	}
+	if err != nil {
+		checkInterrupted()
+		return
+	}
+	workingTrees.add(key, wt)
 	return
 }
 
+// showProvenance displays the upstream provenance of each file in
+// dir, compared to ref, if requested.
+func showProvenance(src *retrodep.GoSource, project *retrodep.RepoPath, wt retrodep.WorkingTree, dir string, ref *retrodep.Reference) {
+	if !*provenanceFlag {
+		return
+	}
+
+	files, err := src.Provenance(project, wt, dir, ref)
+	if err != nil {
+		log.Errorf("%s: %s", dir, err)
+		return
+	}
+
+	clearProgress()
+	for _, file := range files {
+		line := fmt.Sprintf("  %s: %s", file.Provenance, file.Path)
+		if file.Rev != "" {
+			line += " " + file.Rev
+		}
+		fmt.Println(line)
+	}
+}
+
+// showAdvisories displays the advisories, if -osv was given, which
+// affect the identified project version ref, using its working tree
+// wt to compare revisions.
+func showAdvisories(wt retrodep.WorkingTree, ref *retrodep.Reference) {
+	if advisories == nil {
+		return
+	}
+
+	matched, err := advisories.Match(ref, wt)
+	if err != nil {
+		checkInterrupted()
+		fatal(err)
+	}
+
+	clearProgress()
+	for _, adv := range matched {
+		line := fmt.Sprintf("  advisory: %s [%s]", adv, adv.Severity)
+		if adv.Summary != "" {
+			line += ": " + adv.Summary
+		}
+		fmt.Println(line)
+		if adv.Severity.AtLeast(severityThreshold) {
+			vulnerable = true
+		}
+	}
+}
+
 func showTopLevel(tmpl *template.Template, src *retrodep.GoSource) *retrodep.Reference {
 	var topLevelMarker string
 	if *templateArg != "" {
@@ -110,11 +421,13 @@ func showTopLevel(tmpl *template.Template, src *retrodep.GoSource) *retrodep.Ref
 	main := getProject(src, *importPath)
 	if main.Err != nil {
 		log.Errorf("%s: %s", *importPath, main.Err)
-		displayUnknown(tmpl, topLevelMarker, nil, main.Root)
+		showRef(tmpl, src, topLevelMarker, nil, main.Root, false)
 		return nil
 	}
 
-	wt, err := newWorkingTree(src.Path, &main.RepoRoot)
+	ctx, cancel := projectContext()
+	defer cancel()
+	wt, err := newWorkingTree(ctx, src.Path, &main.RepoRoot)
 	if err != nil {
 		log.Errorf("%s: %s", src.Path, err)
 
@@ -123,28 +436,47 @@ func showTopLevel(tmpl *template.Template, src *retrodep.GoSource) *retrodep.Ref
 			Pkg:  main.Root,
 			Repo: main.Repo,
 		}
-		displayUnknown(tmpl, topLevelMarker, project, main.Root)
+		showRef(tmpl, src, topLevelMarker, project, main.Root, false)
 		return project
 	}
 
-	defer wt.Close()
-	project, err := src.DescribeProject(main, wt, src.Path, nil)
-	switch err {
-	case retrodep.ErrorVersionNotFound:
-		displayUnknown(tmpl, topLevelMarker, project, main.Root)
-	case nil:
-		display(tmpl, topLevelMarker, project)
+	project, err := src.DescribeProjectContext(ctx, main, wt, src.Path, nil)
+	switch {
+	case err == retrodep.ErrorVersionNotFound:
+		showRef(tmpl, src, topLevelMarker, project, main.Root, false)
+		showProvenance(src, main, wt, src.Path, project)
+	case err == nil:
+		showRef(tmpl, src, topLevelMarker, project, main.Root, true)
+		showProvenance(src, main, wt, src.Path, project)
+		showAdvisories(wt, project)
+	case timedOut(ctx, main.Root):
+		project = &retrodep.Reference{
+			Pkg:  main.Root,
+			Repo: main.Repo,
+		}
+		showRef(tmpl, src, topLevelMarker, project, main.Root, false)
 	default:
-		log.Fatalf("%s: %s", src.Path, err)
+		fatalf("%s: %s", src.Path, err)
 	}
 
 	return project
 }
 
-func showVendored(tmpl *template.Template, src *retrodep.GoSource, top *retrodep.Reference) {
+// addToBaseline adds the vendored project to the baseline, if one
+// is being saved.
+func addToBaseline(baseline *retrodep.Baseline, src *retrodep.GoSource, project *retrodep.RepoPath, ref *retrodep.Reference) {
+	if baseline == nil {
+		return
+	}
+	if err := src.AddProject(baseline, project, ref); err != nil {
+		log.Errorf("%s: not saved in baseline: %s", project.Root, err)
+	}
+}
+
+func showVendored(tmpl *template.Template, src *retrodep.GoSource, top *retrodep.Reference, baseline *retrodep.Baseline) {
 	vendored, err := src.VendoredProjects()
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
 	}
 
 	// Sort the projects for predictable output
@@ -156,66 +488,249 @@ func showVendored(tmpl *template.Template, src *retrodep.GoSource, top *retrodep
 
 	// Describe each vendored project
 	for _, repo := range repos {
-		project := vendored[repo]
-		if project.Err != nil {
-			log.Errorf("%s: %s", repo, project.Err)
-			ref := &retrodep.Reference{
-				TopPkg: top.Pkg,
-				TopVer: top.Ver,
-				Pkg:    repo,
-			}
-			displayUnknown(tmpl, "", ref, repo)
-			continue
-		}
+		showVendoredProject(tmpl, src, repo, vendored[repo], top, baseline)
+	}
+}
+
+// showVendoredProject describes a single vendored project, found at
+// repo within the vendor directory.
+func showVendoredProject(tmpl *template.Template, src *retrodep.GoSource, repo string, project *retrodep.RepoPath, top *retrodep.Reference, baseline *retrodep.Baseline) {
+	// Treat failures as VersionNotFound.
+	unknown := &retrodep.Reference{
+		Chain: project.Chain,
+		Pkg:   project.Root,
+	}
+	if top != nil {
+		unknown.TopPkg = top.Pkg
+		unknown.TopVer = top.Ver
+	}
+	if project.Err != nil {
+		log.Errorf("%s: %s", repo, project.Err)
+		showRef(tmpl, src, "", unknown, repo, false)
+		addToBaseline(baseline, src, project, unknown)
+		return
+	}
 
-		wt, err := newWorkingTree(project.Root, &project.RepoRoot)
+	unknown.Repo = project.Repo
+	if project.Skip {
+		showSkipped(src, project.Root)
+		addToBaseline(baseline, src, project, unknown)
+		return
+	}
+
+	ctx, cancel := projectContext()
+	defer cancel()
+	wt, err := newWorkingTree(ctx, project.Root, &project.RepoRoot)
+	if err != nil {
+		log.Errorf("%s: %s", project.Root, err)
+		showRef(tmpl, src, "", unknown, project.Root, false)
+		addToBaseline(baseline, src, project, unknown)
+		return
+	}
+
+	vp, err := src.DescribeVendoredProjectContext(ctx, project, wt, top)
+	if err == nil && vp.Repo != project.Repo {
+		// Found in a fork, whose working tree is shared
+		fork := *project
+		fork.Repo = vp.Repo
+		project = &fork
+		wt, err = newWorkingTree(ctx, project.Root, &fork.RepoRoot)
 		if err != nil {
 			log.Errorf("%s: %s", project.Root, err)
+			showRef(tmpl, src, "", unknown, project.Root, false)
+			addToBaseline(baseline, src, project, unknown)
+			return
+		}
+	}
+	switch {
+	case err == retrodep.ErrorVersionNotFound:
+		showRef(tmpl, src, "", vp, project.Root, false)
+		showProvenance(src, project, wt, src.VendoredDir(project), vp)
+		addToBaseline(baseline, src, project, vp)
+	case err == nil:
+		showRef(tmpl, src, "", vp, project.Root, true)
+		showProvenance(src, project, wt, src.VendoredDir(project), vp)
+		showAdvisories(wt, vp)
+		addToBaseline(baseline, src, project, vp)
+	case timedOut(ctx, project.Root):
+		showRef(tmpl, src, "", unknown, project.Root, false)
+		addToBaseline(baseline, src, project, unknown)
+	default:
+		fatalf("%s: %s", project.Root, err)
+	}
+}
 
-			// Treat this as VersionNotFound.
-			vp := &retrodep.Reference{
-				TopPkg: top.Pkg,
-				TopVer: top.Ver,
-				Pkg:    project.Root,
-				Repo:   project.Repo,
-			}
-			displayUnknown(tmpl, "", vp, project.Root)
-			continue
+// readBaselines reads the saved baselines from file, indexed by
+// SubPath.
+func readBaselines(file string) map[string]*retrodep.Baseline {
+	f, err := os.Open(file)
+	if err != nil {
+		fatal(err)
+	}
+	defer f.Close()
+
+	baselines, err := retrodep.ReadBaselines(f)
+	if err != nil {
+		fatalf("%s: %s", file, err)
+	}
+
+	bySubPath := make(map[string]*retrodep.Baseline)
+	for _, b := range baselines {
+		bySubPath[b.SubPath] = b
+	}
+	return bySubPath
+}
+
+// writeBaselines saves the baselines to file.
+func writeBaselines(file string, baselines []*retrodep.Baseline) {
+	f, err := os.Create(file)
+	if err != nil {
+		fatal(err)
+	}
+	err = retrodep.WriteBaselines(f, baselines)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		fatalf("%s: %s", file, err)
+	}
+}
+
+// checkBaseline compares the vendored projects in src with the saved
+// baseline, without consulting upstream repositories. Projects which
+// have changed are identified again. It returns true if any changes
+// were found.
+func checkBaseline(tmpl *template.Template, src *retrodep.GoSource, baseline *retrodep.Baseline) bool {
+	if baseline == nil {
+		log.Errorf("%s: no baseline saved", src.Path)
+		return true
+	}
+
+	drift, err := src.CheckBaseline(baseline)
+	if err != nil {
+		fatalf("%s: %s", src.Path, err)
+	}
+
+	for _, path := range drift.Untracked {
+		log.Errorf("%s: not in baseline", path)
+	}
+
+	for _, saved := range drift.Drifted {
+		log.Errorf("%s: changed since baseline (%s)",
+			saved.Pkg, saved.Ver)
+		redescribe(tmpl, src, saved, baseline.Top)
+	}
+
+	return drift.Drifted != nil || drift.Untracked != nil
+}
+
+// redescribe identifies the version of a project which has changed
+// since it was saved in the baseline.
+func redescribe(tmpl *template.Template, src *retrodep.GoSource, saved *retrodep.BaselineProject, top *retrodep.Reference) {
+	project := saved.RepoPath(src)
+	if project.VCS == nil {
+		// The upstream repository was not known
+		displayUnknown(tmpl, "", &saved.Reference, project.Root)
+		return
+	}
+
+	ctx, cancel := projectContext()
+	defer cancel()
+	wt, err := newWorkingTree(ctx, project.Root, &project.RepoRoot)
+	if err != nil {
+		log.Errorf("%s: %s", project.Root, err)
+		displayUnknown(tmpl, "", &saved.Reference, project.Root)
+		return
+	}
+
+	vp, err := src.DescribeVendoredProjectContext(ctx, project, wt, top)
+	switch {
+	case err == retrodep.ErrorVersionNotFound:
+		displayUnknown(tmpl, "", vp, project.Root)
+	case err == nil:
+		display(tmpl, "", vp)
+	case timedOut(ctx, project.Root):
+		displayUnknown(tmpl, "", &saved.Reference, project.Root)
+	default:
+		fatalf("%s: %s", project.Root, err)
+	}
+}
+
+// newResolver returns the retrodep.Resolver to use for import paths,
+// consulting the -import-map file if supplied. Results are cached.
+func newResolver() retrodep.Resolver {
+	resolver := retrodep.VCSResolver
+	if *importMapArg != "" {
+		f, err := os.Open(*importMapArg)
+		if err != nil {
+			fatal(err)
 		}
+		defer f.Close()
 
-		defer wt.Close()
-		vp, err := src.DescribeVendoredProject(project, wt, top)
-		switch err {
-		case retrodep.ErrorVersionNotFound:
-			displayUnknown(tmpl, "", vp, project.Root)
-		case nil:
-			display(tmpl, "", vp)
-		default:
-			log.Fatalf("%s: %s", project.Root, err)
+		static, err := retrodep.LoadStaticResolver(f)
+		if err != nil {
+			fatalf("%s: %s", *importMapArg, err)
 		}
+		resolver = retrodep.MultiResolver(static, resolver)
+	}
+	return retrodep.NewCachingResolver(resolver)
+}
+
+// readRules reads the -rules file, if supplied.
+func readRules() retrodep.Rules {
+	if *rulesArg == "" {
+		return nil
+	}
+
+	f, err := os.Open(*rulesArg)
+	if err != nil {
+		fatal(err)
+	}
+	defer f.Close()
+
+	rules, err := retrodep.LoadRules(f, filepath.Base(*rulesArg))
+	if err != nil {
+		fatal(err)
 	}
+	return rules
 }
 
-func readExcludeFile() []string {
+// readConfig reads the -config file, if supplied.
+func readConfig() *config.Config {
+	if *configArg == "" {
+		return nil
+	}
+
+	conf, err := config.Load(*configArg)
+	if err != nil {
+		fatal(err)
+	}
+	return conf
+}
+
+// readExcludeFile reads the -exclude-from file, if supplied.
+func readExcludeFile() *retrodep.Excludes {
 	if *excludeFrom == "" {
 		return nil
 	}
 
 	e, err := os.Open(*excludeFrom)
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
 	}
 	defer e.Close()
 
-	excludes := make([]string, 0)
-	scanner := bufio.NewScanner(bufio.NewReader(e))
-	for scanner.Scan() {
-		excludes = append(excludes, strings.TrimSpace(scanner.Text()))
+	excludes, err := retrodep.ReadExcludes(e)
+	if err != nil {
+		fatal(err)
 	}
 	return excludes
 }
 
-func processArgs(args []string) []*retrodep.GoSource {
+// processArgs parses the command line, which either names a command
+// or uses the legacy form, and returns the command along with the Go
+// source trees to run it on.
+func processArgs(args []string) (*command, []*retrodep.GoSource) {
 	progName := filepath.Base(args[0])
 
 	// Stop the default behaviour of printing errors and exiting.
@@ -225,27 +740,55 @@ func processArgs(args []string) []*retrodep.GoSource {
 	cli.SetOutput(ioutil.Discard)
 	cli.Usage = func() {}
 
-	usageMsg := fmt.Sprintf("usage: %s [OPTION]... PATH", progName)
+	cmd := legacyCommand
+	fs := cli
+	usageMsg := legacyUsage(progName)
+	if len(args) > 1 {
+		if c := lookupCommand(args[1]); c != nil {
+			cmd = c
+			fs = c.flagSet()
+			fs.SetOutput(ioutil.Discard)
+			fs.Usage = func() {}
+			usageMsg = c.usage(progName)
+			args = args[1:]
+		}
+	}
+
 	usage = func(flaw string) {
-		log.Fatalf("%s: %s\n%s", progName, flaw, usageMsg)
+		fatalf("%s: %s\n%s", progName, flaw, usageMsg)
 	}
-	err := cli.Parse(args[1:])
+	err := fs.Parse(args[1:])
 	if err == flag.ErrHelp || *helpFlag { // Handle ‘-h’.
-		fmt.Printf("%s: help requested\n%s\n", progName, usageMsg)
-		cli.SetOutput(os.Stdout)
-		flag.PrintDefaults()
-		os.Exit(0) // Not an error.
+		fmt.Printf("%s: help requested\n", progName)
+		showHelp(os.Stdout, progName, cmd.name)
+		exit(0) // Not an error.
 	}
 	if err != nil {
 		usage(err.Error())
 	}
 
-	narg := flag.NArg()
-	if narg == 0 {
+	if cmd.name == "help" {
+		if fs.NArg() > 1 {
+			usage(fmt.Sprintf("only one command allowed: %q", fs.Arg(1)))
+		}
+		if err := showHelp(os.Stdout, progName, fs.Arg(0)); err != nil {
+			usage(err.Error())
+		}
+		exit(0)
+	}
+
+	paths := fs.Args()
+	if len(paths) == 0 {
 		usage("missing path")
 	}
-	if narg != 1 {
-		usage(fmt.Sprintf("only one path allowed: %q", flag.Arg(1)))
+	if len(paths) > 1 && (*checkArg != "" || *saveBaselineArg != "") {
+		usage("only one path allowed with a baseline file")
+	}
+	if *combinedFlag && *provenanceFlag {
+		usage("-combined cannot be used with -provenance")
+	}
+	if *combinedFlag && *osvArg != "" {
+		usage("-combined cannot be used with -osv")
 	}
 
 	level := logging.INFO
@@ -254,21 +797,77 @@ func processArgs(args []string) []*retrodep.GoSource {
 	}
 	logging.SetLevel(level, "retrodep")
 
-	excludeGlobs := readExcludeFile()
-	path := flag.Arg(0)
-	sources, err := retrodep.FindGoSources(path, excludeGlobs)
+	opts := &retrodep.GoSourceOptions{
+		Excludes: readExcludeFile(),
+		Resolver: newResolver(),
+	}
+	var sources []*retrodep.GoSource
+	for _, path := range paths {
+		srcs, err := retrodep.FindGoSourcesWithOptions(path, opts)
+		if err != nil {
+			if err == retrodep.ErrorNoGo {
+				fmt.Fprintf(os.Stderr,
+					"%s: no Go source code at %s\n",
+					progName, path)
+				exit(4)
+			}
+
+			fatal(err)
+		}
+		for _, src := range srcs {
+			sourcePaths[src] = path
+		}
+		sources = append(sources, srcs...)
+	}
+
+	normalise, err := retrodep.ParseNormalisation(*normaliseArg)
+	if err != nil {
+		usage(err.Error())
+	}
+	removed, err := retrodep.ParseRemovedFiles(*diffRemovedArg)
 	if err != nil {
-		if err == retrodep.ErrorNoGo {
-			fmt.Fprintf(os.Stderr,
-				"%s: no Go source code at %s\n",
-				progName, path)
-			os.Exit(4)
+		usage(err.Error())
+	}
+
+	if *osvArg != "" {
+		severityThreshold, err = retrodep.ParseSeverity(*osvSeverityArg)
+		if err != nil {
+			usage(err.Error())
 		}
+		advisories, err = retrodep.LoadAdvisories(*osvArg)
+		if err != nil {
+			fatal(err)
+		}
+	}
 
-		log.Fatal(err)
+	rules := readRules()
+	conf := readConfig()
+	for _, src := range sources {
+		src.Rules = rules
+		src.Normalise = normalise
+		src.ShowRemoved = removed
+		src.OpenWorkingTree = openWorkingTree
+		if conf != nil {
+			if err := src.ApplyConfig(conf); err != nil {
+				fatalf("%s: %s", *configArg, err)
+			}
+		}
+		if src.Config == nil || src.Config.Output == "" {
+			continue
+		}
+		switch configOutput {
+		case "":
+			configOutput = src.Config.Output
+		case src.Config.Output:
+		default:
+			if *outputArg == "" && *templateArg == "" {
+				log.Warningf("%s: ignoring configured output format %q, using %q",
+					src.Path, src.Config.Output, configOutput)
+			}
+		}
 	}
 
-	return sources
+	return cmd, sources
 }
 
 func getTemplate() string {
@@ -282,6 +881,11 @@ func getTemplate() string {
 	case *templateArg != "":
 		customTemplate = "{{.Pkg}}" + *templateArg
 		log.Warning("-template is deprecated, use -o go-template= instead")
+	case configOutput != "":
+		customTemplate = strings.TrimPrefix(configOutput, "go-template=")
+		if customTemplate == configOutput {
+			usage("unknown output format in configuration")
+		}
 	default:
 		customTemplate = defaultTemplate
 	}
@@ -289,47 +893,453 @@ func getTemplate() string {
 	return customTemplate
 }
 
-func main() {
-	srcs := processArgs(os.Args)
-
-	customTemplate := getTemplate()
-	tmpl, err := template.New("output").Parse(customTemplate)
+// parseTemplate returns the template for displaying projects.
+func parseTemplate() *template.Template {
+	tmpl, err := template.New("output").Parse(getTemplate())
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
+	}
+	return tmpl
+}
+
+// exitStatus returns the exit code for commands which display
+// projects.
+func exitStatus() int {
+	if errorShown {
+		return 2
+	}
+	return 0
+}
+
+// runLegacy runs the command selected by the legacy command line
+// flags.
+func runLegacy(srcs []*retrodep.GoSource) int {
+	switch {
+	case *diffArg != "", *diffVendoredArg != "":
+		return runDiff(srcs)
+	case *patchesArg != "":
+		return runPatches(srcs)
+	case *onlyImportPath:
+		return runImportPath("*")(srcs)
+	case *checkArg != "":
+		return runCheck(srcs)
+	}
+	return runDescribe(srcs)
+}
+
+// runDescribe identifies the top-level project of each source, and
+// its vendored projects unless -deps=false. With -osv, the advisories
+// affecting each are shown too.
+func runDescribe(srcs []*retrodep.GoSource) int {
+	tmpl := parseTemplate()
+	if *combinedFlag {
+		report = newCombinedReport()
+	}
+	var baselines []*retrodep.Baseline
+	for _, src := range srcs {
+		top := showTopLevel(tmpl, src)
+		if *depsFlag {
+			var baseline *retrodep.Baseline
+			if *saveBaselineArg != "" {
+				baseline = src.NewBaseline(top)
+				baselines = append(baselines, baseline)
+			}
+			showVendored(tmpl, src, top, baseline)
+		}
+	}
+
+	if *saveBaselineArg != "" {
+		writeBaselines(*saveBaselineArg, baselines)
+	}
+
+	if report != nil {
+		clearProgress()
+		report.write(os.Stdout)
 	}
+
+	if vulnerable {
+		return 7
+	}
+	return exitStatus()
+}
+
+// runDiff compares the top-level project of each source, or the
+// vendored project given by -diff-vendored, with the upstream ref
+// given by -diff (or -ref), with -diff-context (or -context) lines of
+// context. For a vendored project with no ref given, the closest
+// upstream ref is used. With -o json, a summary of the differences
+// is shown instead.
+func runDiff(srcs []*retrodep.GoSource) int {
+	if *diffArg == "" && *diffVendoredArg == "" {
+		usage("missing ref")
+	}
+	var summaries []*diffSummary
+	switch *outputArg {
+	case "":
+	case "json":
+		summaries = make([]*diffSummary, 0, len(srcs))
+	default:
+		usage("unknown output format")
+	}
+
 	changes := false
 	for _, src := range srcs {
-		if *diffArg != "" {
-			main := getProject(src, *importPath)
+		summary, changed := diffSource(src, summaries != nil)
+		if summary != nil {
+			summaries = append(summaries, summary)
+		}
+		changes = changes || changed
+	}
+
+	if summaries != nil {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(summaries); err != nil {
+			fatal(err)
+		}
+	}
 
-			wt, err := newWorkingTree(src.Path, &main.RepoRoot)
-			if err != nil {
-				log.Fatal(err)
+	if changes {
+		return 5
+	}
+	return 0
+}
+
+// diffSource compares the project chosen by diffProject in src with
+// its upstream ref, returning a summary of the differences if
+// summarise is true or writing them to os.Stdout otherwise. It also
+// returns whether there were any differences.
+func diffSource(src *retrodep.GoSource, summarise bool) (*diffSummary, bool) {
+	project, dir := diffProject(src)
+
+	ctx, cancel := projectContext()
+	defer cancel()
+	wt, err := newWorkingTree(ctx, dir, &project.RepoRoot)
+	if err != nil {
+		fatal(err)
+	}
+
+	ref, ver := *diffArg, *diffArg
+	if ref == "" {
+		vp, n, err := src.ClosestRefContext(ctx, project, wt, dir, nil)
+		if err != nil {
+			checkInterrupted()
+			fatalf("%s: %s", project.Root, err)
+		}
+		log.Infof("%s: comparing with closest match %s (differing files: %d)",
+			project.Root, vp.Ver, n)
+		ref, ver = vp.Rev, vp.Ver
+	}
+
+	diffs, err := src.FileDiffsContext(ctx, project, wt, dir, ref,
+		*diffContextArg)
+	if err != nil {
+		checkInterrupted()
+		fatal(err)
+	}
+	if summarise {
+		return newDiffSummary(dir, project, ver, ref, diffs), len(diffs) > 0
+	}
+	for _, d := range diffs {
+		if _, err := d.WriteTo(os.Stdout); err != nil {
+			fatal(err)
+		}
+	}
+	return nil, len(diffs) > 0
+}
+
+// diffProject returns the project to compare in diff mode, and the
+// directory holding the local copy: the top-level project, or the
+// vendored project given by -diff-vendored.
+func diffProject(src *retrodep.GoSource) (*retrodep.RepoPath, string) {
+	if *diffVendoredArg == "" {
+		return getProject(src, *importPath), src.Path
+	}
+
+	vendored, err := src.VendoredProjects()
+	if err != nil {
+		fatal(err)
+	}
+	project, ok := vendored[*diffVendoredArg]
+	if !ok {
+		fatalf("%s: not vendored in %s", *diffVendoredArg, src.Path)
+	}
+	if project.Err != nil {
+		fatalf("%s: %s", *diffVendoredArg, project.Err)
+	}
+	return project, src.VendoredDir(project)
+}
+
+// runPatches writes a patch series into the directory given by
+// -patches, with a patch for each vendored project which differs from
+// its closest upstream ref. The name of each patch file is shown.
+func runPatches(srcs []*retrodep.GoSource) int {
+	if *patchesArg == "" {
+		usage("missing directory")
+	}
+	if err := os.MkdirAll(*patchesArg, 0755); err != nil {
+		fatal(err)
+	}
+
+	n := 0
+	for _, src := range srcs {
+		vendored, err := src.VendoredProjects()
+		if err != nil {
+			fatal(err)
+		}
+
+		// Sort the projects for predictable output
+		var repos []string
+		for repo := range vendored {
+			repos = append(repos, repo)
+		}
+		sort.Strings(repos)
+
+		for _, repo := range repos {
+			patch, ok := vendoredPatch(src, repo, vendored[repo])
+			if !ok {
+				continue
 			}
-			defer wt.Close()
 
-			c, err := src.Diff(main, wt, os.Stdout, src.Path, *diffArg)
-			if err != nil {
-				log.Fatal(err)
+			n++
+			name := filepath.Join(*patchesArg,
+				retrodep.PatchFileName(n, repo))
+			if err := ioutil.WriteFile(name, patch, 0644); err != nil {
+				fatal(err)
 			}
+			clearProgress()
+			fmt.Println(name)
+		}
+	}
+
+	return exitStatus()
+}
+
+// vendoredPatch returns the patch of local changes to the vendored
+// project, found at repo within the vendor directory, compared with
+// its closest upstream ref. It returns false if there are none, or if
+// the closest ref was not found.
+func vendoredPatch(src *retrodep.GoSource, repo string, project *retrodep.RepoPath) ([]byte, bool) {
+	if project.Err != nil {
+		log.Errorf("%s: %s", repo, project.Err)
+		versionMissing()
+		return nil, false
+	}
+	if project.Skip {
+		log.Infof("%s: skipped", project.Root)
+		return nil, false
+	}
+
+	ctx, cancel := projectContext()
+	defer cancel()
+	wt, err := newWorkingTree(ctx, project.Root, &project.RepoRoot)
+	if err != nil {
+		log.Errorf("%s: %s", project.Root, err)
+		versionMissing()
+		return nil, false
+	}
+
+	dir := src.VendoredDir(project)
+	ref, differences, err := src.ClosestRefContext(ctx, project, wt, dir, nil)
+	switch {
+	case err == nil:
+	case timedOut(ctx, project.Root):
+		versionMissing()
+		return nil, false
+	default:
+		checkInterrupted()
+		log.Errorf("%s: %s", repo, err)
+		versionMissing()
+		return nil, false
+	}
+	if differences == 0 {
+		log.Debugf("%s: matches %s", repo, ref.Ver)
+		return nil, false
+	}
+
+	var patch bytes.Buffer
+	changes, err := src.WritePatchContext(ctx, project, wt, &patch, dir, ref)
+	if err != nil {
+		checkInterrupted()
+		fatalf("%s: %s", repo, err)
+	}
+	return patch.Bytes(), changes
+}
+
+// runContains shows whether each upstream commit given by -commits
+// is included in the top-level project of each source, or in the
+// vendored project given by -vendored. The exit code is 8 if any is
+// not, or is only partially, included.
+func runContains(srcs []*retrodep.GoSource) int {
+	var commits []string
+	for _, commit := range strings.Split(*containsArg, ",") {
+		if commit = strings.TrimSpace(commit); commit != "" {
+			commits = append(commits, commit)
+		}
+	}
+	if len(commits) == 0 {
+		usage("missing commits")
+	}
+
+	missing := false
+	for _, src := range srcs {
+		if !containsSource(src, commits) {
+			missing = true
+		}
+	}
+
+	if missing {
+		return 8
+	}
+	return 0
+}
+
+// containsSource shows whether each of commits is included in the
+// project chosen by diffProject in src, returning false if any is
+// not, or is only partially, included.
+func containsSource(src *retrodep.GoSource, commits []string) bool {
+	project, dir := diffProject(src)
 
-			changes = changes || c
-		} else if *onlyImportPath {
+	ctx, cancel := projectContext()
+	defer cancel()
+	wt, err := newWorkingTree(ctx, dir, &project.RepoRoot)
+	if err != nil {
+		fatal(err)
+	}
+
+	// Without an exact match, files are compared instead
+	ref, err := src.DescribeProjectContext(ctx, project, wt, dir, nil)
+	switch {
+	case err == nil:
+		log.Infof("%s: matches %s", project.Root, ref.Ver)
+	case err == retrodep.ErrorVersionNotFound:
+		log.Infof("%s: no exact match, comparing files", project.Root)
+		ref = nil
+	default:
+		checkInterrupted()
+		fatalf("%s: %s", project.Root, err)
+	}
+
+	included := true
+	for _, commit := range commits {
+		status, err := src.FixIncluded(project, wt, dir, ref, commit)
+		if err != nil {
+			checkInterrupted()
+			fatal(err)
+		}
+		clearProgress()
+		fmt.Printf("%s %s: %s\n", project.Root, commit,
+			describeFixStatus(status))
+		switch status.Inclusion {
+		case retrodep.FixNotIncluded, retrodep.FixPartiallyIncluded:
+			included = false
+		}
+	}
+	return included
+}
+
+// describeFixStatus returns a description of whether a commit is
+// included, such as "partially included (files a.go, b.go match
+// post-fix)".
+func describeFixStatus(status *retrodep.FixStatus) string {
+	switch {
+	case status.Inclusion == retrodep.FixPartiallyIncluded:
+		return fmt.Sprintf("%s (files %s match post-fix)",
+			status.Inclusion, strings.Join(status.Matched, ", "))
+	case status.Inclusion == retrodep.FixNotApplicable:
+		return fmt.Sprintf("%s (no files it changed are present)",
+			status.Inclusion)
+	}
+	return string(status.Inclusion)
+}
+
+// runImportPath returns a function which shows the top-level import
+// path of each source, prefixed by marker.
+func runImportPath(marker string) func([]*retrodep.GoSource) int {
+	return func(srcs []*retrodep.GoSource) int {
+		for _, src := range srcs {
 			main := getProject(src, *importPath)
-			fmt.Println("*" + main.Root)
-		} else {
-			top := showTopLevel(tmpl, src)
-			if *depsFlag {
-				showVendored(tmpl, src, top)
-			}
+			fmt.Println(marker + main.Root)
 		}
+		return 0
 	}
+}
 
-	if errorShown {
-		os.Exit(2)
+// runCheck compares the vendored projects of each source with the
+// baseline saved for it.
+func runCheck(srcs []*retrodep.GoSource) int {
+	tmpl := parseTemplate()
+	saved := make(map[string]map[string]*retrodep.Baseline)
+	drifted := false
+	for _, src := range srcs {
+		// Unless given, each PATH has its own baseline file.
+		file := *checkArg
+		if file == "" {
+			file = filepath.Join(sourcePaths[src],
+				retrodep.DefaultBaselineFile)
+		}
+		if _, ok := saved[file]; !ok {
+			saved[file] = readBaselines(file)
+		}
+		if checkBaseline(tmpl, src, saved[file][src.SubPath]) {
+			drifted = true
+		}
+	}
+
+	if drifted {
+		return 6
+	}
+	return exitStatus()
+}
+
+// runList shows the vendored projects of each source without
+// consulting upstream repositories.
+func runList(srcs []*retrodep.GoSource) int {
+	var tmpl *template.Template
+	if *outputArg == "" {
+		tmpl = template.Must(template.New("list").Parse(listTemplate))
+	} else {
+		tmpl = parseTemplate()
+	}
+
+	for _, src := range srcs {
+		vendored, err := src.VendoredProjects()
+		if err != nil {
+			fatal(err)
+		}
+
+		var repos []string
+		for repo := range vendored {
+			repos = append(repos, repo)
+		}
+		sort.Strings(repos)
+
+		for _, repo := range repos {
+			project := vendored[repo]
+			if project.Err != nil {
+				log.Errorf("%s: %s", repo, project.Err)
+			}
+			display(tmpl, "", &retrodep.Reference{
+				Chain:    project.Chain,
+				Pkg:      project.Root,
+				Repo:     project.Repo,
+				Rule:     project.Rule,
+				Packages: project.Packages,
+			})
+		}
 	}
+	return 0
+}
 
-	if *diffArg != "" && changes {
-		os.Exit(5)
+func main() {
+	cmd, srcs := processArgs(os.Args)
+
+	var cancel context.CancelFunc
+	runContext, cancel = newRunContext()
+	defer cancel()
+	if progress := newProgress(); progress != nil {
+		runContext = retrodep.WithProgress(runContext, progress)
 	}
+
+	exit(cmd.run(srcs))
 }
@@ -16,11 +16,15 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"io"
 	"io/ioutil"
 	"os"
+	"strings"
 	"syscall"
 	"testing"
+	"text/template"
 
 	"github.com/release-engineering/retrodep/v2/retrodep"
 )
@@ -92,6 +96,48 @@ func TestDisplayUnknown(t *testing.T) {
 	}
 }
 
+func TestShowVendoredProjectUnknown(t *testing.T) {
+	tcs := []struct {
+		name     string
+		top      *retrodep.Reference
+		expected string
+	}{
+		{
+			"unresolvable top level",
+			nil,
+			"example.com/bar  \n",
+		},
+		{
+			"top level",
+			&retrodep.Reference{Pkg: "example.com/foo", Ver: "v1.0.0"},
+			"example.com/bar example.com/foo v1.0.0\n",
+		},
+	}
+
+	tmpl := template.Must(template.New("").Parse("{{.Pkg}} {{.TopPkg}} {{.TopVer}}"))
+	src := &retrodep.GoSource{}
+	project := &retrodep.RepoPath{Err: errors.New("unresolvable")}
+	project.Root = "example.com/bar"
+	for _, tc := range tcs {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			*templateArg = ""
+			r, reset := captureStdout(t)
+			showVendoredProject(tmpl, src, "example.com/bar", project, tc.top, nil)
+			reset()
+			output, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(output) != tc.expected {
+				t.Errorf("expected %q but got %q",
+					tc.expected, string(output))
+			}
+		})
+	}
+}
+
 func TestGetTemplate(t *testing.T) {
 	tcs := []struct {
 		name     string
@@ -132,3 +178,282 @@ func TestGetTemplate(t *testing.T) {
 		})
 	}
 }
+
+func TestDefaultTemplate(t *testing.T) {
+	tcs := []struct {
+		name     string
+		ref      *retrodep.Reference
+		expected string
+	}{
+		{
+			"top-level",
+			&retrodep.Reference{Pkg: "example.com/foo", Ver: "v1.0.0"},
+			"example.com/foo:v1.0.0\n",
+		},
+		{
+			"vendored",
+			&retrodep.Reference{
+				TopPkg: "example.com/foo",
+				TopVer: "v1.0.0",
+				Pkg:    "example.com/bar",
+			},
+			"example.com/foo:v1.0.0 example.com/bar:?\n",
+		},
+		{
+			"nested",
+			&retrodep.Reference{
+				TopPkg: "example.com/foo",
+				TopVer: "v1.0.0",
+				Chain:  []string{"example.com/bar"},
+				Pkg:    "example.com/baz",
+				Ver:    "v0.1.0",
+			},
+			"example.com/foo:v1.0.0 example.com/bar -> example.com/baz:v0.1.0\n",
+		},
+		{
+			"rule",
+			&retrodep.Reference{
+				Pkg:  "code.google.com/p/go-uuid",
+				Ver:  "v1.1.0",
+				Rule: "rules:1",
+			},
+			"code.google.com/p/go-uuid:v1.1.0 (rule rules:1)\n",
+		},
+		{
+			"omitted",
+			&retrodep.Reference{
+				Pkg:             "example.com/foo",
+				Ver:             "v1.0.0",
+				OmittedPackages: []string{"example.com/foo/cmd"},
+			},
+			"example.com/foo:v1.0.0\n  omitted: example.com/foo/cmd\n",
+		},
+		{
+			"binary",
+			&retrodep.Reference{
+				Pkg:      "example.com/foo",
+				Ver:      "v1.0.0",
+				Binaries: []string{"example.com/foo/rsrc.syso"},
+			},
+			"example.com/foo:v1.0.0\n  binary: example.com/foo/rsrc.syso\n",
+		},
+		{
+			"missing license",
+			&retrodep.Reference{
+				Pkg:                 "example.com/foo",
+				Ver:                 "v1.0.0",
+				Licenses:            []string{"MIT"},
+				MissingLicenseFiles: []string{"example.com/foo/LICENSE"},
+			},
+			"example.com/foo:v1.0.0\n  missing license: example.com/foo/LICENSE\n",
+		},
+	}
+
+	tmpl, err := template.New("output").Parse(defaultTemplate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range tcs {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			r, reset := captureStdout(t)
+			display(tmpl, "", tc.ref)
+			reset()
+			output, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(output) != tc.expected {
+				t.Errorf("expected %q but got %q",
+					tc.expected, string(output))
+			}
+		})
+	}
+}
+
+func TestProcessArgsCommand(t *testing.T) {
+	tcs := []struct {
+		name     string
+		args     []string
+		command  string
+		expected string
+	}{
+		{
+			"legacy",
+			[]string{"retrodep", "-o", "go-template={{.Pkg}}", "."},
+			"",
+			"{{.Pkg}}",
+		},
+		{
+			"describe",
+			[]string{"retrodep", "describe", "."},
+			"describe",
+			defaultTemplate,
+		},
+		{
+			"list",
+			[]string{"retrodep", "list", "-o", "go-template={{.Repo}}", "."},
+			"list",
+			"{{.Repo}}",
+		},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+
+		// Reset the flags.
+		*templateArg = ""
+		*outputArg = ""
+
+		t.Run(tc.name, func(t *testing.T) {
+			cmd, _ := processArgs(tc.args)
+			if cmd.name != tc.command {
+				t.Errorf("expected command %q but got %q",
+					tc.command, cmd.name)
+			}
+			tmpl := getTemplate()
+			if tmpl != tc.expected {
+				t.Errorf("expected %v but got %v",
+					tc.expected, tmpl)
+			}
+		})
+	}
+}
+
+func TestCombinedReport(t *testing.T) {
+	r := newCombinedReport()
+	r.add("two", &retrodep.Reference{Ver: "v1.1.0"}, "example.com/foo")
+	r.add("one", &retrodep.Reference{Ver: "v1.0.0"}, "example.com/foo")
+	r.add("three", nil, "example.com/foo")
+	r.add("one", &retrodep.Reference{Ver: "v0.2.0"}, "example.com/bar")
+	r.add("two", &retrodep.Reference{Ver: "v0.2.0"}, "example.com/bar")
+	r.add("two", &retrodep.Reference{Ver: "v0.2.0"}, "example.com/bar")
+	r.addVersion("four", "example.com/foo", "skipped")
+
+	var b strings.Builder
+	r.write(&b)
+	expected := `example.com/bar
+  v0.2.0: one, two
+example.com/foo
+  skipped: four
+  v1.0.0: one
+  v1.1.0: two
+  ?: three
+`
+	if b.String() != expected {
+		t.Errorf("expected %q but got %q", expected, b.String())
+	}
+}
+
+func TestDiffSummary(t *testing.T) {
+	project := &retrodep.RepoPath{}
+	project.Root = "example.com/foo"
+	diffs := []*retrodep.FileDiff{
+		retrodep.NewFileDiff("a.go", []byte("package a\n"),
+			[]byte("package a // import \"example.com/foo\"\n"), 3),
+		retrodep.NewFileDiff("b.go", nil, []byte("package a\n"), 3),
+	}
+
+	for _, rev := range []string{"v1.0.0", "0123456789ab"} {
+		b, err := json.Marshal(newDiffSummary("src", project, "v1.0.0",
+			rev, diffs))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := `{"Dir":"src","Project":"example.com/foo","Ref":"v1.0.0",`
+		if rev != "v1.0.0" {
+			expected += `"Rev":"` + rev + `",`
+		}
+		expected += `"Files":[` +
+			`{"Path":"a.go","Change":"modified","LinesAdded":1,"LinesRemoved":1,"ImportCommentOnly":true},` +
+			`{"Path":"b.go","Change":"added","LinesAdded":1,"LinesRemoved":0}]}`
+		if string(b) != expected {
+			t.Errorf("expected %s but got %s", expected, string(b))
+		}
+	}
+}
+
+func TestDescribeFixStatus(t *testing.T) {
+	tcs := []struct {
+		status   retrodep.FixStatus
+		expected string
+	}{
+		{
+			retrodep.FixStatus{Inclusion: retrodep.FixIncluded, Rev: "abc"},
+			"included",
+		},
+		{
+			retrodep.FixStatus{
+				Inclusion: retrodep.FixIncluded,
+				Changed:   []string{"a.go"},
+				Matched:   []string{"a.go"},
+			},
+			"included",
+		},
+		{
+			retrodep.FixStatus{
+				Inclusion: retrodep.FixPartiallyIncluded,
+				Changed:   []string{"a.go", "b.go", "c.go"},
+				Matched:   []string{"a.go", "c.go"},
+			},
+			"partially included (files a.go, c.go match post-fix)",
+		},
+		{
+			retrodep.FixStatus{
+				Inclusion: retrodep.FixNotIncluded,
+				Changed:   []string{"a.go"},
+			},
+			"not included",
+		},
+		{
+			retrodep.FixStatus{Inclusion: retrodep.FixNotApplicable},
+			"not applicable (no files it changed are present)",
+		},
+	}
+
+	for _, tc := range tcs {
+		if s := describeFixStatus(&tc.status); s != tc.expected {
+			t.Errorf("expected %q but got %q", tc.expected, s)
+		}
+	}
+}
+
+type closeRecorder struct {
+	retrodep.WorkingTree
+	closed bool
+}
+
+func (wt *closeRecorder) Close() error {
+	wt.closed = true
+	return nil
+}
+
+func TestWorkingTreeCache(t *testing.T) {
+	c := newWorkingTreeCache(2)
+	a, b, d := &closeRecorder{}, &closeRecorder{}, &closeRecorder{}
+	c.add("a", a)
+	c.add("b", b)
+
+	// Using a makes b the least recently used.
+	if wt, ok := c.get("a"); !ok || wt != a {
+		t.Fatal("a not cached")
+	}
+	c.add("d", d)
+	if !b.closed || a.closed || d.closed {
+		t.Errorf("expected only b closed: %t %t %t", a.closed, b.closed,
+			d.closed)
+	}
+	if _, ok := c.get("b"); ok {
+		t.Error("b still cached")
+	}
+
+	c.closeAll()
+	if !a.closed || !d.closed {
+		t.Error("not all closed")
+	}
+	if _, ok := c.get("a"); ok {
+		t.Error("a still cached")
+	}
+}
@@ -0,0 +1,168 @@
+// Copyright (C) 2019 Tim Waugh
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	stdlog "log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/op/go-logging"
+	"github.com/release-engineering/retrodep/v2/retrodep"
+)
+
+// maxProgressWidth limits the progress line so that it does not wrap
+// on a typical terminal.
+const maxProgressWidth = 79
+
+// progressLine is the progress display on stderr, if there is one.
+var progressLine *progressDisplay
+
+// progressDisplay shows the latest progress event on a single,
+// repeatedly overwritten, line of a terminal.
+type progressDisplay struct {
+	mu    sync.Mutex
+	w     io.Writer
+	shown bool
+}
+
+// Progress implements the retrodep.Progress interface.
+func (d *progressDisplay) Progress(ev retrodep.ProgressEvent) {
+	var msg string
+	switch ev.Kind {
+	case retrodep.ProgressMatched:
+		d.clear()
+		return
+	case retrodep.ProgressTryingTag:
+		msg = fmt.Sprintf("%s: trying tag %s (%d/%d)",
+			ev.Project, ev.Ref, ev.N, ev.Total)
+	case retrodep.ProgressTryingRevision:
+		rev := ev.Ref
+		if len(rev) > 12 {
+			rev = rev[:12]
+		}
+		msg = fmt.Sprintf("%s: trying revision %s (%d/%d)",
+			ev.Project, rev, ev.N, ev.Total)
+	default:
+		msg = fmt.Sprintf("%s: %s", ev.Project, ev.Kind)
+	}
+	if len(msg) > maxProgressWidth {
+		msg = msg[:maxProgressWidth]
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	fmt.Fprintf(d.w, "\r\x1b[K%s", msg)
+	d.shown = true
+}
+
+// clear removes the progress line, ready for other output.
+func (d *progressDisplay) clear() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.shown {
+		fmt.Fprint(d.w, "\r\x1b[K")
+		d.shown = false
+	}
+}
+
+// clearProgress removes the progress line, if shown.
+func clearProgress() {
+	if progressLine != nil {
+		progressLine.clear()
+	}
+}
+
+// progressBackend is a logging.Backend which removes the progress
+// line before logging.
+type progressBackend struct {
+	logging.Backend
+}
+
+// Log implements the logging.Backend interface.
+func (b progressBackend) Log(level logging.Level, calldepth int, rec *logging.Record) error {
+	clearProgress()
+	return b.Backend.Log(level, calldepth+1, rec)
+}
+
+// progressStream writes progress events as JSON, one per line.
+type progressStream struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// Progress implements the retrodep.Progress interface.
+func (s *progressStream) Progress(ev retrodep.ProgressEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.enc.Encode(struct {
+		Time time.Time
+		retrodep.ProgressEvent
+	}{time.Now(), ev})
+	if err != nil {
+		log.Errorf("%s: %s", *progressJSONArg, err)
+	}
+}
+
+// isTerminal reports whether f is a terminal.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// newProgress returns the retrodep.Progress to report to, or nil if
+// progress is not wanted. Progress is displayed on stderr if it is a
+// terminal, unless debugging output is enabled, and written to the
+// -progress-json file if supplied.
+func newProgress() retrodep.Progress {
+	var progress []retrodep.Progress
+	if *progressFlag && !*debugFlag && isTerminal(os.Stderr) {
+		progressLine = &progressDisplay{w: os.Stderr}
+		progress = append(progress, progressLine)
+
+		// Log messages must not be appended to the progress
+		// line.
+		level := logging.GetLevel("retrodep")
+		logging.SetBackend(progressBackend{
+			logging.NewLogBackend(os.Stderr, "", stdlog.LstdFlags),
+		})
+		logging.SetLevel(level, "retrodep")
+	}
+
+	if *progressJSONArg != "" {
+		f, err := os.Create(*progressJSONArg)
+		if err != nil {
+			fatal(err)
+		}
+		progress = append(progress, &progressStream{enc: json.NewEncoder(f)})
+	}
+
+	switch len(progress) {
+	case 0:
+		return nil
+	case 1:
+		return progress[0]
+	}
+	return retrodep.ProgressFunc(func(ev retrodep.ProgressEvent) {
+		for _, p := range progress {
+			p.Progress(ev)
+		}
+	})
+}
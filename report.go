@@ -0,0 +1,134 @@
+// Copyright (C) 2019 Tim Waugh
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/release-engineering/retrodep/v2/retrodep"
+)
+
+// report is the combined report being collected, if -combined was
+// given.
+var report *combinedReport
+
+// combinedReport collects the versions of projects found in several
+// Go source trees, so that each project is shown once.
+type combinedReport struct {
+	// trees maps project import paths to versions to the trees
+	// using that version.
+	trees map[string]map[string][]string
+}
+
+func newCombinedReport() *combinedReport {
+	return &combinedReport{trees: make(map[string]map[string][]string)}
+}
+
+// add records that the tree uses the project described by ref, whose
+// import path is root. If the version is not known, ref may be nil.
+func (r *combinedReport) add(tree string, ref *retrodep.Reference, root string) {
+	ver := "?"
+	if ref != nil && ref.Ver != "" {
+		ver = ref.Ver
+	}
+	r.addVersion(tree, root, ver)
+}
+
+// addVersion records that the tree uses version ver of the project
+// whose import path is root.
+func (r *combinedReport) addVersion(tree, root, ver string) {
+	versions, ok := r.trees[root]
+	if !ok {
+		versions = make(map[string][]string)
+		r.trees[root] = versions
+	}
+	for _, t := range versions[ver] {
+		if t == tree {
+			// Already seen, e.g. through a different
+			// chain of vendored projects.
+			return
+		}
+	}
+	versions[ver] = append(versions[ver], tree)
+}
+
+// write shows each project, followed by its versions and the trees
+// using them. Unknown versions are shown last.
+func (r *combinedReport) write(w io.Writer) {
+	var roots []string
+	for root := range r.trees {
+		roots = append(roots, root)
+	}
+	sort.Strings(roots)
+
+	for _, root := range roots {
+		fmt.Fprintln(w, root)
+		versions := r.trees[root]
+		var vers []string
+		for ver := range versions {
+			vers = append(vers, ver)
+		}
+		sort.Slice(vers, func(i, j int) bool {
+			if vers[i] == "?" || vers[j] == "?" {
+				return vers[j] == "?" && vers[i] != "?"
+			}
+			return vers[i] < vers[j]
+		})
+		for _, ver := range vers {
+			trees := versions[ver]
+			sort.Strings(trees)
+			fmt.Fprintf(w, "  %s: %s\n", ver, strings.Join(trees, ", "))
+		}
+	}
+}
+
+// diffSummary summarises the differences between the local copy of a
+// project and an upstream ref, for -o json in diff mode.
+type diffSummary struct {
+	// Dir is the directory holding the local copy.
+	Dir string
+
+	// Project is the repository root import path.
+	Project string
+
+	// Ref is the upstream ref compared with, as given or as the
+	// closest match, and Rev is its revision if known.
+	Ref string
+	Rev string `json:",omitempty"`
+
+	Files []retrodep.FileChange
+}
+
+// newDiffSummary returns the summary of diffs, comparing dir with the
+// ref (whose revision is rev) of project.
+func newDiffSummary(dir string, project *retrodep.RepoPath, ref, rev string, diffs []*retrodep.FileDiff) *diffSummary {
+	s := &diffSummary{
+		Dir:     dir,
+		Project: project.Root,
+		Ref:     ref,
+		Files:   make([]retrodep.FileChange, 0, len(diffs)),
+	}
+	if rev != ref {
+		s.Rev = rev
+	}
+	for _, d := range diffs {
+		s.Files = append(s.Files, d.Summary())
+	}
+	return s
+}
@@ -0,0 +1,106 @@
+// Copyright (C) 2019 Tim Waugh
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package retrodep
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// packageAssetExts holds the extensions of files, other than Go
+// source, which the go tool builds into a package: C, C++,
+// Objective-C, Fortran and assembly sources and headers, SWIG
+// interfaces, and system object files.
+var packageAssetExts = map[string]struct{}{
+	".c": {}, ".h": {},
+	".cc": {}, ".cpp": {}, ".cxx": {},
+	".hh": {}, ".hpp": {}, ".hxx": {},
+	".m": {},
+	".f": {}, ".F": {}, ".for": {}, ".f90": {},
+	".s": {}, ".S": {}, ".sx": {},
+	".swig": {}, ".swigcxx": {},
+	".syso": {},
+}
+
+// definitionExts holds the extensions of interface definition files,
+// from which Go source is generated. Some projects are vendored only
+// for these.
+var definitionExts = map[string]struct{}{
+	".proto":  {},
+	".thrift": {},
+	".fbs":    {},
+}
+
+// isPackageAsset returns true if the relative path p names a file,
+// other than Go source, which the go tool builds into the package
+// in its directory.
+func isPackageAsset(p string) bool {
+	_, ok := packageAssetExts[filepath.Ext(p)]
+	return ok && !ignoredByGoTool(p)
+}
+
+// isProjectFile returns true if the path p names a file which
+// shows that the directory holding it belongs to a vendored project:
+// Go source, a package asset, or an interface definition.
+func isProjectFile(p string) bool {
+	ext := filepath.Ext(p)
+	if ext == ".go" {
+		return true
+	}
+	if _, ok := packageAssetExts[ext]; ok {
+		return true
+	}
+	_, ok := definitionExts[ext]
+	return ok
+}
+
+// binaryFiles returns the sorted, slash-separated, paths from hashes
+// whose files in dir are binary. Their source code cannot be
+// compared, so they deserve review even when they match upstream.
+func binaryFiles(dir string, hashes FileHashes) ([]string, error) {
+	var binaries []string
+	buf := make([]byte, 8000)
+	for path := range hashes {
+		head, err := readFileHead(filepath.Join(dir, path), buf)
+		if err != nil {
+			return nil, errors.Wrap(err, "binaryFiles")
+		}
+		if isBinary(head) {
+			binaries = append(binaries, filepath.ToSlash(path))
+		}
+	}
+	sort.Strings(binaries)
+	return binaries, nil
+}
+
+// readFileHead reads the start of the file at path into buf,
+// returning the part of buf filled.
+func readFileHead(path string, buf []byte) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	return buf[:n], nil
+}
@@ -0,0 +1,115 @@
+// Copyright (C) 2019 Tim Waugh
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package retrodep
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"golang.org/x/tools/go/vcs"
+)
+
+func TestVendoredProjectsAssets(t *testing.T) {
+	src, err := NewGoSource("testdata/assets", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vendored, err := src.VendoredProjects()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Projects with no Go source are found from their other
+	// files, but data files alone are not enough.
+	expected := map[string][]string{
+		"github.com/foo/asm":   {"github.com/foo/asm"},
+		"github.com/foo/blob":  {"github.com/foo/blob"},
+		"github.com/foo/csrc":  nil,
+		"github.com/foo/proto": nil,
+	}
+	var roots []string
+	for root, project := range vendored {
+		roots = append(roots, root)
+		if project.Err != nil {
+			t.Errorf("%s: %s", root, project.Err)
+			continue
+		}
+		pkgs, ok := expected[root]
+		if !ok {
+			continue
+		}
+		if !reflect.DeepEqual(project.Packages, pkgs) {
+			t.Errorf("%s: expected packages %v, got %v", root,
+				pkgs, project.Packages)
+		}
+	}
+	sort.Strings(roots)
+	if len(roots) != len(expected) {
+		t.Errorf("expected %d projects, got %v", len(expected), roots)
+	}
+}
+
+func TestBinaryFiles(t *testing.T) {
+	dir := "testdata/assets/vendor/github.com/foo/blob"
+	hashes, err := NewFileHashes(&sha256Hasher{}, dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	binaries, err := binaryFiles(dir, hashes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"rsrc_amd64.syso"}
+	if !reflect.DeepEqual(binaries, expected) {
+		t.Errorf("expected %v, got %v", expected, binaries)
+	}
+
+	project := &RepoPath{RepoRoot: vcs.RepoRoot{Root: "github.com/foo/blob"}}
+	ref, err := newReference(project, nil, dir, hashes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []string{"github.com/foo/blob/rsrc_amd64.syso"}
+	if !reflect.DeepEqual(ref.Binaries, expected) {
+		t.Errorf("expected %v, got %v", expected, ref.Binaries)
+	}
+}
+
+func TestMissingFromPackagesAssets(t *testing.T) {
+	local := FileHashes{
+		"add.go":   "1",
+		"c/x.h":    "2",
+		"data.txt": "3",
+	}
+	upstream := FileHashes{
+		"add.go":        "1",
+		"add_amd64.s":   "4",
+		"c/x.h":         "2",
+		"c/y.h":         "5",
+		"data.txt":      "3",
+		"more.txt":      "6",
+		"testdata/t.c":  "7",
+		"other/other.c": "8",
+	}
+
+	// Only files built into packages present locally are missing
+	missing := local.MissingFromPackages(upstream)
+	expected := []string{"add_amd64.s"}
+	if !reflect.DeepEqual(missing, expected) {
+		t.Errorf("expected %v, got %v", expected, missing)
+	}
+}
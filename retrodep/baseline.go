@@ -0,0 +1,257 @@
+// Copyright (C) 2019 Tim Waugh
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package retrodep
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/pkg/errors"
+	"golang.org/x/tools/go/vcs"
+)
+
+// DefaultBaselineFile is the conventional name for a file, at the
+// top-level of the tree, holding saved baselines. As its name begins
+// with "." it is not considered when matching against upstream.
+const DefaultBaselineFile = ".retrodep.lock"
+
+// Baseline records the identified versions of the vendored projects
+// in a GoSource, along with their local file hashes. This allows
+// later changes to the vendored copies to be detected without
+// consulting the upstream repositories.
+type Baseline struct {
+	// SubPath is the GoSource's SubPath.
+	SubPath string
+
+	// Top is the Reference for the top-level project, if known.
+	Top *Reference `json:",omitempty"`
+
+	// Projects holds the vendored projects.
+	Projects []*BaselineProject
+}
+
+// BaselineProject is the saved state of a single vendored project.
+type BaselineProject struct {
+	Reference
+
+	// Dir is the filepath of the vendored copy, relative to the
+	// GoSource's Path.
+	Dir string
+
+	// VCS is the command name of the upstream version control
+	// system, which determines how file hashes are calculated. It
+	// is "" if the upstream repository is not known.
+	VCS string
+
+	// Hashes holds the local file hashes.
+	Hashes FileHashes
+}
+
+// BaselineDrift describes the ways in which a GoSource no longer
+// matches its Baseline.
+type BaselineDrift struct {
+	// Drifted holds the saved state of vendored projects whose
+	// files have changed.
+	Drifted []*BaselineProject
+
+	// Untracked holds the filepaths, relative to the GoSource's
+	// Path, of files in the vendor directory which would identify
+	// a vendored project but belong to no project in the
+	// Baseline.
+	Untracked []string
+}
+
+// hasherForVCS returns a Hasher which calculates file hashes in the
+// same way as a WorkingTree for the version control system named
+// cmd, without needing a local checkout. If cmd is "" file contents
+// are hashed.
+func hasherForVCS(cmd string) (Hasher, error) {
+	switch cmd {
+	case "":
+		return &sha256Hasher{}, nil
+	case vcsGit:
+		return &gitHasher{}, nil
+	case vcsHg:
+		return &sha256Hasher{}, nil
+	}
+	return nil, ErrorUnknownVCS
+}
+
+// NewBaseline returns a Baseline for src with no projects.
+func (src GoSource) NewBaseline(top *Reference) *Baseline {
+	return &Baseline{
+		SubPath: src.SubPath,
+		Top:     top,
+	}
+}
+
+// AddProject hashes the local files of the vendored project and adds
+// it, along with its Reference, to the Baseline. Projects whose
+// upstream repository is not known, for instance because the import
+// path could not be resolved, are added too so that their files are
+// not reported as untracked.
+func (src GoSource) AddProject(b *Baseline, project *RepoPath, ref *Reference) error {
+	var cmd string
+	if project.VCS != nil {
+		cmd = project.VCS.Cmd
+	}
+	hasher, err := hasherForVCS(cmd)
+	if err != nil {
+		return err
+	}
+
+	dir := src.VendoredDir(project)
+	hashes, err := src.hashLocalFiles(hasher, project, dir)
+	if err != nil {
+		return err
+	}
+
+	rel, err := filepath.Rel(src.Path, dir)
+	if err != nil {
+		return errors.Wrapf(err, "Rel(%q, %q)", src.Path, dir)
+	}
+
+	b.Projects = append(b.Projects, &BaselineProject{
+		Reference: *ref,
+		Dir:       filepath.ToSlash(rel),
+		VCS:       cmd,
+		Hashes:    hashes,
+	})
+	return nil
+}
+
+// RepoPath returns a RepoPath for the saved project, suitable for
+// re-identifying it.
+func (p *BaselineProject) RepoPath(src *GoSource) *RepoPath {
+	return &RepoPath{
+		RepoRoot: vcs.RepoRoot{
+			VCS:  vcs.ByCmd(p.VCS),
+			Repo: p.Repo,
+			Root: p.Pkg,
+		},
+		Dir:   filepath.Join(src.Path, filepath.FromSlash(p.Dir)),
+		Chain: p.Chain,
+	}
+}
+
+// CheckBaseline re-hashes the local files of each vendored project in
+// the Baseline and reports those which have changed. No upstream
+// repositories are consulted.
+func (src GoSource) CheckBaseline(b *Baseline) (*BaselineDrift, error) {
+	drift := &BaselineDrift{}
+	for _, saved := range b.Projects {
+		hasher, err := hasherForVCS(saved.VCS)
+		if err != nil {
+			return nil, errors.Wrap(err, saved.Pkg)
+		}
+
+		project := saved.RepoPath(&src)
+		hashes, err := src.hashLocalFiles(hasher, project, project.Dir)
+		if err != nil && err != ErrorNoFiles {
+			return nil, err
+		}
+
+		if !hashes.Equal(saved.Hashes) {
+			log.Debugf("%s: drifted", saved.Pkg)
+			drift.Drifted = append(drift.Drifted, saved)
+		}
+	}
+
+	untracked, err := src.untrackedVendored(b)
+	if err != nil {
+		return nil, err
+	}
+	drift.Untracked = untracked
+	return drift, nil
+}
+
+// untrackedVendored returns the files in the vendor directory which
+// would identify a vendored project (see isProjectFile) but are not
+// within the directory of any project in the Baseline. Excluded
+// paths are ignored.
+func (src GoSource) untrackedVendored(b *Baseline) ([]string, error) {
+	var dirs []string
+	for _, saved := range b.Projects {
+		dirs = append(dirs, filepath.Join(src.Path, filepath.FromSlash(saved.Dir)))
+	}
+
+	vendor := src.Vendor()
+	var untracked []string
+	walkfn := func(pth string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if pth != vendor && src.isExcluded(pth, info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		for _, dir := range dirs {
+			if pathStartsWith(pth, dir) {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+		}
+		if !info.Mode().IsRegular() || !isProjectFile(pth) {
+			return nil
+		}
+		rel, err := filepath.Rel(src.Path, pth)
+		if err != nil {
+			return err
+		}
+		untracked = append(untracked, filepath.ToSlash(rel))
+		return nil
+	}
+
+	if _, err := os.Stat(vendor); err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if err := filepath.Walk(vendor, walkfn); err != nil {
+		return nil, err
+	}
+	sort.Strings(untracked)
+	return untracked, nil
+}
+
+// WriteBaselines writes the baselines to w in JSON format.
+func WriteBaselines(w io.Writer, baselines []*Baseline) error {
+	data, err := json.MarshalIndent(baselines, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+// ReadBaselines reads baselines in the format written by
+// WriteBaselines.
+func ReadBaselines(r io.Reader) ([]*Baseline, error) {
+	var baselines []*Baseline
+	err := json.NewDecoder(r).Decode(&baselines)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading baselines")
+	}
+	return baselines, nil
+}
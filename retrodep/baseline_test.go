@@ -0,0 +1,210 @@
+// Copyright (C) 2019 Tim Waugh
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package retrodep
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"golang.org/x/tools/go/vcs"
+)
+
+func TestBaseline(t *testing.T) {
+	src, err := NewGoSource("testdata/gosource", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	project := &RepoPath{
+		RepoRoot: vcs.RepoRoot{
+			VCS:  vcs.ByCmd(vcsGit),
+			Repo: "https://github.com/foo/bar",
+			Root: "github.com/foo/bar",
+		},
+	}
+	ref := &Reference{
+		TopPkg: "example.com/top",
+		Pkg:    "github.com/foo/bar",
+		Repo:   "https://github.com/foo/bar",
+		Ver:    "v1.0.0",
+	}
+
+	b := src.NewBaseline(&Reference{Pkg: "example.com/top"})
+	err = src.AddProject(b, project, ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Projects[0].Dir != "vendor/github.com/foo/bar" {
+		t.Errorf("Dir: got %q", b.Projects[0].Dir)
+	}
+
+	// Round-trip
+	var buf bytes.Buffer
+	err = WriteBaselines(&buf, []*Baseline{b})
+	if err != nil {
+		t.Fatal(err)
+	}
+	baselines, err := ReadBaselines(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(baselines) != 1 || len(baselines[0].Projects) != 1 {
+		t.Fatalf("unexpected baselines: %v", baselines)
+	}
+	b = baselines[0]
+	if b.Projects[0].Ver != "v1.0.0" {
+		t.Errorf("Ver: got %q", b.Projects[0].Ver)
+	}
+
+	drift, err := src.CheckBaseline(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if drift.Drifted != nil {
+		t.Errorf("unexpected drift: %v", drift.Drifted)
+	}
+	expUntracked := []string{
+		"vendor/github.com/eggs/ham/ham.go",
+		"vendor/github.com/eggs/ham/spam/ignored.go",
+	}
+	if len(drift.Untracked) != len(expUntracked) {
+		t.Fatalf("Untracked: got %v, want %v", drift.Untracked, expUntracked)
+	}
+	for i, u := range expUntracked {
+		if drift.Untracked[i] != u {
+			t.Errorf("Untracked: got %v, want %v", drift.Untracked, expUntracked)
+			break
+		}
+	}
+
+	// Pretend the local copy has changed.
+	b.Projects[0].Hashes["bar.go"] = "0"
+	drift, err = src.CheckBaseline(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(drift.Drifted) != 1 || drift.Drifted[0].Pkg != "github.com/foo/bar" {
+		t.Errorf("Drifted: got %v", drift.Drifted)
+	}
+}
+
+func TestBaselineUnresolved(t *testing.T) {
+	src, err := NewGoSource("testdata/gosource", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src.Resolver = ResolverFunc(func(importPath string) (*vcs.RepoRoot, error) {
+		if strings.HasPrefix(importPath, "github.com/eggs/") {
+			return nil, errors.New("unresolvable")
+		}
+		return VCSResolver.RepoRootForImportPath(importPath)
+	})
+
+	vendored, err := src.VendoredProjects()
+	if err != nil {
+		t.Fatal(err)
+	}
+	project, ok := vendored["github.com/eggs/ham"]
+	if !ok || project.Err == nil {
+		t.Fatalf("expected unresolvable project: %v", vendored)
+	}
+
+	// Every project is saved, even without a Reference to its
+	// upstream repository.
+	b := src.NewBaseline(nil)
+	for _, project := range vendored {
+		ref := &Reference{Pkg: project.Root}
+		if err := src.AddProject(b, project, ref); err != nil {
+			t.Fatalf("%s: %s", project.Root, err)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := WriteBaselines(&buf, []*Baseline{b}); err != nil {
+		t.Fatal(err)
+	}
+	baselines, err := ReadBaselines(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	drift, err := src.CheckBaseline(baselines[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if drift.Drifted != nil || drift.Untracked != nil {
+		t.Errorf("unexpected drift: %v %v", drift.Drifted, drift.Untracked)
+	}
+}
+
+func TestUntrackedVendored(t *testing.T) {
+	dir, err := ioutil.TempDir("", "retrodep-test.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := []string{
+		"vendor/example.com/saved/saved.go",
+		"vendor/example.com/asm/asm_amd64.s",
+		"vendor/example.com/api/api.proto",
+		"vendor/example.com/api/README.md",
+		"vendor/example.com/excluded/excluded.go",
+		"vendor/example.com/other/excluded.c",
+		"vendor/example.com/other/other.go",
+	}
+	for _, f := range files {
+		pth := filepath.Join(dir, filepath.FromSlash(f))
+		if err := os.MkdirAll(filepath.Dir(pth), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(pth, []byte{}, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	src := GoSource{
+		Path: dir,
+		excludes: NewExcludes([]string{
+			"vendor/example.com/excluded",
+			"vendor/example.com/other/excluded.c",
+		}),
+	}
+	b := &Baseline{
+		Projects: []*BaselineProject{
+			{Dir: "vendor/example.com/saved"},
+		},
+	}
+	untracked, err := src.untrackedVendored(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Package assets and interface definitions are reported as
+	// well as Go source, but excluded paths are not.
+	expected := []string{
+		"vendor/example.com/api/api.proto",
+		"vendor/example.com/asm/asm_amd64.s",
+		"vendor/example.com/other/other.go",
+	}
+	if strings.Join(untracked, " ") != strings.Join(expected, " ") {
+		t.Errorf("got %v, want %v", untracked, expected)
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright (C) 2019 Tim Waugh
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package retrodep
+
+import (
+	"context"
+)
+
+// ClosestRef returns a Reference for the tag or revision whose files
+// in the project best match the files in dir, together with the
+// number of local files which differ from it. If DescribeProject
+// finds a match, that is the result and the number is 0. Otherwise
+// the tag or revision with the fewest differing files is chosen,
+// preferring tags to revisions and newer revisions to older ones.
+func (src GoSource) ClosestRef(project *RepoPath, wt WorkingTree, dir string, top *Reference) (*Reference, int, error) {
+	return src.closestRef(context.Background(), project, wt, dir, top)
+}
+
+// ClosestRefContext is like ClosestRef but gives up, with ctx.Err(),
+// once ctx is done.
+func (src GoSource) ClosestRefContext(ctx context.Context, project *RepoPath, wt WorkingTree, dir string, top *Reference) (*Reference, int, error) {
+	wt = WorkingTreeWithContext(ctx, wt)
+	return src.closestRef(ctx, project, wt, dir, top)
+}
+
+func (src GoSource) closestRef(ctx context.Context, project *RepoPath, wt WorkingTree, dir string, top *Reference) (*Reference, int, error) {
+	ref, err := src.describeProject(ctx, project, wt, dir, top)
+	if err != ErrorVersionNotFound {
+		return ref, 0, err
+	}
+
+	hashes, err := src.hashLocalFiles(wt, project, dir)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	trying := func(kind ProgressKind) ProgressEvent {
+		return ProgressEvent{Kind: kind, Project: project.Root}
+	}
+
+	tags, err := wt.VersionTags()
+	if err != nil {
+		return nil, 0, err
+	}
+	normalisers := src.normalisersFor(dir)
+	tag, tagDiffs, err := closestFromRefs(ctx, trying(ProgressTryingTag),
+		normalisers, hashes, wt, project.SubPath, tags)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	revs, err := wt.Revisions()
+	if err != nil {
+		return nil, 0, err
+	}
+	rev, revDiffs, err := closestFromRefs(ctx,
+		trying(ProgressTryingRevision), normalisers, hashes, wt,
+		project.SubPath, revs)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	ref, err = newReference(project, top, dir, hashes)
+	if err != nil {
+		return nil, 0, err
+	}
+	switch {
+	case tag != "" && (rev == "" || tagDiffs <= revDiffs):
+		ref.Rev, err = wt.RevisionFromTag(tag)
+		if err != nil {
+			return nil, 0, err
+		}
+		ref.Tag = tag
+		ref.Ver = tag
+		return ref, tagDiffs, nil
+	case rev != "":
+		ref.Ver, err = PseudoVersion(wt, rev)
+		if err != nil {
+			return nil, 0, err
+		}
+		ref.Rev = rev
+		return ref, revDiffs, nil
+	}
+	return nil, 0, ErrorVersionNotFound
+}
+
+// closestFromRefs returns the first of refs whose files in subPath
+// differ least from hashes, and the number of local files which
+// differ from it. Files missing from packages present locally count
+// as differences. Upstream files are changed using the normalisers,
+// in the same way as the vendoring tool, before comparing. It returns
+// "" if there are no valid refs.
+func closestFromRefs(ctx context.Context, ev ProgressEvent, normalisers []Normaliser, hashes FileHashes, wt WorkingTree, subPath string, refs []string) (string, int, error) {
+	var closest string
+	fewest := -1
+	for i, ref := range refs {
+		if err := ctx.Err(); err != nil {
+			return "", 0, err
+		}
+		ev.Ref, ev.N, ev.Total = ref, i+1, len(refs)
+		reportProgress(ctx, ev)
+		refHashes, err := wt.FileHashesFromRef(ref, subPath)
+		if err != nil {
+			if err == ErrorInvalidRef {
+				continue
+			}
+			return "", 0, err
+		}
+
+		mismatches := hashes.Mismatches(refHashes, false)
+		missing := hashes.MissingFromPackages(refHashes)
+		if normalisers != nil && (mismatches != nil || missing != nil) {
+			paths := missing
+			for _, path := range mismatches {
+				if _, ok := refHashes[path]; ok {
+					paths = append(paths, path)
+				}
+			}
+			err := updateHashesAfterNormalise(refHashes, wt, ref,
+				subPath, paths, normalisers)
+			if err != nil {
+				return "", 0, err
+			}
+			mismatches = hashes.Mismatches(refHashes, false)
+			missing = hashes.MissingFromPackages(refHashes)
+		}
+		n := len(mismatches) + len(missing)
+		if fewest == -1 || n < fewest {
+			closest, fewest = ref, n
+		}
+	}
+	log.Debugf("closest from %d refs: %s (%d differences)", len(refs),
+		closest, fewest)
+	return closest, fewest, nil
+}
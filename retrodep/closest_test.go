@@ -0,0 +1,242 @@
+// Copyright (C) 2019 Tim Waugh
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package retrodep
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/tools/go/vcs"
+)
+
+// closestContent returns Go source content identified by s.
+func closestContent(s string) string {
+	return "package a // " + s + "\n"
+}
+
+// mockClosestWorkingTree has tags and revisions whose files have the
+// contents given by closestContent for the strings in refs.
+type mockClosestWorkingTree struct {
+	stubWorkingTree
+
+	tags, revs []string
+	refs       map[string]map[string]string
+}
+
+func (wt *mockClosestWorkingTree) VersionTags() ([]string, error) {
+	return wt.tags, nil
+}
+
+func (wt *mockClosestWorkingTree) Revisions() ([]string, error) {
+	return wt.revs, nil
+}
+
+func (wt *mockClosestWorkingTree) RevisionFromTag(tag string) (string, error) {
+	return "rev-" + tag, nil
+}
+
+func (wt *mockClosestWorkingTree) ReachableTag(rev string) (string, error) {
+	return "", ErrorVersionNotFound
+}
+
+func (wt *mockClosestWorkingTree) FileHashesFromRef(ref, _ string) (FileHashes, error) {
+	files, ok := wt.refs[strings.TrimPrefix(ref, "rev-")]
+	if !ok {
+		return nil, ErrorInvalidRef
+	}
+	hashes := make(FileHashes)
+	for path, content := range files {
+		h, err := wt.hashContent(path,
+			strings.NewReader(closestContent(content)))
+		if err != nil {
+			return nil, err
+		}
+		hashes[path] = h
+	}
+	return hashes, nil
+}
+
+func TestClosestRef(t *testing.T) {
+	wt := &mockClosestWorkingTree{
+		tags: []string{"v1.1.0", "v1.0.0"},
+		revs: []string{"333333333333333333333333", "222222222222222222222222", "111111111111111111111111"},
+		refs: map[string]map[string]string{
+			"v1.1.0":                   {"a.go": "a1", "b.go": "b1", "c.go": "c1"},
+			"v1.0.0":                   {"a.go": "a0", "b.go": "b0", "c.go": "c0"},
+			"333333333333333333333333": {"a.go": "a3", "b.go": "b3", "c.go": "c1"},
+			"222222222222222222222222": {"a.go": "a2", "b.go": "b1", "c.go": "c1"},
+			"111111111111111111111111": {"a.go": "a0", "b.go": "b0", "c.go": "c0"},
+		},
+	}
+	wt.hasher = &sha256Hasher{}
+	project := &RepoPath{RepoRoot: vcs.RepoRoot{Root: "example.com/a"}}
+
+	tcs := []struct {
+		local       map[string]string
+		ver, rev    string
+		differences int
+	}{
+		{
+			// Exact match
+			local: map[string]string{"a.go": "a0", "b.go": "b0", "c.go": "c0"},
+			ver:   "v1.0.0",
+			rev:   "rev-v1.0.0",
+		},
+		{
+			// Closest tag
+			local:       map[string]string{"a.go": "a0", "b.go": "b0", "c.go": "cX"},
+			ver:         "v1.0.0",
+			rev:         "rev-v1.0.0",
+			differences: 1,
+		},
+		{
+			// A tag is preferred to an equally close revision
+			local:       map[string]string{"a.go": "aX", "b.go": "b1", "c.go": "c1"},
+			ver:         "v1.1.0",
+			rev:         "rev-v1.1.0",
+			differences: 1,
+		},
+		{
+			// Closer revision, with missing file
+			local:       map[string]string{"a.go": "a3", "b.go": "b3"},
+			ver:         "v0.0.0-0.00010101000000-333333333333",
+			rev:         "333333333333333333333333",
+			differences: 1,
+		},
+	}
+
+	for i, tc := range tcs {
+		dir, err := ioutil.TempDir("", "retrodep-test.")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		for path, content := range tc.local {
+			err = ioutil.WriteFile(filepath.Join(dir, path),
+				[]byte(closestContent(content)), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		src, err := NewGoSource(dir, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ref, n, err := src.ClosestRef(project, wt, dir, nil)
+		if err != nil {
+			t.Errorf("%d: %s", i, err)
+			continue
+		}
+		if ref.Ver != tc.ver {
+			t.Errorf("%d: expected version %s, got %s", i, tc.ver,
+				ref.Ver)
+		}
+		if ref.Rev != tc.rev {
+			t.Errorf("%d: expected revision %s, got %s", i, tc.rev,
+				ref.Rev)
+		}
+		if n != tc.differences {
+			t.Errorf("%d: expected %d differences, got %d", i,
+				tc.differences, n)
+		}
+	}
+}
+
+// mockClosestSyncWorkingTree is a mockClosestWorkingTree whose files
+// can be read after syncing to a ref.
+type mockClosestSyncWorkingTree struct {
+	mockClosestWorkingTree
+
+	synced string
+}
+
+func (wt *mockClosestSyncWorkingTree) RevSync(rev string) error {
+	wt.synced = strings.TrimPrefix(rev, "rev-")
+	return nil
+}
+
+func (wt *mockClosestSyncWorkingTree) ReadFile(path string) ([]byte, error) {
+	content, ok := wt.refs[wt.synced][path]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return []byte(closestContent(content)), nil
+}
+
+// suffixNormaliser removes a suffix from upstream content, as though
+// a vendoring tool did.
+type suffixNormaliser struct{}
+
+func (suffixNormaliser) Name() string {
+	return "suffix"
+}
+
+func (suffixNormaliser) Normalise(path string, content []byte) ([]byte, bool) {
+	return []byte(strings.Replace(string(content), "-up", "", -1)), true
+}
+
+func TestClosestRefNormalised(t *testing.T) {
+	wt := &mockClosestSyncWorkingTree{
+		mockClosestWorkingTree: mockClosestWorkingTree{
+			tags: []string{"v1.1.0", "v1.0.0"},
+			refs: map[string]map[string]string{
+				"v1.1.0": {"a.go": "a1-up", "b.go": "b1-up", "c.go": "c1"},
+				"v1.0.0": {"a.go": "a1", "b.go": "b0", "c.go": "c0"},
+			},
+		},
+	}
+	wt.hasher = &sha256Hasher{}
+	project := &RepoPath{RepoRoot: vcs.RepoRoot{Root: "example.com/a"}}
+
+	top, err := ioutil.TempDir("", "retrodep-test.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(top)
+	dir := filepath.Join(top, "vendor", "example.com", "a")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	local := map[string]string{"a.go": "a1", "b.go": "b1", "c.go": "cX"}
+	for path, content := range local {
+		err = ioutil.WriteFile(filepath.Join(dir, path),
+			[]byte(closestContent(content)), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	src, err := NewGoSource(top, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src.Normalisers = []Normaliser{suffixNormaliser{}}
+
+	// Only c.go differs from v1.1.0 after normalisation, although
+	// v1.0.0 has fewer differences before it.
+	ref, n, err := src.ClosestRef(project, wt, dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ref.Ver != "v1.1.0" || n != 1 {
+		t.Errorf("expected v1.1.0 with 1 difference, got %s with %d",
+			ref.Ver, n)
+	}
+}
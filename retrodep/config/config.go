@@ -0,0 +1,114 @@
+// Copyright (C) 2019 Tim Waugh
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package config reads retrodep configuration files, which hold
+// project-level settings.
+package config
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v2"
+)
+
+// DefaultFile is the name of the configuration file at the top-level
+// of a project.
+const DefaultFile = ".retrodep.yaml"
+
+// Config holds project-level settings.
+type Config struct {
+	// ImportPath is the import path of the top-level project.
+	ImportPath string `yaml:"importpath"`
+
+	// Exclude holds patterns, in the format described in
+	// gitignore(5) and relative to the top-level of the project,
+	// for files to ignore when matching against upstream.
+	Exclude []string `yaml:"exclude"`
+
+	// Output is the output format, as for the -o flag.
+	Output string `yaml:"output"`
+
+	// Dependencies holds settings for vendored projects.
+	Dependencies []Dependency `yaml:"dependencies"`
+}
+
+// Dependency holds settings for a vendored project.
+type Dependency struct {
+	// ImportPath is the import path of the project's repository
+	// root.
+	ImportPath string `yaml:"importpath"`
+
+	// Repo is a replacement repository URL.
+	Repo string `yaml:"repo"`
+
+	// VCS is the version control system used by Repo. The
+	// default is "git".
+	VCS string `yaml:"vcs"`
+
+	// Version is a tag or revision to try first.
+	Version string `yaml:"version"`
+
+	// Skip is true if the project should not be identified.
+	Skip bool `yaml:"skip"`
+
+	// Forks holds repository URLs to try, in order, if no match
+	// is found in the project's own repository. They use the
+	// same version control system.
+	Forks []string `yaml:"forks"`
+
+	// Exclude holds patterns, in the same format as for Config
+	// but relative to the top-level of the vendored copy, for
+	// files in this project to ignore.
+	Exclude []string `yaml:"exclude"`
+}
+
+// Read parses a configuration file from r. Unknown settings are
+// reported as errors.
+func Read(r io.Reader) (*Config, error) {
+	dec := yaml.NewDecoder(r)
+	dec.SetStrict(true)
+	var conf Config
+	if err := dec.Decode(&conf); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	for i, dep := range conf.Dependencies {
+		if dep.ImportPath == "" {
+			return nil, fmt.Errorf("dependency %d: missing importpath", i+1)
+		}
+	}
+	return &conf, nil
+}
+
+// Load reads the file named file. If it does not exist, the returned
+// error satisfies os.IsNotExist.
+func Load(file string) (*Config, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Read(f)
+}
+
+// LoadProject reads DefaultFile from the top-level of the project at
+// projectRoot. If it does not exist, the returned error satisfies
+// os.IsNotExist.
+func LoadProject(projectRoot string) (*Config, error) {
+	return Load(filepath.Join(projectRoot, DefaultFile))
+}
@@ -0,0 +1,81 @@
+// Copyright (C) 2019 Tim Waugh
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package config
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLoadProject(t *testing.T) {
+	conf, err := LoadProject("../testdata/config")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := &Config{
+		ImportPath: "github.com/example/config",
+		Exclude:    []string{"Dockerfile"},
+		Output:     "go-template={{.Pkg}}",
+		Dependencies: []Dependency{
+			{
+				ImportPath: "github.com/foo/bar",
+				Repo:       "https://example.com/mirror/bar.git",
+				Version:    "v1.2.0",
+				Forks:      []string{"https://example.com/fork/bar.git"},
+				Exclude:    []string{"*.orig"},
+			},
+			{
+				ImportPath: "github.com/baz/qux",
+				Skip:       true,
+			},
+		},
+	}
+	if !reflect.DeepEqual(conf, expected) {
+		t.Errorf("expected %#v but got %#v", expected, conf)
+	}
+}
+
+func TestLoadProjectMissing(t *testing.T) {
+	_, err := LoadProject("../testdata/gosource")
+	if !os.IsNotExist(err) {
+		t.Errorf("expected IsNotExist, got %v", err)
+	}
+}
+
+func TestRead(t *testing.T) {
+	tcs := []struct {
+		name   string
+		conf   string
+		errors bool
+	}{
+		{"empty", "", false},
+		{"unknown setting", "imports: foo\n", true},
+		{"missing importpath", "dependencies:\n  - repo: foo\n", true},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := Read(strings.NewReader(tc.conf))
+			if (err != nil) != tc.errors {
+				t.Errorf("unexpected error result: %v", err)
+			}
+		})
+	}
+}
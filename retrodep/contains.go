@@ -0,0 +1,216 @@
+// Copyright (C) 2019 Tim Waugh
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package retrodep
+
+import (
+	"path/filepath"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// FixInclusion describes whether an upstream commit, such as a
+// security fix, is included in a local copy of a project.
+type FixInclusion string
+
+const (
+	// FixIncluded indicates the commit is included.
+	FixIncluded FixInclusion = "included"
+
+	// FixNotIncluded indicates the commit is not included.
+	FixNotIncluded FixInclusion = "not included"
+
+	// FixPartiallyIncluded indicates only some of the files
+	// changed by the commit match their content after it.
+	FixPartiallyIncluded FixInclusion = "partially included"
+
+	// FixNotApplicable indicates the commit changed no files in
+	// directories present in the local copy.
+	FixNotApplicable FixInclusion = "not applicable"
+)
+
+// FixStatus describes whether an upstream commit is included in a
+// local copy of a project.
+type FixStatus struct {
+	// Commit is the upstream commit.
+	Commit string
+
+	// Inclusion is whether the commit is included.
+	Inclusion FixInclusion
+
+	// Rev is the matched upstream revision whose ancestry was
+	// examined, or "" if files were compared instead.
+	Rev string
+
+	// Changed holds the files changed by the commit which were
+	// compared, relative to the project directory. Only files in
+	// directories present in the local copy are compared.
+	Changed []string
+
+	// Matched holds the files from Changed whose local content
+	// matches their content after the commit, or their content in
+	// a later revision descended from it. Files the commit removed
+	// match if they are missing locally.
+	Matched []string
+}
+
+// FixIncluded returns whether the upstream commit is included in the
+// local copy of project in dir. If ref has a revision, which
+// exactly matched the local copy, the answer comes from whether the
+// commit is one of its ancestors. Otherwise, each file the commit
+// changed is compared with its content after the commit, and in
+// revisions descended from it. A commit which changed no files in
+// directories present in the local copy is FixNotApplicable.
+func (src GoSource) FixIncluded(project *RepoPath, wt WorkingTree, dir string, ref *Reference, commit string) (*FixStatus, error) {
+	status := &FixStatus{Commit: commit}
+	if ref != nil && ref.Rev != "" {
+		included, err := wt.IsAncestor(commit, ref.Rev)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s: commit %s", project.Root, commit)
+		}
+		status.Rev = ref.Rev
+		status.Inclusion = FixNotIncluded
+		if included {
+			status.Inclusion = FixIncluded
+		}
+		return status, nil
+	}
+
+	hashes, err := src.hashLocalFiles(wt, project, dir)
+	if err != nil {
+		return nil, err
+	}
+	subPath := project.SubPath
+	after, err := wt.FileHashesFromRef(commit, subPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s: commit %s", project.Root, commit)
+	}
+	before := make(FileHashes)
+	parent, err := wt.ParentRevision(commit)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s: commit %s", project.Root, commit)
+	}
+	if parent != "" {
+		before, err = wt.FileHashesFromRef(parent, subPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	status.Changed = changedFiles(hashes, before, after)
+
+	// Change the upstream files in the same way as the vendoring
+	// tool before comparing.
+	var paths []string
+	for _, path := range status.Changed {
+		hash, ok := after[path]
+		if local, found := hashes[path]; ok && found && local != hash {
+			paths = append(paths, path)
+		}
+	}
+	normalisers := src.normalisersFor(dir)
+	if normalisers != nil && paths != nil {
+		err := updateHashesAfterNormalise(after, wt, commit, subPath,
+			paths, normalisers)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, path := range status.Changed {
+		hash, ok := after[path]
+		local, found := hashes[path]
+		if ok == found && hash == local {
+			log.Debugf("%s: matches %s", path, commit)
+			status.Matched = append(status.Matched, path)
+			continue
+		}
+		if !found {
+			continue
+		}
+
+		// The local content may be from a later revision
+		descendant, err := laterRevisionWithBlob(wt, commit,
+			filepath.Join(subPath, path), local)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s: commit %s", project.Root, commit)
+		}
+		if descendant {
+			log.Debugf("%s: matches a descendant of %s", path, commit)
+			status.Matched = append(status.Matched, path)
+		}
+	}
+
+	switch {
+	case len(status.Changed) == 0:
+		status.Inclusion = FixNotApplicable
+	case len(status.Matched) == 0:
+		status.Inclusion = FixNotIncluded
+	case len(status.Matched) == len(status.Changed):
+		status.Inclusion = FixIncluded
+	default:
+		status.Inclusion = FixPartiallyIncluded
+	}
+	return status, nil
+}
+
+// laterRevisionWithBlob returns whether the content whose hash is
+// hash was introduced at path, relative to the repository root, in a
+// revision descended from commit.
+func laterRevisionWithBlob(wt WorkingTree, commit, path string, hash FileHash) (bool, error) {
+	rev, err := wt.RevisionWithBlob(path, hash)
+	switch err {
+	case nil:
+	case ErrorVersionNotFound:
+		return false, nil
+	default:
+		return false, err
+	}
+	return wt.IsAncestor(commit, rev)
+}
+
+// changedFiles returns the sorted paths which differ between the
+// upstream file hashes before and after a commit, leaving out those
+// in directories not present in the hashes of the local copy.
+func changedFiles(hashes, before, after FileHashes) []string {
+	dirs := map[string]struct{}{".": {}}
+	for p := range hashes {
+		dirs[filepath.Dir(p)] = struct{}{}
+	}
+
+	paths := make(map[string]struct{})
+	for _, h := range []FileHashes{before, after} {
+		for p := range h {
+			paths[p] = struct{}{}
+		}
+	}
+
+	var changed []string
+	for p := range paths {
+		b, inBefore := before[p]
+		a, inAfter := after[p]
+		if inBefore == inAfter && a == b {
+			continue
+		}
+		if _, ok := dirs[filepath.Dir(p)]; !ok {
+			log.Debugf("%s: not present locally", p)
+			continue
+		}
+		changed = append(changed, p)
+	}
+	sort.Strings(changed)
+	return changed
+}
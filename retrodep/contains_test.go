@@ -0,0 +1,309 @@
+// Copyright (C) 2019 Tim Waugh
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package retrodep
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"golang.org/x/tools/go/vcs"
+)
+
+type mockFixWorkingTree struct {
+	mockAncestryWorkingTree
+
+	// files maps revisions to the content of each file
+	files map[string]map[string]string
+
+	// parents maps revisions to their parents
+	parents map[string]string
+}
+
+func (wt *mockFixWorkingTree) FileHashesFromRef(ref, _ string) (FileHashes, error) {
+	files, ok := wt.files[ref]
+	if !ok {
+		return nil, ErrorInvalidRef
+	}
+	hashes := make(FileHashes)
+	for path, content := range files {
+		h, err := wt.hashContent(path, strings.NewReader(content))
+		if err != nil {
+			return nil, err
+		}
+		hashes[path] = h
+	}
+	return hashes, nil
+}
+
+func (wt *mockFixWorkingTree) ParentRevision(rev string) (string, error) {
+	return wt.parents[rev], nil
+}
+
+// RevisionWithBlob returns the oldest revision, the one with fewest
+// ancestors, in which path has the content whose hash is hash.
+func (wt *mockFixWorkingTree) RevisionWithBlob(path string, hash FileHash) (string, error) {
+	found := ""
+	for rev, files := range wt.files {
+		content, ok := files[path]
+		if !ok {
+			continue
+		}
+		h, err := wt.hashContent(path, strings.NewReader(content))
+		if err != nil {
+			return "", err
+		}
+		if h != hash {
+			continue
+		}
+		if found == "" || len(wt.ancestors[rev]) < len(wt.ancestors[found]) {
+			found = rev
+		}
+	}
+	if found == "" {
+		return "", ErrorVersionNotFound
+	}
+	return found, nil
+}
+
+func TestFixIncluded(t *testing.T) {
+	wt := &mockFixWorkingTree{
+		mockAncestryWorkingTree: mockAncestryWorkingTree{
+			ancestors: map[string][]string{
+				"base": {"base"},
+				"fix":  {"base", "fix"},
+				"next": {"base", "fix", "next"},
+			},
+		},
+		files: map[string]map[string]string{
+			"base": {
+				"a.go":       "package a // 1\n",
+				"b.go":       "package a // 1\n",
+				"gone.go":    "package a // 1\n",
+				"sub/c.go":   "package sub // 1\n",
+				"other/d.go": "package other // 1\n",
+			},
+			"fix": {
+				"a.go":       "package a // 2\n",
+				"b.go":       "package a // 2\n",
+				"sub/c.go":   "package sub // 1\n",
+				"other/d.go": "package other // 2\n",
+			},
+			"next": {
+				"a.go":       "package a // 3\n",
+				"b.go":       "package a // 2\n",
+				"sub/c.go":   "package sub // 1\n",
+				"other/d.go": "package other // 3\n",
+			},
+		},
+		parents: map[string]string{"fix": "base", "next": "fix"},
+	}
+	wt.hasher = &sha256Hasher{}
+	project := &RepoPath{RepoRoot: vcs.RepoRoot{Root: "example.com/a"}}
+
+	// Files in directories not present locally are not compared
+	changed := []string{"a.go", "b.go", "gone.go"}
+	tcs := []struct {
+		name      string
+		local     map[string]string
+		ref       *Reference
+		inclusion FixInclusion
+		changed   []string
+		matched   []string
+	}{
+		{
+			name:      "ancestor",
+			local:     map[string]string{"a.go": "package a\n"},
+			ref:       &Reference{Rev: "next"},
+			inclusion: FixIncluded,
+		},
+		{
+			name:      "not ancestor",
+			local:     map[string]string{"a.go": "package a\n"},
+			ref:       &Reference{Rev: "base"},
+			inclusion: FixNotIncluded,
+		},
+		{
+			name: "post-fix",
+			local: map[string]string{
+				"a.go":     "package a // 2\n",
+				"b.go":     "package a // 2\n",
+				"sub/c.go": "package sub // 1\n",
+			},
+			inclusion: FixIncluded,
+			changed:   changed,
+			matched:   changed,
+		},
+		{
+			name: "descendant",
+			local: map[string]string{
+				"a.go":     "package a // 3\n",
+				"b.go":     "package a // 2\n",
+				"sub/c.go": "package sub // 1\n",
+			},
+			inclusion: FixIncluded,
+			changed:   changed,
+			matched:   changed,
+		},
+		{
+			name: "partial",
+			local: map[string]string{
+				"a.go":     "package a // 2\n",
+				"b.go":     "package a // 1\n",
+				"gone.go":  "package a // 1\n",
+				"sub/c.go": "package sub // 1\n",
+			},
+			inclusion: FixPartiallyIncluded,
+			changed:   changed,
+			matched:   []string{"a.go"},
+		},
+		{
+			name: "pre-fix",
+			local: map[string]string{
+				"a.go":     "package a // 1\n",
+				"b.go":     "package a // 3\n",
+				"gone.go":  "package a // 1\n",
+				"sub/c.go": "package sub // 1\n",
+			},
+			inclusion: FixNotIncluded,
+			changed:   changed,
+		},
+	}
+
+	for _, tc := range tcs {
+		dir, err := ioutil.TempDir("", "retrodep-test.")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		for path, content := range tc.local {
+			path = filepath.Join(dir, path)
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		src, err := NewGoSource(dir, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		status, err := src.FixIncluded(project, wt, dir, tc.ref, "fix")
+		if err != nil {
+			t.Fatalf("%s: %s", tc.name, err)
+		}
+		if status.Inclusion != tc.inclusion {
+			t.Errorf("%s: expected %q, got %q", tc.name, tc.inclusion,
+				status.Inclusion)
+		}
+		if !reflect.DeepEqual(status.Changed, tc.changed) {
+			t.Errorf("%s: expected changed %v, got %v", tc.name,
+				tc.changed, status.Changed)
+		}
+		if !reflect.DeepEqual(status.Matched, tc.matched) {
+			t.Errorf("%s: expected matched %v, got %v", tc.name,
+				tc.matched, status.Matched)
+		}
+	}
+}
+
+func TestFixNotApplicable(t *testing.T) {
+	wt := &mockFixWorkingTree{
+		mockAncestryWorkingTree: mockAncestryWorkingTree{
+			ancestors: map[string][]string{
+				"base": {"base"},
+				"fix":  {"base", "fix"},
+			},
+		},
+		files: map[string]map[string]string{
+			"base": {
+				"a.go":       "package a\n",
+				"sub/c.go":   "package sub // 1\n",
+				"other/d.go": "package other // 1\n",
+			},
+			"fix": {
+				"a.go":       "package a\n",
+				"sub/c.go":   "package sub // 1\n",
+				"other/d.go": "package other // 2\n",
+			},
+		},
+		parents: map[string]string{"fix": "base"},
+	}
+	wt.hasher = &sha256Hasher{}
+	project := &RepoPath{RepoRoot: vcs.RepoRoot{Root: "example.com/a"}}
+
+	dir, err := ioutil.TempDir("", "retrodep-test.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	local := map[string]string{
+		"a.go":     "package a\n",
+		"sub/c.go": "package sub // 1\n",
+	}
+	for path, content := range local {
+		path = filepath.Join(dir, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The fix only changed a package not present locally
+	src, err := NewGoSource(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := src.FixIncluded(project, wt, dir, nil, "fix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Inclusion != FixNotApplicable {
+		t.Errorf("expected %q, got %q", FixNotApplicable, status.Inclusion)
+	}
+	if status.Changed != nil || status.Matched != nil {
+		t.Errorf("unexpected files: %v %v", status.Changed, status.Matched)
+	}
+}
+
+func TestFixIncludedUnknownCommit(t *testing.T) {
+	wt := &mockFixWorkingTree{
+		mockAncestryWorkingTree: mockAncestryWorkingTree{
+			ancestors: map[string][]string{"base": {"base"}},
+		},
+	}
+	wt.hasher = &sha256Hasher{}
+	project := &RepoPath{RepoRoot: vcs.RepoRoot{Root: "example.com/a"}}
+	src, err := NewGoSource("testdata/gosource", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ref := range []*Reference{{Rev: "base"}, nil} {
+		_, err := src.FixIncluded(project, wt, src.Path, ref, "unknown")
+		if errors.Cause(err) != ErrorInvalidRef {
+			t.Errorf("%v: expected ErrorInvalidRef, got %v", ref, err)
+		}
+	}
+}
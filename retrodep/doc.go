@@ -49,4 +49,10 @@
 //
 // It does this by comparing file hashes of the local files with those
 // from commits in the upstream repository.
+//
+// Import paths are mapped to repositories using a Resolver, which can
+// be given in GoSourceOptions. By default VCSResolver is used, which
+// behaves like 'go get'. StaticResolver, MetaResolver and
+// CachingResolver provide alternatives which may be combined using
+// MultiResolver.
 package retrodep
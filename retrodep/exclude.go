@@ -0,0 +1,171 @@
+// Copyright (C) 2019 Tim Waugh
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package retrodep
+
+import (
+	"bufio"
+	"io"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// excludePattern is a single exclusion pattern.
+type excludePattern struct {
+	pathPattern
+
+	// negate is true if paths matching the pattern are
+	// re-included.
+	negate bool
+
+	// dirOnly is true if the pattern only matches directories.
+	dirOnly bool
+}
+
+// Excludes holds exclusion patterns, in the format described in
+// gitignore(5). Paths are excluded if the last pattern to match them
+// is not negated, or if a parent directory is excluded.
+//
+// A nil *Excludes excludes nothing.
+type Excludes struct {
+	// root is the slash-separated directory, relative to the
+	// directory the patterns are relative to, which paths to be
+	// matched are relative to.
+	root string
+
+	patterns []excludePattern
+}
+
+// NewExcludes returns a new *Excludes for the patterns, which are
+// relative to the top-level. Blank patterns and those beginning with
+// "#" are ignored.
+func NewExcludes(patterns []string) *Excludes {
+	excl := &Excludes{}
+	excl.Add(patterns...)
+	return excl
+}
+
+// ReadExcludes reads exclusion patterns, one per line, from r.
+func ReadExcludes(r io.Reader) (*Excludes, error) {
+	var patterns []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		patterns = append(patterns, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return NewExcludes(patterns), nil
+}
+
+// Add adds patterns relative to the top-level, taking precedence
+// over existing patterns.
+func (excl *Excludes) Add(patterns ...string) {
+	for _, p := range patterns {
+		// Trailing spaces are ignored unless escaped.
+		trimmed := strings.TrimRight(p, " ")
+		if len(trimmed) < len(p) && strings.HasSuffix(trimmed, `\`) {
+			trimmed += " "
+		}
+		p = trimmed
+		if p == "" || strings.HasPrefix(p, "#") {
+			continue
+		}
+
+		var ep excludePattern
+		if strings.HasPrefix(p, "!") {
+			ep.negate = true
+			p = p[1:]
+		}
+		if strings.HasSuffix(p, "/") {
+			ep.dirOnly = true
+			p = strings.TrimRight(p, "/")
+		}
+		if p == "" {
+			continue
+		}
+		ep.pathPattern = newPathPattern(excl.root, p)
+		excl.patterns = append(excl.patterns, ep)
+	}
+}
+
+// sub returns a copy of excl whose top-level is the directory dir.
+func (excl *Excludes) sub(dir string) *Excludes {
+	dir = filepath.ToSlash(dir)
+	if excl == nil {
+		return &Excludes{}
+	}
+	root := path.Join(excl.root, dir)
+	if root == "." {
+		root = ""
+	}
+	return &Excludes{
+		root:     root,
+		patterns: append([]excludePattern(nil), excl.patterns...),
+	}
+}
+
+// matchOne returns true if the last pattern to match the
+// slash-separated path name, ignoring its parent directories,
+// excludes it.
+func (excl *Excludes) matchOne(name string, isDir bool) bool {
+	excluded := false
+	for _, p := range excl.patterns {
+		if p.dirOnly && !isDir {
+			continue
+		}
+		if p.match(name) {
+			excluded = !p.negate
+		}
+	}
+	return excluded
+}
+
+// Excluded returns true if the path name, relative to the top-level,
+// is excluded, either by a pattern matching it or by one matching a
+// parent directory. If isDir is true, name is a directory.
+func (excl *Excludes) Excluded(name string, isDir bool) bool {
+	if excl == nil || len(excl.patterns) == 0 {
+		return false
+	}
+	name = path.Join(excl.root, filepath.ToSlash(name))
+	if name == "." {
+		return false
+	}
+
+	elements := strings.Split(name, "/")
+	for i := 1; i < len(elements); i++ {
+		if excl.matchOne(strings.Join(elements[:i], "/"), true) {
+			return true
+		}
+	}
+	return excl.matchOne(name, isDir)
+}
+
+// literalPattern returns a pattern matching only the slash-separated
+// path name, relative to the top-level.
+func literalPattern(name string) string {
+	var b strings.Builder
+	b.WriteString("/")
+	for _, r := range name {
+		switch r {
+		case '\\', '*', '?', '[':
+			b.WriteRune('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
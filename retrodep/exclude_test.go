@@ -0,0 +1,101 @@
+// Copyright (C) 2019 Tim Waugh
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package retrodep
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestExcluded(t *testing.T) {
+	excl, err := ReadExcludes(strings.NewReader(strings.Join([]string{
+		"# comment",
+		"",
+		"**/*.orig",
+		"Dockerfile",
+		"/Makefile",
+		"build/",
+		"docs/*.md",
+		"!docs/README.md",
+		`\#hash`,
+		`\!bang`,
+		"trailing   ",
+		"vendor/github.com/foo/bar/testdata",
+	}, "\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tcs := []struct {
+		name     string
+		isDir    bool
+		excluded bool
+	}{
+		{"main.go", false, false},
+		{"a.orig", false, true},
+		{"a/b/c.orig", false, true},
+		{"Dockerfile", false, true},
+		{"sub/Dockerfile", false, true},
+		{"Makefile", false, true},
+		{"sub/Makefile", false, false},
+		{"build", true, true},
+		{"build", false, false},
+		{"build/main.go", false, true},
+		{"sub/build/main.go", false, true},
+		{"docs/guide.md", false, true},
+		{"docs/README.md", false, false},
+		{"#hash", false, true},
+		{"!bang", false, true},
+		{"trailing", false, true},
+		{"vendor/github.com/foo/bar/testdata/x.go", false, true},
+		{"vendor/github.com/foo/bar/bar.go", false, false},
+	}
+
+	for _, tc := range tcs {
+		if excl.Excluded(tc.name, tc.isDir) != tc.excluded {
+			t.Errorf("%s (dir:%v): expected excluded=%v",
+				tc.name, tc.isDir, tc.excluded)
+		}
+	}
+
+	// Patterns are relative to the sub-directory's parent
+	sub := excl.sub("vendor/github.com/foo/bar")
+	sub.Add("/bar.go")
+	if !sub.Excluded("testdata/x.go", false) {
+		t.Error("sub: testdata/x.go not excluded")
+	}
+	if !sub.Excluded("bar.go", false) {
+		t.Error("sub: bar.go not excluded")
+	}
+	if excl.Excluded("bar.go", false) {
+		t.Error("sub: pattern added to parent")
+	}
+
+	var none *Excludes
+	if none.Excluded("main.go", false) {
+		t.Error("nil Excludes excluded main.go")
+	}
+}
+
+func TestLiteralPattern(t *testing.T) {
+	excl := NewExcludes([]string{literalPattern("a/[b]*.go")})
+	if !excl.Excluded("a/[b]*.go", false) {
+		t.Error("literal path not excluded")
+	}
+	if excl.Excluded("a/b.go", false) {
+		t.Error("path excluded as glob")
+	}
+}
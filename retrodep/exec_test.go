@@ -16,6 +16,7 @@
 package retrodep
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"os/exec"
@@ -33,15 +34,16 @@ const (
 var mockedExitStatus int
 var mockedStdout, mockedStderr string
 
-// Capture exec.Command calls via execCommand and make them run our
-// fake version instead. This returns a function which the caller
-// should defer a call to in order to reset execCommand.
+// Capture exec.CommandContext calls via execCommandContext and make
+// them run our fake version instead. This returns a function which
+// the caller should defer a call to in order to reset
+// execCommandContext.
 func mockExecCommand() func() {
-	execCommand = fakeExecCommand
+	execCommandContext = fakeExecCommandContext
 
 	// Reset it afterwards
 	return func() {
-		execCommand = exec.Command
+		execCommandContext = exec.CommandContext
 		mockedExitStatus = 0
 		mockedStdout = ""
 		mockedStderr = ""
@@ -50,11 +52,11 @@ func mockExecCommand() func() {
 
 // Run this test binary (again!) but transfer control immediately to
 // TestHelper, telling it how to act.
-func fakeExecCommand(command string, args ...string) *exec.Cmd {
+func fakeExecCommandContext(ctx context.Context, command string, args ...string) *exec.Cmd {
 	testBinary := os.Args[0]
 	opts := []string{"-test.run=TestHelper", "--", command}
 	opts = append(opts, args...)
-	cmd := exec.Command(testBinary, opts...)
+	cmd := exec.CommandContext(ctx, testBinary, opts...)
 	cmd.Env = []string{
 		envHelper + "=1",
 		envStdout + "=" + mockedStdout,
@@ -64,7 +66,7 @@ func fakeExecCommand(command string, args ...string) *exec.Cmd {
 	return cmd
 }
 
-// This runs in its own process (see fakeExecCommand) and mocks the
+// This runs in its own process (see fakeExecCommandContext) and mocks the
 // command being run.
 func TestHelper(t *testing.T) {
 	if os.Getenv(envHelper) != "1" {
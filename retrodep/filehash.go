@@ -16,13 +16,15 @@
 package retrodep
 
 import (
-	"bufio"
+	"bytes"
 	"crypto/sha256"
 	"encoding/hex"
 	"io"
+	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"strings"
 
 	"github.com/pkg/errors"
@@ -40,6 +42,13 @@ type Hasher interface {
 	Hash(relativePath, absPath string) (FileHash, error)
 }
 
+// contentHasher is implemented by Hashers which can hash content
+// read from r, for example after converting its line endings, rather
+// than content read from a file.
+type contentHasher interface {
+	hashContent(relativePath string, r io.Reader) (FileHash, error)
+}
+
 type sha256Hasher struct{}
 
 // Hash implements the Hasher interface generically using sha256.
@@ -50,15 +59,49 @@ func (h sha256Hasher) Hash(relativePath, absPath string) (FileHash, error) {
 	}
 	defer f.Close()
 
-	hash := sha256.New()
-	_, err = io.Copy(hash, f)
+	fileHash, err := h.hashContent(relativePath, f)
 	if err != nil {
 		return FileHash(""), errors.Wrapf(err, "hashing %s", absPath)
 	}
+	return fileHash, nil
+}
+
+// hashContent implements the contentHasher interface using sha256.
+func (h sha256Hasher) hashContent(relativePath string, r io.Reader) (FileHash, error) {
+	hash := sha256.New()
+	_, err := io.Copy(hash, r)
+	if err != nil {
+		return FileHash(""), err
+	}
 
 	return FileHash(hex.EncodeToString(hash.Sum(nil))), nil
 }
 
+// hashFile returns the file hash for the filename absPath, hashed
+// as though it were in the repository as filename relativePath with
+// the attributes attrs. Line endings are normalised if the
+// attributes require it and the Hasher supports it.
+func hashFile(h Hasher, relativePath, absPath string, attrs map[string]string) (FileHash, error) {
+	ch, ok := h.(contentHasher)
+	if !ok || (attrs["text"] == "" && attrs["eol"] == "" && attrs["crlf"] == "") {
+		// No conversion is needed
+		return h.Hash(relativePath, absPath)
+	}
+
+	content, err := ioutil.ReadFile(absPath)
+	if err != nil {
+		return FileHash(""), errors.Wrapf(err, "hashing %s", absPath)
+	}
+	if needsEOLConversion(attrs, content) {
+		content = normaliseEOL(content)
+	}
+	fileHash, err := ch.hashContent(relativePath, bytes.NewReader(content))
+	if err != nil {
+		return FileHash(""), errors.Wrapf(err, "hashing %s", absPath)
+	}
+	return fileHash, nil
+}
+
 // FileHashes is a map of paths, relative to the top-level of the
 // version control system, to their hashes.
 type FileHashes map[string]FileHash
@@ -66,25 +109,33 @@ type FileHashes map[string]FileHash
 // NewFileHashes returns a new FileHashes from a filesystem tree at root,
 // whose files belong to the version control system named in vcsCmd. Keys in
 // the excludes map are filenames to ignore.
+//
+// Rules from .gitattributes files within the tree are honoured: files
+// with the export-ignore or export-subst attributes are ignored, as
+// they are not expected to match upstream, and the line endings of
+// text files are normalised before hashing.
 func NewFileHashes(h Hasher, root string, excludes map[string]struct{}) (FileHashes, error) {
+	return newFileHashes(h, root, excludes, nil)
+}
+
+// newFileHashes is like NewFileHashes but also ignores paths which
+// excl, relative to root, excludes.
+func newFileHashes(h Hasher, root string, excludes map[string]struct{}, excl *Excludes) (FileHashes, error) {
 	hashes := make(FileHashes)
 	root = path.Clean(root)
-
-	// Make a local copy of excludes we can safely modify
-	excl := make(map[string]struct{})
-	if excludes != nil {
-		for k, v := range excludes {
-			excl[k] = v
-		}
-	}
+	attributes := newGitAttributes()
 
 	walkfn := func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
-		if _, skip := excl[path]; skip {
-			// This pathname has been ignored, either by caller
-			// request or due to .gitattributes
+		relativePath, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		_, skip := excludes[path]
+		if skip || excl.Excluded(relativePath, info.IsDir()) {
+			// This pathname has been ignored by caller request
 			if info.IsDir() {
 				return filepath.SkipDir
 			}
@@ -92,9 +143,7 @@ func NewFileHashes(h Hasher, root string, excludes map[string]struct{}) (FileHas
 		}
 		if info.IsDir() {
 			// Check for .gitattributes in this directory
-			// FIXME: gitattributes(5) describes a more complex file
-			// format than handled here.  Can git-check-attr(1) help?
-			ga, err := os.Open(filepath.Join(path, ".gitattributes"))
+			ga, err := os.Open(filepath.Join(path, gitAttributesFile))
 			if err != nil {
 				if os.IsNotExist(err) {
 					err = nil
@@ -103,33 +152,29 @@ func NewFileHashes(h Hasher, root string, excludes map[string]struct{}) (FileHas
 			}
 			defer ga.Close()
 
-			scanner := bufio.NewScanner(bufio.NewReader(ga))
-			for scanner.Scan() {
-				fields := strings.Fields(scanner.Text())
-				if len(fields) < 2 {
-					continue
-				}
-				for _, field := range fields[1:] {
-					if field == "export-subst" {
-						// Not expected to have matching hash
-						fn := filepath.Join(path, fields[0])
-						excl[fn] = struct{}{}
-						break
-					}
-				}
+			dir := filepath.ToSlash(relativePath)
+			if dir == "." {
+				dir = ""
+			}
+			err = attributes.add(dir, ga)
+			if err != nil {
+				return errors.Wrapf(err, "reading %s", ga.Name())
 			}
-
 			return nil
 		}
 		if !info.Mode().IsRegular() {
 			return nil
 		}
-		relativePath, err := filepath.Rel(root, path)
-		if err != nil {
-			return err
+
+		attrs := attributes.lookup(filepath.ToSlash(relativePath))
+		if notExported(attrs) {
+			// Not expected to have matching hash
+			log.Debugf("%s: ignored due to %s", relativePath,
+				gitAttributesFile)
+			return nil
 		}
 
-		fileHash, err := h.Hash(relativePath, path)
+		fileHash, err := hashFile(h, relativePath, path, attrs)
 		if err != nil {
 			return err
 		}
@@ -148,6 +193,12 @@ func (h FileHashes) IsSubsetOf(s FileHashes) bool {
 	return h.Mismatches(s, true) == nil
 }
 
+// Equal returns true if these file hashes have the same filenames
+// and hashes as s.
+func (h FileHashes) Equal(s FileHashes) bool {
+	return len(h) == len(s) && h.IsSubsetOf(s)
+}
+
 // Mismatches returns a slice of filenames from h whose hashes
 // mismatch those in s. If failFast is true at most one mismatch will
 // be returned.
@@ -172,3 +223,105 @@ func (h FileHashes) Mismatches(s FileHashes, failFast bool) []string {
 
 	return mismatches
 }
+
+// ignoredByGoTool returns true if the relative path p is within a
+// directory the go tool ignores when matching packages: "vendor",
+// "testdata", or names beginning with "." or "_".
+func ignoredByGoTool(p string) bool {
+	dirs := strings.Split(filepath.ToSlash(filepath.Dir(p)), "/")
+	for _, dir := range dirs {
+		switch {
+		case dir == ".":
+			continue
+		case dir == "vendor", dir == "testdata",
+			strings.HasPrefix(dir, "."),
+			strings.HasPrefix(dir, "_"):
+			return true
+		}
+	}
+	return false
+}
+
+// inVendorDir returns true if the relative path p is within a
+// "vendor" directory.
+func inVendorDir(p string) bool {
+	for _, dir := range strings.Split(filepath.ToSlash(filepath.Dir(p)), "/") {
+		if dir == "vendor" {
+			return true
+		}
+	}
+	return false
+}
+
+// isPackageSource returns true if the relative path p names a Go
+// source file, other than a test, which forms part of a package.
+func isPackageSource(p string) bool {
+	return strings.HasSuffix(p, ".go") &&
+		!strings.HasSuffix(p, "_test.go") &&
+		!ignoredByGoTool(p)
+}
+
+// Packages returns the sorted directories, relative to the top-level,
+// which contain Go source files other than tests.
+func (h FileHashes) Packages() []string {
+	pkgs := h.packageSet()
+	dirs := make([]string, 0, len(pkgs))
+	for dir := range pkgs {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	return dirs
+}
+
+func (h FileHashes) packageSet() map[string]struct{} {
+	pkgs := make(map[string]struct{})
+	for p := range h {
+		if isPackageSource(p) {
+			pkgs[filepath.Dir(p)] = struct{}{}
+		}
+	}
+	return pkgs
+}
+
+// MissingFromPackages returns a slice of filenames from s which are
+// Go source files (other than tests), or other files built into
+// packages such as C sources, belonging to packages present in h, but
+// which are not themselves present in h. Packages entirely absent
+// from h, as happens with pruned vendor trees, are not considered.
+func (h FileHashes) MissingFromPackages(s FileHashes) []string {
+	pkgs := h.packageSet()
+	var missing []string
+	for p := range s {
+		if !isPackageSource(p) && !isPackageAsset(p) {
+			continue
+		}
+		if _, ok := pkgs[filepath.Dir(p)]; !ok {
+			continue
+		}
+		if _, ok := h[p]; !ok {
+			log.Debugf("%s: missing from package", p)
+			missing = append(missing, p)
+		}
+	}
+	return missing
+}
+
+// OmittedPackages returns the sorted directories of packages present
+// in s but not in h.
+func (h FileHashes) OmittedPackages(s FileHashes) []string {
+	pkgs := h.packageSet()
+	var omitted []string
+	for _, dir := range s.Packages() {
+		if _, ok := pkgs[dir]; !ok {
+			omitted = append(omitted, dir)
+		}
+	}
+	return omitted
+}
+
+// MatchesPackages returns true if these file hashes are a subset of
+// s and, for each package present, no Go source files from s are
+// missing. Whole packages may be missing.
+func (h FileHashes) MatchesPackages(s FileHashes) bool {
+	return h.IsSubsetOf(s) && h.MissingFromPackages(s) == nil
+}
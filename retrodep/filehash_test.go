@@ -91,6 +91,37 @@ func TestNewFileHashesExclude(t *testing.T) {
 	}
 }
 
+func TestNewFileHashesGitAttributes(t *testing.T) {
+	hashes, err := NewFileHashes(&gitHasher{}, "testdata/gitattributes", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Files marked export-ignore or export-subst are left out, and
+	// text files are hashed with normalised line endings.
+	expected := map[string]FileHash{
+		"crlf.txt":       "422c2b7ab3b3c668038da977e4e93a5fc623169c",
+		"main.go":        "06ab7d0f9a35a7d1070711496d6ca1cb892a258f",
+		"sub/sub.go":     "1dc3d0d99a570448a11ac7a6f67343c4fabc2b0a",
+		"sub/ignored.go": "e69de29bb2d1d6434b8b29ae775ad8c2e48c5391",
+	}
+	for key, value := range expected {
+		got, ok := hashes[key]
+		if !ok {
+			t.Errorf("%s missing", key)
+			continue
+		}
+		if got != value {
+			t.Errorf("%s: wrong hash (%s != %s)", key, got, value)
+		}
+	}
+	for _, key := range []string{"ignored.go", "version.tmpl", "gen/gen.go"} {
+		if _, ok := hashes[key]; ok {
+			t.Errorf("%s not ignored", key)
+		}
+	}
+}
+
 func TestIsSubsetOf(t *testing.T) {
 	hasher := &gitHasher{}
 	hashes, err := NewFileHashes(hasher, "testdata/gosource", nil)
@@ -159,3 +190,97 @@ func TestMismatches(t *testing.T) {
 		t.Errorf("too many mismatches returned: %v", mismatches)
 	}
 }
+
+func TestPackages(t *testing.T) {
+	hashes := FileHashes{
+		"top.go":             "1",
+		"top_test.go":        "2",
+		"sub/sub.go":         "3",
+		"tests/a_test.go":    "4",
+		"testdata/data.go":   "5",
+		"_examples/main.go":  "6",
+		"vendor/foo/foo.go":  "7",
+		"README.md":          "8",
+		"sub/deeper/deep.go": "9",
+	}
+	expected := []string{".", "sub", "sub/deeper"}
+	pkgs := hashes.Packages()
+	if len(pkgs) != len(expected) {
+		t.Fatalf("got %v, want %v", pkgs, expected)
+	}
+	for i, pkg := range expected {
+		if pkgs[i] != pkg {
+			t.Fatalf("got %v, want %v", pkgs, expected)
+		}
+	}
+}
+
+func TestMatchesPackages(t *testing.T) {
+	upstream := FileHashes{
+		"top.go":       "1",
+		"top_test.go":  "2",
+		"top_linux.go": "3",
+		"sub/sub.go":   "4",
+		"cmd/main.go":  "5",
+		"LICENSE":      "6",
+	}
+
+	type tcase struct {
+		name    string
+		local   FileHashes
+		matches bool
+		omitted []string
+	}
+	tcases := []tcase{
+		{
+			name:    "complete",
+			local:   upstream,
+			matches: true,
+		},
+		{
+			name: "pruned",
+			local: FileHashes{
+				"top.go":       "1",
+				"top_linux.go": "3",
+				"LICENSE":      "6",
+			},
+			matches: true,
+			omitted: []string{"cmd", "sub"},
+		},
+		{
+			name: "missing-file",
+			local: FileHashes{
+				"top.go":     "1",
+				"sub/sub.go": "4",
+			},
+			matches: false,
+			omitted: []string{"cmd"},
+		},
+		{
+			name: "modified",
+			local: FileHashes{
+				"top.go":       "1",
+				"top_linux.go": "0",
+			},
+			matches: false,
+			omitted: []string{"cmd", "sub"},
+		},
+	}
+
+	for _, tc := range tcases {
+		if m := tc.local.MatchesPackages(upstream); m != tc.matches {
+			t.Errorf("%s: got %t, want %t", tc.name, m, tc.matches)
+		}
+		omitted := tc.local.OmittedPackages(upstream)
+		if len(omitted) != len(tc.omitted) {
+			t.Errorf("%s: omitted: got %v, want %v", tc.name, omitted, tc.omitted)
+			continue
+		}
+		for i, o := range tc.omitted {
+			if omitted[i] != o {
+				t.Errorf("%s: omitted: got %v, want %v", tc.name, omitted, tc.omitted)
+				break
+			}
+		}
+	}
+}
@@ -20,10 +20,13 @@ package retrodep
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
@@ -34,6 +37,10 @@ type gitWorkingTree struct {
 	anyWorkingTree
 }
 
+func (g *gitWorkingTree) withContext(ctx context.Context) WorkingTree {
+	return &gitWorkingTree{anyWorkingTree: g.anyWorkingTree.withContext(ctx)}
+}
+
 // Revisions returns all revisions in the git repository, using 'git
 // rev-list --all'.
 func (g *gitWorkingTree) Revisions() ([]string, error) {
@@ -62,6 +69,84 @@ func (g *gitWorkingTree) RevisionFromTag(tag string) (string, error) {
 	return rev, nil
 }
 
+// IsAncestor returns true if ancestor is rev or one of its
+// ancestors, using 'git merge-base --is-ancestor ...'. It returns
+// ErrorInvalidRef if either is not present in the repository.
+func (g *gitWorkingTree) IsAncestor(ancestor, rev string) (bool, error) {
+	stdout, stderr, err := g.run("merge-base", "--is-ancestor",
+		ancestor, rev)
+	if err == nil {
+		return true, nil
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+		return false, nil
+	}
+	output := strings.ToLower(stdout.String() + stderr.String())
+	if strings.HasPrefix(output, "fatal: not a valid commit name ") ||
+		strings.HasPrefix(output, "fatal: not a valid object name ") {
+		return false, ErrorInvalidRef
+	}
+	g.showOutput(stdout, stderr)
+	return false, err
+}
+
+// ParentRevision returns the first parent of rev, or "" if it has
+// none, using 'git rev-list --parents -n1 ...'. It returns
+// ErrorInvalidRef if rev is not present in the repository.
+func (g *gitWorkingTree) ParentRevision(rev string) (string, error) {
+	stdout, stderr, err := g.run("rev-list", "--parents", "-n1", rev)
+	if err != nil {
+		output := strings.ToLower(stdout.String() + stderr.String())
+		if strings.HasPrefix(output, "fatal: bad object ") ||
+			strings.HasPrefix(output, "fatal: ambiguous argument ") {
+			return "", ErrorInvalidRef
+		}
+		g.showOutput(stdout, stderr)
+		return "", err
+	}
+	revs := strings.Fields(stdout.String())
+	if len(revs) < 2 {
+		return "", nil
+	}
+	return revs[1], nil
+}
+
+// RevisionWithBlob returns the revision which introduced a blob
+// with hash hash at path, using 'git log --all --find-object=... --
+// path'. The same content at other paths is not considered.
+func (g *gitWorkingTree) RevisionWithBlob(path string, hash FileHash) (string, error) {
+	stdout, stderr, err := g.run("log", "--all", "--format=%H",
+		"--find-object="+string(hash), "--", path)
+	if err != nil {
+		g.showOutput(stdout, stderr)
+		return "", err
+	}
+
+	// The oldest commit listed introduced the blob. Newer ones
+	// may have removed it again.
+	revs := strings.Fields(stdout.String())
+	if len(revs) == 0 {
+		return "", ErrorVersionNotFound
+	}
+	return revs[len(revs)-1], nil
+}
+
+// RevisionWithPath returns the newest revision which modified path,
+// using 'git log --all -- ...'.
+func (g *gitWorkingTree) RevisionWithPath(path string) (string, error) {
+	stdout, stderr, err := g.run("log", "--all", "-n1", "--format=%H",
+		"--", path)
+	if err != nil {
+		g.showOutput(stdout, stderr)
+		return "", err
+	}
+	rev := strings.TrimSpace(stdout.String())
+	if rev == "" {
+		return "", ErrorVersionNotFound
+	}
+	return rev, nil
+}
+
 // RevSync updates the working tree to reflect the revision rev, using
 // 'git checkout ...'. The working tree must not have been locally
 // modified.
@@ -135,11 +220,22 @@ func (g *gitWorkingTree) ReachableTag(rev string) (string, error) {
 }
 
 // FileHashesFromRef parses the output of 'git ls-tree -r' to
-// return the file hashes for the given tag or revision ref.
+// return the file hashes for the given tag or revision ref. Files
+// which .gitattributes rules mark as export-ignore or export-subst
+// are left out, as vendored copies made using 'git archive' will not
+// match them.
 func (g *gitWorkingTree) FileHashesFromRef(ref, subPath string) (FileHashes, error) {
 	args := []string{"ls-tree", "-r", ref}
 	if subPath != "" {
 		args = append(args, subPath)
+
+		// Also list .gitattributes files in parent
+		// directories, as their rules apply to subPath.
+		dir := filepath.Dir(subPath)
+		for ; dir != "."; dir = filepath.Dir(dir) {
+			args = append(args, filepath.Join(dir, gitAttributesFile))
+		}
+		args = append(args, gitAttributesFile)
 	}
 	stdout, stderr, err := g.run(args...)
 	if err != nil {
@@ -157,6 +253,7 @@ func (g *gitWorkingTree) FileHashesFromRef(ref, subPath string) (FileHashes, err
 		return nil, err
 	}
 	fh := make(FileHashes)
+	attrFiles := make(FileHashes)
 	scanner := bufio.NewScanner(stdout)
 	for scanner.Scan() {
 		line := scanner.Text()
@@ -165,6 +262,14 @@ func (g *gitWorkingTree) FileHashesFromRef(ref, subPath string) (FileHashes, err
 		if len(ts) != 2 {
 			return nil, fmt.Errorf("expected TAB: %s", line)
 		}
+		fields := strings.Fields(ts[0])
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("expected 3 fields: %s", ts[0])
+		}
+		if filepath.Base(ts[1]) == gitAttributesFile {
+			attrFiles[ts[1]] = FileHash(fields[2])
+		}
+
 		var filename string
 		if subPath == "" {
 			filename = ts[1]
@@ -174,25 +279,96 @@ func (g *gitWorkingTree) FileHashesFromRef(ref, subPath string) (FileHashes, err
 				return nil, errors.Wrapf(err, "Rel(%q, %q)",
 					subPath, ts[1])
 			}
-		}
-		fields := strings.Fields(ts[0])
-		if len(fields) != 3 {
-			return nil, fmt.Errorf("expected 3 fields: %s", ts[0])
+			if strings.HasPrefix(filename, "..") {
+				// Listed only for its rules
+				continue
+			}
 		}
 
 		fh[filename] = FileHash(fields[2])
 	}
 
+	if len(attrFiles) > 0 {
+		attributes, err := g.gitAttributes(attrFiles)
+		if err != nil {
+			return nil, err
+		}
+		for filename := range fh {
+			name := filepath.ToSlash(filepath.Join(subPath, filename))
+			if notExported(attributes.lookup(name)) {
+				log.Debugf("%s: ignored due to %s", name,
+					gitAttributesFile)
+				delete(fh, filename)
+			}
+		}
+	}
+
 	return fh, nil
 }
 
-type gitHasher struct{}
+// gitAttributes reads the .gitattributes blobs in attrFiles, which
+// maps their paths to their hashes.
+func (g *gitWorkingTree) gitAttributes(attrFiles FileHashes) (*gitAttributes, error) {
+	// Parent directories must be read before their
+	// sub-directories.
+	paths := make([]string, 0, len(attrFiles))
+	for p := range attrFiles {
+		paths = append(paths, p)
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		di := strings.Count(paths[i], "/")
+		dj := strings.Count(paths[j], "/")
+		if di != dj {
+			return di < dj
+		}
+		return paths[i] < paths[j]
+	})
+
+	attributes := newGitAttributes()
+	for _, p := range paths {
+		stdout, stderr, err := g.run("cat-file", "blob", string(attrFiles[p]))
+		if err != nil {
+			g.showOutput(stdout, stderr)
+			return nil, err
+		}
+		dir := filepath.ToSlash(filepath.Dir(p))
+		if dir == "." {
+			dir = ""
+		}
+		if err := attributes.add(dir, stdout); err != nil {
+			return nil, errors.Wrapf(err, "reading %s", p)
+		}
+	}
+	return attributes, nil
+}
+
+type gitHasher struct {
+	// ctx limits the lifetime of 'git hash-object'. If nil,
+	// context.Background() is used.
+	ctx context.Context
+}
 
 // Hash implements the Hasher interface for git.
 func (g *gitHasher) Hash(relativePath, absPath string) (FileHash, error) {
-	args := []string{"hash-object", "--path", relativePath, absPath}
-	cmd := exec.Command(vcsGit, args...)
+	return g.hashObject(nil, "--path", relativePath, absPath)
+}
+
+// hashContent implements the contentHasher interface for git.
+func (g *gitHasher) hashContent(relativePath string, r io.Reader) (FileHash, error) {
+	return g.hashObject(r, "--stdin", "--path", relativePath)
+}
+
+// hashObject runs 'git hash-object' with the arguments, and with
+// stdin read from r if it is not nil.
+func (g *gitHasher) hashObject(r io.Reader, args ...string) (FileHash, error) {
+	ctx := g.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	args = append([]string{"hash-object"}, args...)
+	cmd := exec.CommandContext(ctx, vcsGit, args...)
 	var buf bytes.Buffer
+	cmd.Stdin = r
 	cmd.Stdout = &buf
 	cmd.Stderr = &buf
 	err := cmd.Run()
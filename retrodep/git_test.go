@@ -16,7 +16,10 @@
 package retrodep
 
 import (
+	"io/ioutil"
+	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -93,6 +96,65 @@ func TestGitRevSync(t *testing.T) {
 	}
 }
 
+func TestGitIsAncestor(t *testing.T) {
+	defer mockExecCommand()()
+
+	wt := gitWorkingTree{
+		anyWorkingTree: anyWorkingTree{
+			Dir: "",
+			VCS: vcs.ByCmd(vcsGit),
+		},
+	}
+
+	for _, status := range []int{0, 1} {
+		mockedExitStatus = status
+		is, err := wt.IsAncestor("a2176f42", "d4c3dbfa")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if is != (status == 0) {
+			t.Errorf("exit status %d: got %t", status, is)
+		}
+	}
+}
+
+func TestGitParentRevision(t *testing.T) {
+	defer mockExecCommand()()
+
+	wt := gitWorkingTree{
+		anyWorkingTree: anyWorkingTree{
+			Dir: "",
+			VCS: vcs.ByCmd(vcsGit),
+		},
+	}
+
+	tcs := []struct {
+		stdout, expected string
+	}{
+		{"d4c3dbfa a2176f42\n", "a2176f42"},
+		{"d4c3dbfa a2176f42 0123abcd\n", "a2176f42"},
+		{"d4c3dbfa\n", ""},
+	}
+	for _, tc := range tcs {
+		mockedStdout = tc.stdout
+		parent, err := wt.ParentRevision("d4c3dbfa")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parent != tc.expected {
+			t.Errorf("%q: got %q, want %q", tc.stdout, parent,
+				tc.expected)
+		}
+	}
+
+	mockedStdout = ""
+	mockedStderr = "fatal: bad object d4c3dbfa\n"
+	mockedExitStatus = 128
+	if _, err := wt.ParentRevision("d4c3dbfa"); err != ErrorInvalidRef {
+		t.Errorf("missing ErrorInvalidRef: %v", err)
+	}
+}
+
 func TestGitTimeFromRevision(t *testing.T) {
 	defer mockExecCommand()()
 
@@ -267,6 +329,10 @@ func TestGitErrors(t *testing.T) {
 	if _, ok := err.(*exec.ExitError); !ok {
 		t.Error("RevSync: git failure was not reported")
 	}
+	_, err = wt.IsAncestor("012345", "tip")
+	if _, ok := err.(*exec.ExitError); !ok {
+		t.Error("IsAncestor: git failure was not reported")
+	}
 	_, err = wt.TimeFromRevision("012345")
 	if _, ok := err.(*exec.ExitError); !ok {
 		t.Error("TimeFromRevision: git failure was not reported")
@@ -298,3 +364,103 @@ func TestGitErrors(t *testing.T) {
 		t.Error("Hash: git failure was not reported")
 	}
 }
+
+func TestGitRevisionWithBlob(t *testing.T) {
+	defer mockExecCommand()()
+
+	wt := gitWorkingTree{
+		anyWorkingTree: anyWorkingTree{
+			Dir: "",
+			VCS: vcs.ByCmd(vcsGit),
+		},
+	}
+
+	// The oldest revision introduced the blob.
+	mockedStdout = "d4c3dbfa77a74ae238e401d5d2197b45f30d8513\n" +
+		"a2176f4275f92ceddb47cff1e363313156124bf6\n"
+	rev, err := wt.RevisionWithBlob("ignored.go", "e69de29bb2d1d6434b8b29ae775ad8c2e48c5391")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rev != "a2176f4275f92ceddb47cff1e363313156124bf6" {
+		t.Errorf("unexpected revision: %s", rev)
+	}
+
+	mockedStdout = ""
+	_, err = wt.RevisionWithBlob("ignored.go", "e69de29bb2d1d6434b8b29ae775ad8c2e48c5391")
+	if err != ErrorVersionNotFound {
+		t.Errorf("unexpected error: %v", err)
+	}
+	_, err = wt.RevisionWithPath("ignored.go")
+	if err != ErrorVersionNotFound {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestGitRevisionWithBlobPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "retrodep-test.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	git := func(args ...string) string {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		out, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("git %s: %v", strings.Join(args, " "), err)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	commit := func(name string) string {
+		err := ioutil.WriteFile(filepath.Join(dir, name),
+			[]byte("same\n"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		git("add", name)
+		git("-c", "user.name=test", "-c", "user.email=test@example.com",
+			"commit", "-q", "-m", name)
+		return git("rev-parse", "HEAD")
+	}
+
+	git("init", "-q")
+	first := commit("a.go")
+	second := commit("b.go")
+	hash := FileHash(git("hash-object", "b.go"))
+
+	wt := &gitWorkingTree{
+		anyWorkingTree: anyWorkingTree{
+			Dir: dir,
+			VCS: vcs.ByCmd(vcsGit),
+		},
+	}
+
+	// The same blob was introduced at a.go first, but only b.go
+	// should be considered.
+	tcs := []struct {
+		path     string
+		expected string
+	}{
+		{"a.go", first},
+		{"b.go", second},
+		{"c.go", ""},
+	}
+	for _, tc := range tcs {
+		rev, err := wt.RevisionWithBlob(tc.path, hash)
+		if tc.expected == "" {
+			if err != ErrorVersionNotFound {
+				t.Errorf("%s: unexpected error: %v", tc.path, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.path, err)
+			continue
+		}
+		if rev != tc.expected {
+			t.Errorf("%s: got %s, wanted %s", tc.path, rev, tc.expected)
+		}
+	}
+}
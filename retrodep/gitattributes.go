@@ -0,0 +1,319 @@
+// Copyright (C) 2019 Tim Waugh
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package retrodep
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Attribute states, as shown by git-check-attr(1). Attributes which
+// are unspecified are absent.
+const (
+	attrSet   = "set"
+	attrUnset = "unset"
+)
+
+// gitAttributesFile is the name of the file holding the attributes
+// for paths within its directory.
+const gitAttributesFile = ".gitattributes"
+
+// pathPattern is a pattern, in the format used by gitignore(5) and
+// gitattributes(5), relative to the directory of the file it was
+// read from.
+type pathPattern struct {
+	// dir is the slash-separated directory, relative to the
+	// top-level, which the pattern applies within. It is "" for
+	// the top-level.
+	dir string
+
+	// segments holds the slash-separated parts of the pattern.
+	segments []string
+
+	// basename is true if the pattern has no slash and so is
+	// matched against the last element of paths at any depth.
+	basename bool
+}
+
+// newPathPattern parses pattern, read from a file in the directory
+// dir.
+func newPathPattern(dir, pattern string) pathPattern {
+	p := pathPattern{dir: dir}
+	if !strings.Contains(pattern, "/") {
+		p.basename = true
+	}
+	pattern = strings.TrimPrefix(pattern, "/")
+	for _, segment := range strings.Split(pattern, "/") {
+		// Go uses "[^...]" to negate character classes,
+		// whereas fnmatch(3) uses "[!...]".
+		segment = strings.Replace(segment, "[!", "[^", -1)
+		p.segments = append(p.segments, segment)
+	}
+	return p
+}
+
+// match returns true if the slash-separated path name, relative to
+// the top-level, matches the pattern.
+func (p pathPattern) match(name string) bool {
+	if p.dir != "" {
+		if !strings.HasPrefix(name, p.dir+"/") {
+			return false
+		}
+		name = name[len(p.dir)+1:]
+	}
+	if p.basename {
+		return matchSegments(p.segments, []string{path.Base(name)})
+	}
+	return matchSegments(p.segments, strings.Split(name, "/"))
+}
+
+// matchSegments returns true if the path elements in name match the
+// pattern elements in pattern. A "**" element matches zero or more
+// directories, or everything within a directory when it is last.
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			pattern = pattern[1:]
+			if len(pattern) == 0 {
+				return len(name) > 0
+			}
+			for i := 0; i < len(name); i++ {
+				if matchSegments(pattern, name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, err := path.Match(pattern[0], name[0]); err != nil || !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// attrAssignment is a single attribute setting from a
+// .gitattributes line. An empty state means the attribute is
+// unspecified.
+type attrAssignment struct {
+	name  string
+	state string
+}
+
+// attrRule is a line from a .gitattributes file.
+type attrRule struct {
+	pattern pathPattern
+	attrs   []attrAssignment
+}
+
+// gitAttributes holds the rules from .gitattributes files within a
+// tree, as described in gitattributes(5).
+type gitAttributes struct {
+	// macros maps macro attribute names to the attributes they
+	// set.
+	macros map[string][]attrAssignment
+
+	// rules holds the rules in increasing order of precedence.
+	// Files must be added in an order such that each directory's
+	// .gitattributes comes after that of its parent directory.
+	rules []attrRule
+}
+
+// newGitAttributes returns a new gitAttributes with only the
+// built-in macro attributes.
+func newGitAttributes() *gitAttributes {
+	return &gitAttributes{
+		macros: map[string][]attrAssignment{
+			"binary": {
+				{name: "diff", state: attrUnset},
+				{name: "merge", state: attrUnset},
+				{name: "text", state: attrUnset},
+			},
+		},
+	}
+}
+
+// parseAttr parses a single attribute from a .gitattributes line.
+func parseAttr(field string) attrAssignment {
+	switch {
+	case strings.HasPrefix(field, "-"):
+		return attrAssignment{name: field[1:], state: attrUnset}
+	case strings.HasPrefix(field, "!"):
+		return attrAssignment{name: field[1:]}
+	}
+	if eq := strings.Index(field, "="); eq != -1 {
+		return attrAssignment{name: field[:eq], state: field[eq+1:]}
+	}
+	return attrAssignment{name: field, state: attrSet}
+}
+
+// add reads a .gitattributes file from r, which is in the
+// slash-separated directory dir relative to the top-level. Macro
+// attributes may only be defined at the top-level.
+func (ga *gitAttributes) add(dir string, r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var pattern string
+		if strings.HasPrefix(line, `"`) {
+			// C-style quoted pattern
+			end := 1
+			for end < len(line) && line[end] != '"' {
+				if line[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(line) {
+				log.Debugf("%s: bad quoting: %s", dir, line)
+				continue
+			}
+			unquoted, err := strconv.Unquote(line[:end+1])
+			if err != nil {
+				log.Debugf("%s: bad quoting: %s", dir, line)
+				continue
+			}
+			pattern = unquoted
+			line = line[end+1:]
+		} else {
+			fields := strings.Fields(line)
+			pattern = fields[0]
+			line = strings.TrimPrefix(line, pattern)
+		}
+
+		var attrs []attrAssignment
+		for _, field := range strings.Fields(line) {
+			attrs = append(attrs, parseAttr(field))
+		}
+
+		if strings.HasPrefix(pattern, "[attr]") {
+			if dir != "" {
+				log.Debugf("%s: ignoring macro definition: %s",
+					dir, pattern)
+				continue
+			}
+			ga.macros[pattern[len("[attr]"):]] = attrs
+			continue
+		}
+
+		switch {
+		case strings.HasPrefix(pattern, "!"):
+			// Negative patterns are forbidden.
+			log.Debugf("%s: ignoring negative pattern: %s",
+				dir, pattern)
+			continue
+		case strings.HasSuffix(pattern, "/"):
+			// Patterns matching directories do not apply
+			// to the files within them.
+			continue
+		}
+
+		ga.rules = append(ga.rules, attrRule{
+			pattern: newPathPattern(dir, pattern),
+			attrs:   attrs,
+		})
+	}
+	return scanner.Err()
+}
+
+// assign applies the attribute assignment to attrs, expanding macro
+// attributes.
+func (ga *gitAttributes) assign(attrs map[string]string, a attrAssignment) {
+	if a.state == "" {
+		delete(attrs, a.name)
+	} else {
+		attrs[a.name] = a.state
+	}
+	if a.state != attrSet {
+		return
+	}
+	for _, m := range ga.macros[a.name] {
+		if m.name != a.name {
+			ga.assign(attrs, m)
+		}
+	}
+}
+
+// lookup returns the attributes for the slash-separated path name,
+// relative to the top-level. Set and unset attributes have the
+// values attrSet and attrUnset respectively.
+func (ga *gitAttributes) lookup(name string) map[string]string {
+	attrs := make(map[string]string)
+	for _, rule := range ga.rules {
+		if !rule.pattern.match(name) {
+			continue
+		}
+		for _, a := range rule.attrs {
+			ga.assign(attrs, a)
+		}
+	}
+	return attrs
+}
+
+// notExported returns true if the attributes mean a file is either
+// left out of 'git archive' exports or has its content changed in
+// them, and so is not expected to match upstream.
+func notExported(attrs map[string]string) bool {
+	return attrs["export-ignore"] == attrSet ||
+		attrs["export-subst"] == attrSet
+}
+
+// needsEOLConversion returns true if the attributes mean that the
+// line endings of a file's content are normalised when it is
+// committed. Content is treated as binary, with no conversion, if it
+// contains a NUL byte and the text attribute is "auto".
+func needsEOLConversion(attrs map[string]string, content []byte) bool {
+	switch attrs["text"] {
+	case attrSet:
+		return true
+	case attrUnset:
+		return false
+	case "auto":
+		return !isBinary(content)
+	}
+	// Setting eol, or the obsolete crlf attribute, implies text.
+	if attrs["eol"] != "" || attrs["crlf"] == attrSet {
+		return true
+	}
+	return false
+}
+
+// isBinary uses the same heuristic as git to decide whether content
+// is binary: whether there is a NUL byte near the start.
+func isBinary(content []byte) bool {
+	const firstFewBytes = 8000
+	if len(content) > firstFewBytes {
+		content = content[:firstFewBytes]
+	}
+	return bytes.IndexByte(content, 0) != -1
+}
+
+// normaliseEOL returns content with CRLF line endings converted to
+// LF, as git does when committing text files.
+func normaliseEOL(content []byte) []byte {
+	return bytes.Replace(content, []byte("\r\n"), []byte("\n"), -1)
+}
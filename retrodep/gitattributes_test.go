@@ -0,0 +1,138 @@
+// Copyright (C) 2019 Tim Waugh
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package retrodep
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPathPatternMatch(t *testing.T) {
+	tcs := []struct {
+		dir, pattern, name string
+		match              bool
+	}{
+		{"", "*.go", "main.go", true},
+		{"", "*.go", "a/b/main.go", true},
+		{"", "*.go", "main.c", false},
+		{"", "/main.go", "main.go", true},
+		{"", "/main.go", "a/main.go", false},
+		{"", "a/*.go", "a/main.go", true},
+		{"", "a/*.go", "a/b/main.go", false},
+		{"", "**/main.go", "a/b/main.go", true},
+		{"", "**/main.go", "main.go", true},
+		{"", "a/**", "a/b/c", true},
+		{"", "a/**", "a", false},
+		{"", "a/**/c", "a/c", true},
+		{"", "a/**/c", "a/b/b/c", true},
+		{"", "[!m]*.go", "main.go", false},
+		{"", "[!m]*.go", "bar.go", true},
+		{"sub", "*.go", "sub/x/main.go", true},
+		{"sub", "*.go", "main.go", false},
+		{"sub", "x/main.go", "sub/x/main.go", true},
+		{"sub", "x/main.go", "x/main.go", false},
+	}
+
+	for _, tc := range tcs {
+		p := newPathPattern(tc.dir, tc.pattern)
+		if p.match(tc.name) != tc.match {
+			t.Errorf("%q in %q matching %q: expected %v",
+				tc.pattern, tc.dir, tc.name, tc.match)
+		}
+	}
+}
+
+func TestGitAttributesLookup(t *testing.T) {
+	ga := newGitAttributes()
+	files := []struct{ dir, content string }{
+		{"", strings.Join([]string{
+			"# comment",
+			"[attr]generated export-ignore -diff",
+			"*.txt text eol=crlf",
+			"*.bin binary",
+			"gen/** generated",
+			`"with space.go" export-subst`,
+			"!*.go export-ignore",
+			"docs/ export-ignore",
+			"sub/*.go export-ignore",
+		}, "\n")},
+		{"sub", strings.Join([]string{
+			"[attr]ignored export-ignore",
+			"*.go -export-ignore",
+			"*.txt !eol",
+		}, "\n")},
+	}
+	for _, f := range files {
+		if err := ga.add(f.dir, strings.NewReader(f.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tcs := []struct {
+		name     string
+		expected map[string]string
+	}{
+		{"a.txt", map[string]string{"text": "set", "eol": "crlf"}},
+		{"a.bin", map[string]string{
+			"binary": "set",
+			"diff":   "unset",
+			"merge":  "unset",
+			"text":   "unset",
+		}},
+		{"gen/a.go", map[string]string{
+			"generated":     "set",
+			"export-ignore": "set",
+			"diff":          "unset",
+		}},
+		{"with space.go", map[string]string{"export-subst": "set"}},
+		{"docs/a.md", map[string]string{}},
+		{"sub/a.go", map[string]string{"export-ignore": "unset"}},
+		{"sub/a.txt", map[string]string{"text": "set"}},
+	}
+
+	for _, tc := range tcs {
+		attrs := ga.lookup(tc.name)
+		if !reflect.DeepEqual(attrs, tc.expected) {
+			t.Errorf("%s: expected %v, got %v",
+				tc.name, tc.expected, attrs)
+		}
+	}
+}
+
+func TestNeedsEOLConversion(t *testing.T) {
+	tcs := []struct {
+		attrs    map[string]string
+		content  string
+		expected bool
+	}{
+		{map[string]string{}, "a\r\n", false},
+		{map[string]string{"text": "set"}, "a\r\n", true},
+		{map[string]string{"text": "unset", "eol": "crlf"}, "a\r\n", false},
+		{map[string]string{"text": "auto"}, "a\r\n", true},
+		{map[string]string{"text": "auto"}, "a\x00\r\n", false},
+		{map[string]string{"eol": "lf"}, "a\r\n", true},
+		{map[string]string{"crlf": "set"}, "a\r\n", true},
+	}
+
+	for _, tc := range tcs {
+		got := needsEOLConversion(tc.attrs, []byte(tc.content))
+		if got != tc.expected {
+			t.Errorf("%v with %q: expected %v", tc.attrs,
+				tc.content, tc.expected)
+		}
+	}
+}
@@ -16,24 +16,26 @@
 package retrodep
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"go/build"
 	"io"
+	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"strings"
 
 	"github.com/op/go-logging"
 	"github.com/pkg/errors"
 	"golang.org/x/tools/go/vcs"
 
+	"github.com/release-engineering/retrodep/v2/retrodep/config"
 	"github.com/release-engineering/retrodep/v2/retrodep/glide"
 )
 
-var vcsRepoRootForImportPath = vcs.RepoRootForImportPath
-
 // RepoPath is a vcs.RepoRoot along with the sub-path within the
 // repository, and the version.
 type RepoPath struct {
@@ -45,6 +47,36 @@ type RepoPath struct {
 
 	Version string
 
+	// Packages holds the import paths of the packages present in
+	// a vendored copy of the project, if known.
+	Packages []string
+
+	// Rule is the Source of the Rule used to find the repository,
+	// or "" if none was used.
+	Rule string
+
+	// Dir is the filepath to a vendored copy of the project, if
+	// known.
+	Dir string
+
+	// Chain holds the import paths of the vendored projects
+	// through which a vendored copy of this project is reached,
+	// outermost first. It is empty for projects in the top-level
+	// vendor directory.
+	Chain []string
+
+	// Forks holds repository URLs of forks of the project, to
+	// try if no match is found in its own repository.
+	Forks []string
+
+	// Skip is true if the project should not be identified.
+	Skip bool
+
+	// Exclude holds exclusion patterns, relative to the
+	// top-level of the vendored copy, which apply only to this
+	// project.
+	Exclude []string
+
 	// Error encountered when finding repo path.
 	Err error
 }
@@ -64,11 +96,48 @@ type GoSource struct {
 	// Package is the import path for the top-level package
 	Package string
 
+	// Resolver is used to find repositories for import paths. If
+	// nil, VCSResolver is used.
+	Resolver Resolver
+
+	// Rules are consulted before Resolver to find repositories
+	// for import paths.
+	Rules Rules
+
+	// OpenWorkingTree is used to obtain working trees for the
+	// forks of vendored projects. If nil, NewWorkingTreeContext
+	// is used and the working trees are removed after use.
+	OpenWorkingTree func(ctx context.Context, root *vcs.RepoRoot) (WorkingTree, error)
+
+	// Config is the configuration applied, if any.
+	Config *config.Config
+
+	// VendorDir is the directory, relative to Path, holding
+	// vendored source code. It is detected from the layout used
+	// by the vendoring tool, for example "vendor" or
+	// "Godeps/_workspace/src".
+	VendorDir string
+
+	// Normalise holds the normalisations to apply to files which
+	// do not match upstream exactly.
+	Normalise Normalisation
+
+	// Normalisers holds the changes made to the content of
+	// vendored files by the vendoring tools in use, detected from
+	// their manifests.
+	Normalisers []Normaliser
+
+	// ShowRemoved selects the upstream files missing from the
+	// local copy to show as deletions when comparing with
+	// upstream.
+	ShowRemoved RemovedFiles
+
 	// repoPaths maps apparent import paths to actual repositories
 	repoPaths map[string]*RepoPath
 
-	// excludes is a map of paths to ignore in this project
-	excludes map[string]struct{}
+	// excludes holds the patterns for paths to ignore in this
+	// project
+	excludes *Excludes
 
 	// usesGodep is true if Godeps/Godeps.json is present
 	usesGodep bool
@@ -76,6 +145,9 @@ type GoSource struct {
 
 // FindExcludes returns a slice of paths which match the provided
 // globs.
+//
+// Deprecated: globs are only matched at the top-level. Use Excludes,
+// which supports the patterns described in gitignore(5), instead.
 func FindExcludes(path string, globs []string) ([]string, error) {
 	excludes := make([]string, 0)
 	for _, glob := range globs {
@@ -90,36 +162,52 @@ func FindExcludes(path string, globs []string) ([]string, error) {
 	return excludes, nil
 }
 
+// GoSourceOptions holds settings for creating a GoSource.
+type GoSourceOptions struct {
+	// Excludes holds the patterns, relative to the path given,
+	// for paths which will not be considered when matching
+	// against upstream repositories. If nil, nothing is excluded.
+	Excludes *Excludes
+
+	// Resolver is used to find repositories for import paths,
+	// including when inferring the top-level import path. If
+	// nil, VCSResolver is used.
+	Resolver Resolver
+}
+
 // FindGoSources looks for top-level projects at path. If path is itself
 // a top-level project, the returned slice contains a single *GoSource
 // for that project; otherwise immediate sub-directories are tested.
-// Files matching globs in excludeGlobs will not be considered when
+// Files matching the patterns in excludeGlobs, in the format described
+// in gitignore(5) and relative to path, will not be considered when
 // matching against upstream repositories.
 func FindGoSources(path string, excludeGlobs []string) ([]*GoSource, error) {
-	// Try at the top-level.
-	excludes, err := FindExcludes(path, excludeGlobs)
-	if err != nil {
-		return nil, err
+	return FindGoSourcesWithExcludes(path, NewExcludes(excludeGlobs))
+}
+
+// FindGoSourcesWithExcludes is like FindGoSources but takes
+// exclusion patterns, relative to path, as an *Excludes.
+func FindGoSourcesWithExcludes(path string, excl *Excludes) ([]*GoSource, error) {
+	return FindGoSourcesWithOptions(path, &GoSourceOptions{Excludes: excl})
+}
+
+// FindGoSourcesWithOptions is like FindGoSources but takes its
+// settings from opts.
+func FindGoSourcesWithOptions(path string, opts *GoSourceOptions) ([]*GoSource, error) {
+	excl := opts.Excludes
+	if excl == nil {
+		excl = &Excludes{}
 	}
-	src, terr := NewGoSource(path, excludes)
+
+	// Try at the top-level.
+	src, terr := NewGoSourceWithOptions(path, opts)
 	if terr == nil {
 		log.Debugf("found project at top-level: %s", path)
 		return []*GoSource{src}, nil
 	}
 
-	// Convert the exclusions list to absolute paths and make a
-	// map for fast look-up.
-	excl := make(map[string]struct{})
-	for _, e := range excludes {
-		a, err := filepath.Abs(e)
-		if err != nil {
-			return nil, err
-		}
-		excl[a] = struct{}{}
-	}
-
-	// Work out the absolute path we were given, for constructing
-	// keys to look up in excl
+	// Work out the absolute path we were given, for finding
+	// sub-directory names
 	abs, err := filepath.Abs(path)
 	if err != nil {
 		return nil, errors.Wrapf(err, "Abs(%q)", path)
@@ -150,12 +238,16 @@ func FindGoSources(path string, excludeGlobs []string) ([]*GoSource, error) {
 		}
 
 		// Check if this is excluded from consideration
-		if _, ok := excl[p]; ok {
+		sub := p[subDirStart:]
+		if excl.Excluded(sub, true) {
 			return filepath.SkipDir
 		}
 
-		r := filepath.Join(path, p[subDirStart:])
-		src, err := NewGoSource(r, excludes)
+		r := filepath.Join(path, sub)
+		src, err := NewGoSourceWithOptions(r, &GoSourceOptions{
+			Excludes: excl.sub(sub),
+			Resolver: opts.Resolver,
+		})
 		if err != nil {
 			if _, ok := err.(*build.NoGoError); ok {
 				return nil
@@ -194,19 +286,45 @@ func FindGoSources(path string, excludeGlobs []string) ([]*GoSource, error) {
 // in excludes will not be considered when matching against the
 // upstream repository.
 func NewGoSource(path string, excludes []string) (*GoSource, error) {
+	excl := &Excludes{}
+	for _, e := range excludes {
+		rel, err := filepath.Rel(path, e)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Rel(%q, %q)", path, e)
+		}
+		if strings.HasPrefix(rel, "..") {
+			continue
+		}
+		excl.Add(literalPattern(filepath.ToSlash(rel)))
+	}
+	return NewGoSourceWithExcludes(path, excl)
+}
+
+// NewGoSourceWithExcludes returns a *GoSource for the given path
+// path. Paths matching the patterns in excl, which are relative to
+// path, will not be considered when matching against the upstream
+// repository.
+func NewGoSourceWithExcludes(path string, excl *Excludes) (*GoSource, error) {
+	return NewGoSourceWithOptions(path, &GoSourceOptions{Excludes: excl})
+}
+
+// NewGoSourceWithOptions is like NewGoSource but takes its settings
+// from opts.
+func NewGoSourceWithOptions(path string, opts *GoSourceOptions) (*GoSource, error) {
+	excl := opts.Excludes
+	if excl == nil {
+		excl = &Excludes{}
+	}
+
 	// There has to be either:
-	// - a 'vendor' subdirectory, or
+	// - a vendor directory, or
 	// - some '*.go' files with Go code in
 	// Otherwise there is nothing for us to do.
-	var vendorExists bool
-	st, err := os.Stat(filepath.Join(path, "vendor"))
-	if err == nil {
-		vendorExists = st.IsDir()
-	}
+	vendorDir, vendorExists, err := findVendorDir(path)
 	switch {
 	case vendorExists:
 		// There is a vendor directory. Nothing else to check.
-	case err == nil || os.IsNotExist(err):
+	case err == nil:
 		// No vendor directory, check for Go source.
 		_, err := build.ImportDir(path, build.ImportComment)
 		if err != nil {
@@ -217,14 +335,11 @@ func NewGoSource(path string, excludes []string) (*GoSource, error) {
 		return nil, err
 	}
 
-	excl := make(map[string]struct{})
-	for _, e := range excludes {
-		excl[e] = struct{}{}
-	}
-
 	src := &GoSource{
-		Path:     path,
-		excludes: excl,
+		Path:      path,
+		VendorDir: vendorDir,
+		Resolver:  opts.Resolver,
+		excludes:  excl.sub(""),
 	}
 
 	// Always read Godeps.json because we need to know whether
@@ -241,10 +356,22 @@ func NewGoSource(path string, excludes []string) (*GoSource, error) {
 		return nil, err
 	}
 
+	// Settings in .retrodep.yaml take precedence.
+	err = loadConfig(src)
+	if err != nil {
+		return nil, err
+	}
+
+	// Work out how vendoring tools changed the files they copied.
+	err = findNormalisers(src)
+	if err != nil {
+		return nil, err
+	}
+
 	if !ok && src.Package == "" {
 		if importPath, err := findImportComment(src); err == nil {
 			src.Package = importPath
-		} else if importPath, ok := importPathFromFilepath(path); ok {
+		} else if importPath, ok := importPathFromFilepath(src.resolver(), path); ok {
 			src.Package = importPath
 		}
 	}
@@ -252,6 +379,71 @@ func NewGoSource(path string, excludes []string) (*GoSource, error) {
 	return src, nil
 }
 
+// vendorLayouts lists the locations of vendored source code used by
+// vendoring tools, most specific first. Each is used only if the
+// manifest, if any, is present as well.
+var vendorLayouts = []struct {
+	dir, manifest string
+}{
+	// godep before Go 1.6
+	{filepath.Join("Godeps", "_workspace", "src"), filepath.Join("Godeps", "Godeps.json")},
+
+	// gb
+	{filepath.Join("vendor", "src"), filepath.Join("vendor", "manifest")},
+
+	{"vendor", ""},
+	{"_vendor", ""},
+}
+
+// findVendorDir returns the directory, relative to path, holding
+// vendored source code, and whether it exists. If none of the known
+// layouts is found the result is "vendor". Errors from os.Stat other
+// than for a missing file are returned.
+func findVendorDir(path string) (string, bool, error) {
+	isDir := func(p string) (bool, error) {
+		st, err := os.Stat(filepath.Join(path, p))
+		switch {
+		case err == nil:
+			return st.IsDir(), nil
+		case os.IsNotExist(err):
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+
+	for _, layout := range vendorLayouts {
+		if layout.manifest != "" {
+			_, err := os.Stat(filepath.Join(path, layout.manifest))
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				return "", false, err
+			}
+		}
+		ok, err := isDir(layout.dir)
+		if err != nil {
+			return "", false, err
+		}
+		if ok {
+			log.Debugf("vendor directory for %s: %s", path, layout.dir)
+			return layout.dir, true, nil
+		}
+	}
+	return "vendor", false, nil
+}
+
+// isExcluded returns true if path, which is within src.Path, is
+// excluded. If isDir is true, path is a directory.
+func (src *GoSource) isExcluded(path string, isDir bool) bool {
+	rel, err := filepath.Rel(src.Path, path)
+	if err != nil {
+		return false
+	}
+	return src.excludes.Excluded(rel, isDir)
+}
+
 // loadGodepsConf parses Godeps/Godeps.json to extract the package
 // name.
 func loadGodepsConf(src *GoSource) error {
@@ -259,7 +451,7 @@ func loadGodepsConf(src *GoSource) error {
 		ImportPath string
 	}
 	conf := filepath.Join(src.Path, "Godeps", "Godeps.json")
-	if _, skip := src.excludes[conf]; skip {
+	if src.isExcluded(conf, false) {
 		return nil
 	}
 	f, err := os.Open(conf)
@@ -289,7 +481,7 @@ func loadGodepsConf(src *GoSource) error {
 // successfully.
 func loadGlideConf(src *GoSource) (bool, error) {
 	conf := filepath.Join(src.Path, "glide.yaml")
-	if _, skip := src.excludes[conf]; skip {
+	if src.isExcluded(conf, false) {
 		return false, nil
 	}
 
@@ -313,17 +505,13 @@ func loadGlideConf(src *GoSource) (bool, error) {
 		return false, errors.Wrapf(err, "stat 'vendor' for %s", conf)
 	}
 
+	// Repositories not named in glide.yaml are resolved when
+	// needed, in RepoPathForImportPath.
 	repoPaths := make(map[string]*RepoPath)
 	for _, imp := range glide.Imports {
-		theVcs := vcs.ByCmd(vcsGit) // default to git
-		if imp.Repo == "" {
-			root, err := vcs.RepoRootForImportPath(imp.Name, false)
-			if err != nil {
-				log.Infof("Skipping %v, could not determine repo root: %v", imp.Name, err)
-				continue
-			}
-			imp.Repo = root.Repo
-			theVcs = root.VCS
+		var theVcs *vcs.Cmd
+		if imp.Repo != "" {
+			theVcs = vcs.ByCmd(vcsGit) // default to git
 		}
 
 		repoPaths[imp.Name] = &RepoPath{
@@ -340,9 +528,80 @@ func loadGlideConf(src *GoSource) (bool, error) {
 	return true, nil
 }
 
+// loadConfig reads .retrodep.yaml, if present, and applies it.
+func loadConfig(src *GoSource) error {
+	conf := filepath.Join(src.Path, config.DefaultFile)
+	if src.isExcluded(conf, false) {
+		return nil
+	}
+
+	c, err := config.Load(conf)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.Wrapf(err, "decoding %s", conf)
+	}
+
+	return errors.Wrap(src.ApplyConfig(c), conf)
+}
+
+// ApplyConfig applies the settings in conf to src. They take
+// precedence over any found in other configuration files, such as
+// glide.yaml.
+func (src *GoSource) ApplyConfig(conf *config.Config) error {
+	if conf.ImportPath != "" {
+		src.Package = conf.ImportPath
+		log.Debugf("import path from configuration: %s", src.Package)
+	}
+
+	if src.excludes == nil {
+		src.excludes = &Excludes{}
+	}
+	src.excludes.Add(conf.Exclude...)
+
+	if src.repoPaths == nil {
+		src.repoPaths = make(map[string]*RepoPath)
+	}
+	for _, dep := range conf.Dependencies {
+		// Start from what is already known, for example from
+		// glide.yaml.
+		repoPath := &RepoPath{
+			RepoRoot: vcs.RepoRoot{Root: dep.ImportPath},
+		}
+		if known, ok := src.repoPaths[dep.ImportPath]; ok {
+			copied := *known
+			repoPath = &copied
+		}
+
+		if dep.Repo != "" {
+			cmd := dep.VCS
+			if cmd == "" {
+				cmd = vcsGit
+			}
+			repoPath.VCS = vcs.ByCmd(cmd)
+			if repoPath.VCS == nil {
+				return fmt.Errorf("%s: unknown VCS %q",
+					dep.ImportPath, cmd)
+			}
+			repoPath.Repo = dep.Repo
+		}
+		if dep.Version != "" {
+			repoPath.Version = dep.Version
+		}
+		repoPath.Forks = dep.Forks
+		repoPath.Exclude = dep.Exclude
+		repoPath.Skip = dep.Skip
+		src.repoPaths[dep.ImportPath] = repoPath
+	}
+
+	src.Config = conf
+	return nil
+}
+
 // importPathFromFilepath attempts to use the project directory path to
-// infer its import path.
-func importPathFromFilepath(path string) (string, bool) {
+// infer its import path, checking candidates using the resolver.
+func importPathFromFilepath(resolver Resolver, path string) (string, bool) {
 	absPath, err := filepath.Abs(path)
 	if err != nil {
 		return "", false
@@ -369,7 +628,7 @@ func importPathFromFilepath(path string) (string, bool) {
 		}
 
 		p := strings.Join(components[i:len(components)], "/")
-		_, err := vcs.RepoRootForImportPath(p, false)
+		_, err := resolver.RepoRootForImportPath(p)
 		if err == nil {
 			return p, true
 		}
@@ -387,15 +646,15 @@ func findImportComment(src *GoSource) (string, error) {
 	var importPath string
 
 	search := func(path string, info os.FileInfo, err error) error {
-		if _, skip := src.excludes[path]; skip {
+		if err != nil {
+			return err
+		}
+		if src.isExcluded(path, info.IsDir()) {
 			if info.IsDir() {
 				return filepath.SkipDir
 			}
 			return nil
 		}
-		if err != nil {
-			return err
-		}
 		if !info.IsDir() {
 			return nil
 		}
@@ -411,6 +670,9 @@ func findImportComment(src *GoSource) (string, error) {
 		case "vendor", "testdata", "_override":
 			return filepath.SkipDir
 		}
+		if path == src.Vendor() {
+			return filepath.SkipDir
+		}
 
 		pkg, err := build.ImportDir(path, build.ImportComment)
 		if err != nil {
@@ -474,9 +736,14 @@ func (src *GoSource) SetSubPath(root string) error {
 	return nil
 }
 
-// Vendor returns the path to the vendored source code.
+// Vendor returns the path to the vendored source code, in
+// src.VendorDir.
 func (src GoSource) Vendor() string {
-	return filepath.Join(src.Path, "vendor")
+	vendorDir := src.VendorDir
+	if vendorDir == "" {
+		vendorDir = "vendor"
+	}
+	return filepath.Join(src.Path, vendorDir)
 }
 
 // Project returns information about the project's repository, as well
@@ -491,7 +758,7 @@ func (src GoSource) Project(importPath string) (*RepoPath, error) {
 		}
 	}
 
-	repoRoot, err := vcsRepoRootForImportPath(importPath, false)
+	repoRoot, rule, err := src.repoRoot(importPath)
 	if err != nil {
 		return &RepoPath{
 			RepoRoot: vcs.RepoRoot{Root: importPath},
@@ -514,9 +781,21 @@ func (src GoSource) Project(importPath string) (*RepoPath, error) {
 	return &RepoPath{
 		RepoRoot: *repoRoot,
 		SubPath:  subPath,
+		Rule:     rule,
 	}, err
 }
 
+// repoRoot returns the repository root for importPath, along with
+// the Source of the Rule used to find it, if any. Rules are consulted
+// before the Resolver.
+func (src GoSource) repoRoot(importPath string) (*vcs.RepoRoot, string, error) {
+	if root, rule := src.Rules.Match(importPath); root != nil {
+		return root, rule.Source, nil
+	}
+	root, err := src.resolver().RepoRootForImportPath(importPath)
+	return root, "", err
+}
+
 // RepoPathForImportPath takes an import path and returns a *RepoPath
 // for it, based on possible replacements within the Go source
 // configuration.
@@ -525,10 +804,23 @@ func (src GoSource) RepoPathForImportPath(importPath string) (*RepoPath, error)
 	pth := importPath
 	for {
 		repl, ok := src.repoPaths[pth]
-		if ok {
-			// Found a replacement repo
+		if ok && (repl.Repo != "" || repl.Skip) {
+			// Found a replacement repo, or no repo is
+			// needed
 			return repl, nil
 		}
+		if ok {
+			// Found a version but not a repo
+			root, rule, err := src.repoRoot(pth)
+			if err == nil {
+				resolved := *repl
+				resolved.Repo = root.Repo
+				resolved.VCS = root.VCS
+				resolved.Rule = rule
+				return &resolved, nil
+			}
+			log.Infof("Skipping %v, could not determine repo root: %v", pth, err)
+		}
 
 		// Try shorter import path
 		pth = path.Dir(pth)
@@ -538,7 +830,7 @@ func (src GoSource) RepoPathForImportPath(importPath string) (*RepoPath, error)
 	}
 
 	// No replacement found, use the import pth as-is
-	r, err := vcs.RepoRootForImportPath(importPath, false)
+	r, rule, err := src.repoRoot(importPath)
 	if err != nil {
 		u := strings.Index(importPath, "_")
 		if u == -1 {
@@ -548,24 +840,120 @@ func (src GoSource) RepoPathForImportPath(importPath string) (*RepoPath, error)
 		// gopkg.in/foo/bar.v2/_examples/chat1
 		// because of the underscore. Remove it and try again.
 		importPath = path.Dir(importPath[:u])
-		r2, err2 := vcs.RepoRootForImportPath(importPath, false)
+		r2, rule2, err2 := src.repoRoot(importPath)
 		if err2 != nil {
 			return nil, err // Returning the initial error is intentional
 		}
-		return &RepoPath{RepoRoot: *r2}, nil
+		return &RepoPath{RepoRoot: *r2, Rule: rule2}, nil
 	}
-	return &RepoPath{RepoRoot: *r}, nil
+	return &RepoPath{RepoRoot: *r, Rule: rule}, nil
 }
 
 // Diff writes (to out) the differences between the Go source code at
-// dir and the repository at revision ref, ignoring files which are
-// only present in the repository. It returns true if changes were
-// found and false if not.
+// dir and the repository at revision ref. Files which are only
+// present in the repository are ignored unless src.ShowRemoved
+// selects them. The differences are in the unified diff format used
+// by git, with file names relative to the repository root. It returns
+// true if changes were found and false if not.
 func (src GoSource) Diff(project *RepoPath, wt WorkingTree, out io.Writer, dir, ref string) (bool, error) {
+	return src.diff(context.Background(), project, wt, out, dir, ref)
+}
+
+// DiffContext is like Diff but gives up, with ctx.Err(), once ctx is
+// done. Commands run in wt are killed at that point.
+func (src GoSource) DiffContext(ctx context.Context, project *RepoPath, wt WorkingTree, out io.Writer, dir, ref string) (bool, error) {
+	wt = WorkingTreeWithContext(ctx, wt)
+	return src.diff(ctx, project, wt, out, dir, ref)
+}
+
+func (src GoSource) diff(ctx context.Context, project *RepoPath, wt WorkingTree, out io.Writer, dir, ref string) (bool, error) {
+	diffs, err := src.fileDiffs(ctx, project, wt, dir, ref, DefaultDiffContext)
+	if err != nil {
+		return false, err
+	}
+	for _, d := range diffs {
+		if _, err := d.WriteTo(out); err != nil {
+			return true, err
+		}
+	}
+	return len(diffs) > 0, nil
+}
+
+// FileDiffs returns the differences between the Go source code at dir
+// and the repository at revision ref, ignoring files which are only
+// present in the repository unless src.ShowRemoved selects them.
+// There is one FileDiff, showing lines unchanged lines around each
+// change, for each file which differs, sorted by Path.
+func (src GoSource) FileDiffs(project *RepoPath, wt WorkingTree, dir, ref string, lines int) ([]*FileDiff, error) {
+	return src.fileDiffs(context.Background(), project, wt, dir, ref, lines)
+}
+
+// FileDiffsContext is like FileDiffs but gives up, with ctx.Err(),
+// once ctx is done.
+func (src GoSource) FileDiffsContext(ctx context.Context, project *RepoPath, wt WorkingTree, dir, ref string, lines int) ([]*FileDiff, error) {
+	wt = WorkingTreeWithContext(ctx, wt)
+	return src.fileDiffs(ctx, project, wt, dir, ref, lines)
+}
+
+func (src GoSource) fileDiffs(ctx context.Context, project *RepoPath, wt WorkingTree, dir, ref string, lines int) ([]*FileDiff, error) {
+	hashes, refHashes, mismatches, err := src.diffMismatches(project, wt, dir, ref)
+	if err != nil {
+		return nil, err
+	}
+	removed, err := src.removedFiles(project, dir, hashes, refHashes)
+	if err != nil {
+		return nil, err
+	}
+	mismatches = append(mismatches, removed...)
+	sort.Strings(mismatches)
+
+	// Files added compared to upstream are compared with an
+	// empty file, and files removed are compared with no file.
+	subPath := project.SubPath
+	normalisers := src.normalisersFor(dir)
+	var diffs []*FileDiff
+	for _, mismatch := range mismatches {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		var old []byte
+		if _, ok := refHashes[mismatch]; ok {
+			old, err = wt.ReadFile(filepath.Join(subPath, mismatch))
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		var new []byte
+		if _, ok := hashes[mismatch]; ok {
+			new, err = ioutil.ReadFile(filepath.Join(dir, mismatch))
+			if err != nil {
+				return nil, err
+			}
+		} else if _, keep, _ := normalise(normalisers, mismatch, old); !keep {
+			// The vendoring tool removed this file
+			continue
+		}
+
+		repoPath := path.Join(filepath.ToSlash(subPath),
+			filepath.ToSlash(mismatch))
+		if d := NewFileDiff(repoPath, old, new, lines); d != nil {
+			diffs = append(diffs, d)
+		}
+	}
+	return diffs, nil
+}
+
+// diffMismatches syncs wt to ref and returns the hashes of the local
+// files in dir, and of the upstream files after changing them in the
+// same way as the vendoring tool, along with the local files which
+// differ from them.
+func (src GoSource) diffMismatches(project *RepoPath, wt WorkingTree, dir, ref string) (FileHashes, FileHashes, []string, error) {
 	// Hash the local files.
 	hashes, err := src.hashLocalFiles(wt, project, dir)
 	if err != nil {
-		return false, err
+		return nil, nil, nil, err
 	}
 
 	// Work out the sub-directory within the repository root to
@@ -574,55 +962,34 @@ func (src GoSource) Diff(project *RepoPath, wt WorkingTree, out io.Writer, dir,
 	projDir := filepath.Join(project.Root, subPath)
 	log.Debugf("describing %s compared to %s", dir, projDir)
 
-	// If godep is in use, strip import comments from the
-	// project's vendored files (but not files from the top-level
-	// project).
-	strip := src.usesGodep && dir != src.Path
-
 	// Sync the files in the working tree to the requested ref,
 	// ready to diff them.
 	err = wt.RevSync(ref)
 	if err != nil {
-		return false, err
+		return nil, nil, nil, err
 	}
 
 	refHashes, err := wt.FileHashesFromRef(ref, subPath)
 	if err != nil {
-		return false, err
+		return nil, nil, nil, err
 	}
 
-	if strip {
-		// Update the working tree files corresponding to the
-		// local files.
+	// Change the upstream files in the same way as the vendoring
+	// tool, so that only other changes are shown.
+	if normalisers := src.normalisersFor(dir); normalisers != nil {
 		var paths []string
 		for path := range hashes {
-			paths = append(paths, filepath.Join(subPath, path))
+			if _, ok := refHashes[path]; ok {
+				paths = append(paths, path)
+			}
 		}
 
-		_, err := updateHashesAfterStrip(hashes, wt, ref, paths)
+		err := updateHashesAfterNormalise(refHashes, wt, ref,
+			subPath, paths, normalisers)
 		if err != nil {
-			return false, err
+			return nil, nil, nil, err
 		}
 	}
 
-	// For each file which differs, write the "diff -u" output.
-	// For files added compared to upstream, write the "diff -u"
-	// output compared to /dev/null.
-	changes := false
-	for _, mismatch := range hashes.Mismatches(refHashes, false) {
-		var refFile string
-
-		// Does the file exist in the working tree?
-		if _, ok := refHashes[mismatch]; ok {
-			refFile = filepath.Join(subPath, mismatch)
-		}
-
-		c, err := wt.Diff(out, refFile, filepath.Join(dir, mismatch))
-		if err != nil {
-			return changes, err
-		}
-
-		changes = changes || c
-	}
-	return changes, nil
+	return hashes, refHashes, hashes.Mismatches(refHashes, false), nil
 }
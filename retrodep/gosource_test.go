@@ -16,7 +16,9 @@
 package retrodep
 
 import (
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 
@@ -91,6 +93,43 @@ func TestNewGoSource(t *testing.T) {
 	}
 }
 
+func TestNewGoSourceWithOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "retrodep-test.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "example.com", "foo")
+	if err := os.MkdirAll(path, 0755); err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(path, "foo.go"),
+		[]byte("package foo\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The Resolver given is used to infer the import path.
+	resolver := ResolverFunc(func(importPath string) (*vcs.RepoRoot, error) {
+		if importPath != "example.com/foo" {
+			return nil, ErrorUnresolved
+		}
+		return &vcs.RepoRoot{Root: importPath}, nil
+	})
+	src, err := NewGoSourceWithOptions(path, &GoSourceOptions{
+		Resolver: resolver,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if src.Package != "example.com/foo" {
+		t.Errorf("got package %q", src.Package)
+	}
+	if src.Resolver == nil {
+		t.Error("Resolver not set")
+	}
+}
+
 func TestFindGoSources(t *testing.T) {
 	type exp struct {
 		path, subpath string
@@ -141,6 +180,16 @@ func TestFindGoSources(t *testing.T) {
 	}
 }
 
+func TestFindGoSourcesExcludes(t *testing.T) {
+	srcs, err := FindGoSources("testdata/multi", []string{"def/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(srcs) != 1 || srcs[0].Path != "testdata/multi/abc" {
+		t.Fatalf("expected only testdata/multi/abc, got %v", srcs)
+	}
+}
+
 func TestProject(t *testing.T) {
 	type tcase struct {
 		name       string
@@ -168,17 +217,12 @@ func TestProject(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	// Reset vcsRepoRootForImportPath after this test.
-	defer func() {
-		vcsRepoRootForImportPath = vcs.RepoRootForImportPath
-	}()
-
 	for _, tc := range tcases {
-		vcsRepoRootForImportPath = func(importPath string, _ bool) (*vcs.RepoRoot, error) {
+		src.Resolver = ResolverFunc(func(importPath string) (*vcs.RepoRoot, error) {
 			return &vcs.RepoRoot{
 				Root: tc.root,
 			}, nil
-		}
+		})
 
 		repoPath, err := src.Project(tc.importPath)
 		if err != nil {
@@ -250,6 +294,50 @@ func TestGlideTrue(t *testing.T) {
 	}
 }
 
+func TestConfig(t *testing.T) {
+	src, err := NewGoSource("testdata/config", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if src.Package != "github.com/example/config" {
+		t.Errorf("Package: got %q", src.Package)
+	}
+	if !src.isExcluded(filepath.Join(src.Path, "Dockerfile"), false) {
+		t.Errorf("Dockerfile not excluded")
+	}
+
+	vendored, err := src.VendoredProjects()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bar, ok := vendored["github.com/foo/bar"]
+	if !ok {
+		t.Fatal("github.com/foo/bar missing")
+	}
+	if bar.Repo != "https://example.com/mirror/bar.git" ||
+		bar.VCS == nil || bar.VCS.Cmd != "git" {
+		t.Errorf("github.com/foo/bar: wrong repo %s", bar.Repo)
+	}
+	if bar.Version != "v1.2.0" {
+		t.Errorf("github.com/foo/bar: wrong version %s", bar.Version)
+	}
+	if len(bar.Forks) != 1 || bar.Forks[0] != "https://example.com/fork/bar.git" {
+		t.Errorf("github.com/foo/bar: wrong forks %v", bar.Forks)
+	}
+	if len(bar.Exclude) != 1 || bar.Exclude[0] != "*.orig" {
+		t.Errorf("github.com/foo/bar: wrong exclude %v", bar.Exclude)
+	}
+
+	qux, ok := vendored["github.com/baz/qux"]
+	if !ok {
+		t.Fatal("github.com/baz/qux missing")
+	}
+	if !qux.Skip {
+		t.Errorf("github.com/baz/qux: not skipped")
+	}
+}
+
 func TestImportPathFromFilepath(t *testing.T) {
 	tests := []struct {
 		name                 string
@@ -295,7 +383,7 @@ func TestImportPathFromFilepath(t *testing.T) {
 	}
 
 	for _, test := range tests {
-		importPath, ok := importPathFromFilepath(test.filePath)
+		importPath, ok := importPathFromFilepath(VCSResolver, test.filePath)
 		if ok != test.ok {
 			t.Errorf("%s: wrong ok value for %s: got _,%v, want _,%v",
 				test.name, test.filePath, ok, test.ok)
@@ -328,16 +416,11 @@ func TestGoSourceDiff(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	// Reset vcsRepoRootForImportPath after this test.
-	defer func() {
-		vcsRepoRootForImportPath = vcs.RepoRootForImportPath
-	}()
-
-	vcsRepoRootForImportPath = func(importPath string, _ bool) (*vcs.RepoRoot, error) {
+	src.Resolver = ResolverFunc(func(importPath string) (*vcs.RepoRoot, error) {
 		return &vcs.RepoRoot{
 			Root: "example.com/foo/bar",
 		}, nil
-	}
+	})
 
 	project, err := src.Project("example.com/foo/bar")
 	if err != nil {
@@ -376,10 +459,10 @@ func TestGoSourceDiff(t *testing.T) {
 	}
 
 	expected := []string{
-		"testdata/godep/Godeps/Godeps.json",
-		"testdata/godep/importcomment.go",
-		"testdata/godep/nonl.go",
-		"testdata/godep/nonl.txt",
+		"b/Godeps/Godeps.json",
+		"b/importcomment.go",
+		"b/nonl.go",
+		"b/nonl.txt",
 	}
 	for _, expect := range expected {
 		if _, ok := newFiles[expect]; !ok {
@@ -390,3 +473,34 @@ func TestGoSourceDiff(t *testing.T) {
 		t.Errorf("got %d, expected %d", len(newFiles), len(expected))
 	}
 }
+
+func TestRepoPathForImportPathUnchanged(t *testing.T) {
+	src := GoSource{
+		Resolver: ResolverFunc(func(importPath string) (*vcs.RepoRoot, error) {
+			return &vcs.RepoRoot{
+				VCS:  vcs.ByCmd(vcsGit),
+				Repo: "https://example.com/foo",
+				Root: "example.com/foo",
+			}, nil
+		}),
+		repoPaths: map[string]*RepoPath{
+			"example.com/foo": &RepoPath{
+				RepoRoot: vcs.RepoRoot{Root: "example.com/foo"},
+				Version:  "v1.0.0",
+			},
+		},
+	}
+
+	repoPath, err := src.RepoPathForImportPath("example.com/foo/bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if repoPath.Repo != "https://example.com/foo" || repoPath.Version != "v1.0.0" {
+		t.Errorf("unexpected result: %v", repoPath)
+	}
+
+	// The configuration shared by copies of src is not changed.
+	if src.repoPaths["example.com/foo"].Repo != "" {
+		t.Errorf("repoPaths changed: %v", src.repoPaths)
+	}
+}
@@ -16,6 +16,9 @@
 package retrodep
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/xml"
 	"fmt"
 	"io/ioutil"
@@ -34,6 +37,10 @@ type hgWorkingTree struct {
 	anyWorkingTree
 }
 
+func (h *hgWorkingTree) withContext(ctx context.Context) WorkingTree {
+	return &hgWorkingTree{anyWorkingTree: h.anyWorkingTree.withContext(ctx)}
+}
+
 type hgLogEntry struct {
 	Node string `xml:"node,attr"`
 	Date []byte `xml:"date"`
@@ -94,6 +101,81 @@ func (h *hgWorkingTree) RevisionFromTag(tag string) (string, error) {
 	return entries[0].Node, nil
 }
 
+// IsAncestor returns true if ancestor is rev or one of its
+// ancestors, using 'hg log -r "... & ancestors(...)"'. It returns
+// ErrorInvalidRef if either is not present in the repository.
+func (h *hgWorkingTree) IsAncestor(ancestor, rev string) (bool, error) {
+	revset := "(" + ancestor + ") & ancestors(" + rev + ")"
+	stdout, stderr, err := h.run("log", "--template", "{node}\\n",
+		"-r", revset)
+	if err != nil {
+		if strings.Contains(stderr.String(), "unknown revision") {
+			return false, ErrorInvalidRef
+		}
+		h.showOutput(stdout, stderr)
+		return false, err
+	}
+	return strings.TrimSpace(stdout.String()) != "", nil
+}
+
+// ParentRevision returns the first parent of rev, or "" if it has
+// none, using 'hg log -r "p1(...)"'. It returns ErrorInvalidRef if
+// rev is not present in the repository.
+func (h *hgWorkingTree) ParentRevision(rev string) (string, error) {
+	stdout, stderr, err := h.run("log", "--template", "{node}\\n",
+		"-r", "p1("+rev+")")
+	if err != nil {
+		if strings.Contains(stderr.String(), "unknown revision") {
+			return "", ErrorInvalidRef
+		}
+		h.showOutput(stdout, stderr)
+		return "", err
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+// fileRevset returns a revset for the revisions which modified path.
+func fileRevset(path string) string {
+	return "file('path:" + strings.Replace(path, "'", "\\'", -1) + "')"
+}
+
+// RevisionWithBlob returns a revision in which path has content
+// with hash hash, using 'hg log -r "file(...)"' and 'hg cat'. Unlike
+// git, hg has no content-addressed store, so only revisions of path
+// itself are considered.
+func (h *hgWorkingTree) RevisionWithBlob(path string, hash FileHash) (string, error) {
+	entries, err := h.log([]string{"-r", fileRevset(path)}, 0)
+	if err != nil {
+		return "", err
+	}
+	for _, entry := range entries {
+		stdout, stderr, err := h.run("cat", "-r", entry.Node, "path:"+path)
+		if err != nil {
+			// Removed in this revision
+			log.Debugf("hg cat %s: %s", entry.Node, stderr.String())
+			continue
+		}
+		sum := sha256.Sum256(stdout.Bytes())
+		if FileHash(hex.EncodeToString(sum[:])) == hash {
+			return entry.Node, nil
+		}
+	}
+	return "", ErrorVersionNotFound
+}
+
+// RevisionWithPath returns the newest revision which modified path,
+// using 'hg log -r "file(...)"'.
+func (h *hgWorkingTree) RevisionWithPath(path string) (string, error) {
+	entries, err := h.log([]string{"-r", "max(" + fileRevset(path) + ")"}, 0)
+	if err != nil {
+		return "", err
+	}
+	if len(entries) == 0 {
+		return "", ErrorVersionNotFound
+	}
+	return entries[0].Node, nil
+}
+
 // RevSync updates the working tree to reflect the revision rev, using
 // 'hg update -r ...'. The working tree must not have been locally
 // modified.
@@ -0,0 +1,271 @@
+// Copyright (C) 2019 Tim Waugh
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package retrodep
+
+import (
+	"bytes"
+	"embed"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/pkg/errors"
+)
+
+// licenseTexts holds the corpus of license texts, named by their SPDX
+// identifiers, used to identify license files.
+//
+//go:embed licenses/*.txt
+var licenseTexts embed.FS
+
+// licenseMatchThreshold is the similarity, from 0 to 1, a license
+// file must have to a license text for it to be identified.
+const licenseMatchThreshold = 0.8
+
+// licenseNotices holds the SPDX identifiers of the licenses whose
+// standard notices, as placed in file headers, contain these words.
+var licenseNotices = []struct {
+	id, notice string
+}{
+	{"Apache-2.0", "licensed under the apache license version 2 0"},
+	{"MPL-2.0", "subject to the terms of the mozilla public license v 2 0"},
+	{"GPL-2.0-or-later", "the gnu general public license as published by the free software foundation either version 2 of the license or at your option any later version"},
+	{"GPL-3.0-or-later", "the gnu general public license as published by the free software foundation either version 3 of the license or at your option any later version"},
+	{"LGPL-2.1-or-later", "the gnu lesser general public license as published by the free software foundation either version 2 1 of the license or at your option any later version"},
+	{"LGPL-3.0-or-later", "the gnu lesser general public license as published by the free software foundation either version 3 of the license or at your option any later version"},
+	{"AGPL-3.0-or-later", "the gnu affero general public license as published by the free software foundation either version 3 of the license or at your option any later version"},
+}
+
+// spdxTag matches SPDX-License-Identifier tags in file headers.
+var spdxTag = regexp.MustCompile(`SPDX-License-Identifier:[ \t]*([^\r\n]*)`)
+
+// licenseFileNames holds the names, in upper case, of license files.
+// Each may be followed by "-" or "." and a suffix, as in LICENSE-MIT,
+// LICENSE.txt or COPYING.LIB.
+var licenseFileNames = []string{"LICENSE", "LICENCE", "COPYING", "NOTICE", "UNLICENSE"}
+
+// licenseTemplate is a license text from the corpus.
+type licenseTemplate struct {
+	id      string
+	bigrams map[string]struct{}
+}
+
+var (
+	licenseTemplatesOnce sync.Once
+	licenseTemplates     []licenseTemplate
+)
+
+// loadLicenseTemplates returns the license texts from the corpus.
+func loadLicenseTemplates() []licenseTemplate {
+	licenseTemplatesOnce.Do(func() {
+		entries, err := licenseTexts.ReadDir("licenses")
+		if err != nil {
+			panic(err)
+		}
+		for _, entry := range entries {
+			text, err := licenseTexts.ReadFile(path.Join("licenses",
+				entry.Name()))
+			if err != nil {
+				panic(err)
+			}
+			licenseTemplates = append(licenseTemplates,
+				licenseTemplate{
+					id:      strings.TrimSuffix(entry.Name(), ".txt"),
+					bigrams: wordBigrams(licenseWords(text)),
+				})
+		}
+	})
+	return licenseTemplates
+}
+
+// isLicenseFile returns true if the name of the file p shows it holds
+// license terms, for example LICENSE, COPYING.txt, LICENSE-MIT or
+// NOTICE. Files which would identify a project, such as license.go,
+// are not license files.
+func isLicenseFile(p string) bool {
+	base := filepath.Base(p)
+	if isProjectFile(strings.ToLower(base)) {
+		return false
+	}
+
+	name := strings.ToUpper(base)
+	for _, n := range licenseFileNames {
+		if name == n {
+			return true
+		}
+		if len(name) > len(n) && strings.HasPrefix(name, n) {
+			if c := name[len(n)]; c == '-' || c == '.' {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// licenseWords returns the words in text, in lower case and without
+// punctuation.
+func licenseWords(text []byte) []string {
+	return strings.FieldsFunc(strings.ToLower(string(text)),
+		func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+		})
+}
+
+// wordBigrams returns the set of pairs of adjacent words.
+func wordBigrams(words []string) map[string]struct{} {
+	bigrams := make(map[string]struct{})
+	for i := 1; i < len(words); i++ {
+		bigrams[words[i-1]+" "+words[i]] = struct{}{}
+	}
+	return bigrams
+}
+
+// identifyLicenseText returns the SPDX identifier of the license text
+// in the corpus most similar to text, or "" if none is similar
+// enough. Similarity is measured by the proportion of pairs of
+// adjacent words they share.
+func identifyLicenseText(text []byte) string {
+	bigrams := wordBigrams(licenseWords(text))
+	if len(bigrams) == 0 {
+		return ""
+	}
+
+	var best string
+	bestScore := licenseMatchThreshold
+	for _, tmpl := range loadLicenseTemplates() {
+		shared := 0
+		for bigram := range bigrams {
+			if _, ok := tmpl.bigrams[bigram]; ok {
+				shared++
+			}
+		}
+		score := 2 * float64(shared) /
+			float64(len(bigrams)+len(tmpl.bigrams))
+		if score >= bestScore {
+			best, bestScore = tmpl.id, score
+		}
+	}
+	return best
+}
+
+// noticeLicenses returns the SPDX identifiers of the licenses named
+// in text, either by SPDX-License-Identifier tags or by standard
+// license notices.
+func noticeLicenses(text []byte) []string {
+	var ids []string
+	for _, m := range spdxTag.FindAllSubmatch(text, -1) {
+		id := strings.TrimSpace(strings.TrimSuffix(
+			strings.TrimSpace(string(m[1])), "*/"))
+		if id != "" {
+			ids = append(ids, id)
+		}
+	}
+
+	words := " " + strings.Join(licenseWords(text), " ") + " "
+	for _, n := range licenseNotices {
+		if strings.Contains(words, " "+n.notice+" ") {
+			ids = append(ids, n.id)
+		}
+	}
+	return ids
+}
+
+// goSourceHeader returns the part of the start of a Go source file,
+// head, which comes before the package clause.
+func goSourceHeader(head []byte) []byte {
+	if bytes.HasPrefix(head, []byte("package ")) {
+		return nil
+	}
+	if i := bytes.Index(head, []byte("\npackage ")); i != -1 {
+		return head[:i]
+	}
+	return head
+}
+
+// detectLicenses returns the sorted SPDX identifiers of the licenses
+// found in the files in dir which have hashes: in license files, and
+// in the headers of Go source files.
+func detectLicenses(dir string, hashes FileHashes) ([]string, error) {
+	found := make(map[string]struct{})
+	buf := make([]byte, 8000)
+	for p := range hashes {
+		var ids []string
+		switch {
+		case isLicenseFile(p):
+			text, err := ioutil.ReadFile(filepath.Join(dir, p))
+			if err != nil {
+				return nil, errors.Wrap(err, "detectLicenses")
+			}
+			if id := identifyLicenseText(text); id != "" {
+				ids = []string{id}
+			} else {
+				ids = noticeLicenses(text)
+			}
+		case strings.HasSuffix(p, ".go"):
+			head, err := readFileHead(filepath.Join(dir, p), buf)
+			if err != nil {
+				return nil, errors.Wrap(err, "detectLicenses")
+			}
+			ids = noticeLicenses(goSourceHeader(head))
+		}
+		for _, id := range ids {
+			found[id] = struct{}{}
+		}
+	}
+
+	licenses := make([]string, 0, len(found))
+	for id := range found {
+		licenses = append(licenses, id)
+	}
+	sort.Strings(licenses)
+	if len(licenses) == 0 {
+		return nil, nil
+	}
+	return licenses, nil
+}
+
+// missingLicenseFiles returns the paths from refHashes of upstream
+// license files missing from hashes of the local copy. Only license
+// files at the top-level, or in directories present in the local
+// copy, are considered.
+func missingLicenseFiles(hashes, refHashes FileHashes) []string {
+	dirs := map[string]struct{}{".": {}}
+	for p := range hashes {
+		dirs[filepath.Dir(p)] = struct{}{}
+	}
+
+	var missing []string
+	for p := range refHashes {
+		if !isLicenseFile(p) {
+			continue
+		}
+		if _, ok := hashes[p]; ok {
+			continue
+		}
+		if _, ok := dirs[filepath.Dir(p)]; !ok {
+			continue
+		}
+		log.Debugf("%s: license file missing", p)
+		missing = append(missing, p)
+	}
+	sort.Strings(missing)
+	return missing
+}
@@ -0,0 +1,269 @@
+// Copyright (C) 2019 Tim Waugh
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package retrodep
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/tools/go/vcs"
+)
+
+func TestIdentifyLicenseText(t *testing.T) {
+	// Each text in the corpus identifies itself, even with the
+	// copyright holder filled in and re-wrapped.
+	templates := loadLicenseTemplates()
+	if len(templates) == 0 {
+		t.Fatal("no license texts")
+	}
+	for _, tmpl := range templates {
+		text, err := licenseTexts.ReadFile("licenses/" + tmpl.id + ".txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		filled := strings.NewReplacer(
+			"<year>", "2019",
+			"<copyright holders>", "Example Corp",
+			"<copyright holder>", "Example Corp",
+			"\n", " ",
+		).Replace(string(text))
+		id := identifyLicenseText([]byte("Copyright 2019 Example\n\n" + filled))
+		if id != tmpl.id {
+			t.Errorf("%s: identified as %q", tmpl.id, id)
+		}
+	}
+
+	for _, text := range []string{
+		"",
+		"All rights reserved.\n",
+		"This software may be used for any purpose whatsoever.\n",
+	} {
+		if id := identifyLicenseText([]byte(text)); id != "" {
+			t.Errorf("%q: identified as %q", text, id)
+		}
+	}
+}
+
+func TestNoticeLicenses(t *testing.T) {
+	tcs := []struct {
+		text     string
+		expected []string
+	}{
+		{"// Copyright 2019 Example\n", nil},
+		{"// SPDX-License-Identifier: MIT\n", []string{"MIT"}},
+		{"/* SPDX-License-Identifier: Apache-2.0 OR MIT */\n", []string{"Apache-2.0 OR MIT"}},
+		{
+			`// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+`,
+			[]string{"Apache-2.0"},
+		},
+		{
+			`// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+`,
+			[]string{"GPL-3.0-or-later"},
+		},
+		{
+			`# This library is free software; you can redistribute it and/or
+# modify it under the terms of the GNU Lesser General Public
+# License as published by the Free Software Foundation; either
+# version 2.1 of the License, or (at your option) any later version.
+`,
+			[]string{"LGPL-2.1-or-later"},
+		},
+	}
+
+	for _, tc := range tcs {
+		ids := noticeLicenses([]byte(tc.text))
+		if !reflect.DeepEqual(ids, tc.expected) {
+			t.Errorf("%q: expected %v, got %v", tc.text, tc.expected, ids)
+		}
+	}
+}
+
+func TestIsLicenseFile(t *testing.T) {
+	tcs := []struct {
+		path    string
+		license bool
+	}{
+		{"LICENSE", true},
+		{"License.md", true},
+		{"sub/LICENCE.txt", true},
+		{"COPYING", true},
+		{"copying.rst", true},
+		{"NOTICE", true},
+		{"UNLICENSE", true},
+		{"LICENSE-MIT", true},
+		{"LICENSE-APACHE", true},
+		{"LICENSE-APACHE.txt", true},
+		{"LICENSE.MIT", true},
+		{"COPYING.LIB", true},
+		{"license.go", false},
+		{"license_test.go", false},
+		{"notice.go", false},
+		{"copying_test.go", false},
+		{"LICENSE.go", false},
+		{"LICENSE-MIT.go", false},
+		{"COPYING.c", false},
+		{"NOTICE.proto", false},
+		{"LICENSEE", false},
+		{"LICENSES", false},
+		{"licenses/MIT.txt", false},
+		{"README", false},
+	}
+	for _, tc := range tcs {
+		if isLicenseFile(tc.path) != tc.license {
+			t.Errorf("%s: expected %t", tc.path, tc.license)
+		}
+	}
+}
+
+func TestDetectLicenses(t *testing.T) {
+	dir, err := ioutil.TempDir("", "retrodep-test.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mit, err := licenseTexts.ReadFile("licenses/MIT.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"LICENSE.txt": string(mit),
+		"a.go":        "// SPDX-License-Identifier: BSD-2-Clause\n\npackage a\n",
+		"b.go":        "package a\n\n// SPDX-License-Identifier: ISC\n",
+		"sub/c.go":    "// Licensed under the Apache License, Version 2.0\n\npackage sub\n",
+		"README":      "SPDX-License-Identifier: Unlicense\n",
+	}
+	for path, content := range files {
+		path = filepath.Join(dir, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	hashes, err := NewFileHashes(&sha256Hasher{}, dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	licenses, err := detectLicenses(dir, hashes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only license files and Go source file headers are examined
+	expected := []string{"Apache-2.0", "BSD-2-Clause", "MIT"}
+	if !reflect.DeepEqual(licenses, expected) {
+		t.Errorf("expected %v, got %v", expected, licenses)
+	}
+}
+
+func TestMissingLicenseFiles(t *testing.T) {
+	local := FileHashes{
+		"a.go":     "1",
+		"sub/b.go": "2",
+	}
+	upstream := FileHashes{
+		"a.go":              "1",
+		"LICENSE":           "3",
+		"NOTICE":            "4",
+		"sub/b.go":          "2",
+		"sub/COPYING":       "5",
+		"other/LICENSE.txt": "6",
+	}
+
+	// Omitted packages do not need their license files
+	missing := missingLicenseFiles(local, upstream)
+	expected := []string{"LICENSE", "NOTICE", "sub/COPYING"}
+	if !reflect.DeepEqual(missing, expected) {
+		t.Errorf("expected %v, got %v", expected, missing)
+	}
+
+	local["LICENSE"] = "3"
+	local["NOTICE"] = "4"
+	local["sub/COPYING"] = "5"
+	if missing := missingLicenseFiles(local, upstream); missing != nil {
+		t.Errorf("unexpected missing files %v", missing)
+	}
+}
+
+func TestDescribeProjectLicenses(t *testing.T) {
+	dir, err := ioutil.TempDir("", "retrodep-test.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mit, err := licenseTexts.ReadFile("licenses/MIT.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wt := &mockNormaliseWorkingTree{
+		upstream: map[string]string{
+			"a.go":    "package a\n",
+			"LICENSE": string(mit),
+		},
+	}
+	wt.hasher = &sha256Hasher{}
+	project := &RepoPath{RepoRoot: vcs.RepoRoot{Root: "example.com/a"}}
+
+	tcs := []struct {
+		local    []string
+		licenses []string
+		missing  []string
+	}{
+		{[]string{"a.go"}, nil, []string{"example.com/a/LICENSE"}},
+		{[]string{"a.go", "LICENSE"}, []string{"MIT"}, nil},
+	}
+
+	for _, tc := range tcs {
+		for _, path := range tc.local {
+			err := ioutil.WriteFile(filepath.Join(dir, path),
+				[]byte(wt.upstream[path]), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		src, err := NewGoSource(dir, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ref, err := src.DescribeProject(project, wt, dir, nil)
+		if err != nil {
+			t.Fatalf("%v: %s", tc.local, err)
+		}
+		if !reflect.DeepEqual(ref.Licenses, tc.licenses) {
+			t.Errorf("%v: expected licenses %v, got %v", tc.local,
+				tc.licenses, ref.Licenses)
+		}
+		if !reflect.DeepEqual(ref.MissingLicenseFiles, tc.missing) {
+			t.Errorf("%v: expected missing %v, got %v", tc.local,
+				tc.missing, ref.MissingLicenseFiles)
+		}
+	}
+}
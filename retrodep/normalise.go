@@ -0,0 +1,392 @@
+// Copyright (C) 2019 Tim Waugh
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package retrodep
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Normalisation is a set of changes which may be made to the content
+// of both the local and upstream copies of a file, when they do not
+// match exactly, before comparing them again. Downstream packagers
+// sometimes make such changes, for example converting line endings.
+type Normalisation uint
+
+const (
+	// NormaliseLineEndings converts CRLF line endings to LF.
+	NormaliseLineEndings Normalisation = 1 << iota
+
+	// NormaliseTrailingSpace removes spaces and tabs from the
+	// ends of lines.
+	NormaliseTrailingSpace
+)
+
+// normalisations holds the name and description of each
+// Normalisation.
+var normalisations = []struct {
+	n                 Normalisation
+	name, description string
+}{
+	{NormaliseLineEndings, "eol", "line endings"},
+	{NormaliseTrailingSpace, "trailing-space", "trailing whitespace"},
+}
+
+// NormalisationNames returns the names accepted by
+// ParseNormalisation.
+func NormalisationNames() []string {
+	names := make([]string, 0, len(normalisations))
+	for _, norm := range normalisations {
+		names = append(names, norm.name)
+	}
+	return names
+}
+
+// ParseNormalisation parses a comma-separated list of normalisation
+// names, as returned by NormalisationNames.
+func ParseNormalisation(s string) (Normalisation, error) {
+	var n Normalisation
+	if s == "" {
+		return n, nil
+	}
+	for _, name := range strings.Split(s, ",") {
+		found := false
+		for _, norm := range normalisations {
+			if norm.name == strings.TrimSpace(name) {
+				n |= norm.n
+				found = true
+				break
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("unknown normalisation %q", name)
+		}
+	}
+	return n, nil
+}
+
+// Descriptions returns descriptions, such as "line endings", of the
+// normalisations in n.
+func (n Normalisation) Descriptions() []string {
+	var descriptions []string
+	for _, norm := range normalisations {
+		if n&norm.n != 0 {
+			descriptions = append(descriptions, norm.description)
+		}
+	}
+	return descriptions
+}
+
+// apply returns content after making the changes in n, along with
+// the normalisations which changed it.
+func (n Normalisation) apply(content []byte) ([]byte, Normalisation) {
+	var changed Normalisation
+	if n&NormaliseLineEndings != 0 {
+		normalised := normaliseEOL(content)
+		if len(normalised) != len(content) {
+			changed |= NormaliseLineEndings
+		}
+		content = normalised
+	}
+	if n&NormaliseTrailingSpace != 0 {
+		normalised := stripTrailingSpace(content)
+		if len(normalised) != len(content) {
+			changed |= NormaliseTrailingSpace
+		}
+		content = normalised
+	}
+	return content, changed
+}
+
+// stripTrailingSpace returns content with spaces and tabs removed
+// from the ends of lines, whether they end with LF or CRLF.
+func stripTrailingSpace(content []byte) []byte {
+	lines := bytes.SplitAfter(content, []byte("\n"))
+	var b bytes.Buffer
+	b.Grow(len(content))
+	for _, line := range lines {
+		ending := len(line)
+		switch {
+		case bytes.HasSuffix(line, []byte("\r\n")):
+			ending -= 2
+		case bytes.HasSuffix(line, []byte("\n")):
+			ending--
+		}
+		b.Write(bytes.TrimRight(line[:ending], " \t"))
+		b.Write(line[ending:])
+	}
+	return b.Bytes()
+}
+
+// hashBytes returns the file hash for content, hashed as though it
+// were in the repository as filename relativePath.
+func hashBytes(h Hasher, relativePath string, content []byte) (FileHash, error) {
+	if ch, ok := h.(contentHasher); ok {
+		return ch.hashContent(relativePath, bytes.NewReader(content))
+	}
+
+	// Write the content out to a file
+	f, err := ioutil.TempFile("", "retrodep-normalise.")
+	if err != nil {
+		return FileHash(""), errors.Wrap(err, "hashing content")
+	}
+
+	// Remove the new file after we've hashed it
+	defer os.Remove(f.Name())
+
+	_, err = f.Write(content)
+	if err != nil {
+		f.Close() // ignore any secondary error
+		return FileHash(""), errors.Wrap(err, "hashing content")
+	}
+	if err = f.Close(); err != nil {
+		return FileHash(""), errors.Wrap(err, "hashing content")
+	}
+
+	return h.Hash(relativePath, f.Name())
+}
+
+// normalisedHash is the hash of a file after normalisation.
+type normalisedHash struct {
+	hash FileHash
+
+	// changed holds the normalisations which changed the content.
+	changed Normalisation
+}
+
+// normalisedMatch compares local files with upstream files which do
+// not match exactly, after changing the upstream files using
+// normalisers and applying normalisations to both.
+type normalisedMatch struct {
+	modes       Normalisation
+	normalisers []Normaliser
+
+	// hasher is used for hashing local files.
+	hasher Hasher
+
+	// dir holds the local files, whose hashes are in hashes.
+	dir    string
+	hashes FileHashes
+
+	// local caches the normalised hashes of local files.
+	local map[string]normalisedHash
+
+	// used maps refs which matched to descriptions of the changes
+	// needed for them to match.
+	used map[string][]string
+}
+
+// newNormalisedMatch returns a *normalisedMatch for the local files
+// in dir, with hashes, or nil if there are no modes or normalisers.
+func newNormalisedMatch(modes Normalisation, normalisers []Normaliser, hasher Hasher, dir string, hashes FileHashes) *normalisedMatch {
+	if modes == 0 && len(normalisers) == 0 {
+		return nil
+	}
+	return &normalisedMatch{
+		modes:       modes,
+		normalisers: normalisers,
+		hasher:      hasher,
+		dir:         dir,
+		hashes:      hashes,
+		local:       make(map[string]normalisedHash),
+		used:        make(map[string][]string),
+	}
+}
+
+// localHash returns the normalised hash of the local file path.
+func (m *normalisedMatch) localHash(path string) (normalisedHash, error) {
+	if nh, ok := m.local[path]; ok {
+		return nh, nil
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(m.dir, path))
+	if err != nil {
+		return normalisedHash{}, err
+	}
+	nh := normalisedHash{hash: m.hashes[path]}
+	content, nh.changed = m.modes.apply(content)
+	if nh.changed != 0 {
+		nh.hash, err = hashBytes(m.hasher, path, content)
+		if err != nil {
+			return normalisedHash{}, err
+		}
+	}
+	m.local[path] = nh
+	return nh, nil
+}
+
+// upstream returns content, from the upstream file path, changed by
+// the normalisers and then the normalisations. It also returns false
+// if a normaliser leaves the file out, the normalisations which
+// changed the content, and the normalisers which either changed the
+// content or left it out.
+func (m *normalisedMatch) upstream(path string, content []byte) ([]byte, bool, Normalisation, []Normaliser) {
+	content, keep, used := normalise(m.normalisers, path, content)
+	if !keep {
+		return nil, false, 0, used
+	}
+	content, changed := m.modes.apply(content)
+	return content, true, changed, used
+}
+
+// match returns true if, after normalisation, the local files match
+// the upstream files at ref, whose hashes are in th and which are
+// relative to subPath.
+func (m *normalisedMatch) match(th FileHashes, wt WorkingTree, ref, subPath string) (bool, error) {
+	missing := m.hashes.MissingFromPackages(th)
+	if missing != nil && len(m.normalisers) == 0 {
+		// Only normalisers can leave files out
+		return false, nil
+	}
+	mismatches := m.hashes.Mismatches(th, false)
+	for _, path := range mismatches {
+		if _, ok := th[path]; !ok {
+			// File missing from revision
+			return false, nil
+		}
+	}
+
+	// Update working tree to match the ref
+	err := wt.RevSync(ref)
+	if err != nil {
+		return false, errors.Wrapf(err, "RevSync to %s", ref)
+	}
+
+	var modes Normalisation
+	usedNormalisers := make(map[Normaliser]struct{})
+	for _, path := range missing {
+		content, err := wt.ReadFile(filepath.Join(subPath, path))
+		if err != nil {
+			return false, err
+		}
+		_, keep, _, used := m.upstream(path, content)
+		if keep {
+			log.Debugf("%s: missing from package", path)
+			return false, nil
+		}
+		for _, n := range used {
+			usedNormalisers[n] = struct{}{}
+		}
+	}
+
+	for _, path := range mismatches {
+		local, err := m.localHash(path)
+		if err != nil {
+			return false, err
+		}
+
+		upstreamPath := filepath.Join(subPath, path)
+		content, err := wt.ReadFile(upstreamPath)
+		if err != nil {
+			return false, err
+		}
+		content, keep, changed, used := m.upstream(path, content)
+		if !keep {
+			log.Debugf("%s: not expected to be vendored", path)
+			return false, nil
+		}
+
+		hash := th[path]
+		if changed != 0 || len(used) > 0 {
+			hash, err = hashBytes(wt, upstreamPath, content)
+			if err != nil {
+				return false, err
+			}
+		}
+		if hash != local.hash {
+			log.Debugf("%s: hash mismatch after normalisation", path)
+			return false, nil
+		}
+		modes |= local.changed | changed
+		for _, n := range used {
+			usedNormalisers[n] = struct{}{}
+		}
+	}
+
+	descriptions := modes.Descriptions()
+	for _, n := range m.normalisers {
+		if _, ok := usedNormalisers[n]; ok {
+			descriptions = append(descriptions, n.Name())
+		}
+	}
+	m.used[ref] = descriptions
+	return true, nil
+}
+
+// descriptions returns descriptions of the changes needed for ref to
+// match, if any.
+func (m *normalisedMatch) descriptions(ref string) []string {
+	if m == nil {
+		return nil
+	}
+	return m.used[ref]
+}
+
+// normalise returns content, from the upstream file path, changed by
+// each of the normalisers in turn. It also returns false if one of
+// them leaves the file out, and the normalisers which either changed
+// the content or left it out.
+func normalise(normalisers []Normaliser, path string, content []byte) ([]byte, bool, []Normaliser) {
+	var used []Normaliser
+	for _, n := range normalisers {
+		normalised, keep := n.Normalise(path, content)
+		if !keep {
+			return nil, false, append(used, n)
+		}
+		if !bytes.Equal(normalised, content) {
+			used = append(used, n)
+		}
+		content = normalised
+	}
+	return content, true, used
+}
+
+// updateHashesAfterNormalise syncs the tree to tag or revision ref
+// and recalculates the hashes of the files in paths, which are
+// relative to subPath, after changing them using the normalisers.
+// Files which the normalisers leave out are removed from hashes.
+func updateHashesAfterNormalise(hashes FileHashes, wt WorkingTree, ref, subPath string, paths []string, normalisers []Normaliser) error {
+	// Update working tree to match the ref
+	err := wt.RevSync(ref)
+	if err != nil {
+		return errors.Wrapf(err, "RevSync to %s", ref)
+	}
+
+	for _, path := range paths {
+		upstreamPath := filepath.Join(subPath, path)
+		content, err := wt.ReadFile(upstreamPath)
+		if err != nil {
+			return err
+		}
+		content, keep, used := normalise(normalisers, path, content)
+		switch {
+		case !keep:
+			delete(hashes, path)
+		case len(used) > 0:
+			hashes[path], err = hashBytes(wt, upstreamPath, content)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+// Copyright (C) 2019 Tim Waugh
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package retrodep
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/tools/go/vcs"
+)
+
+func TestParseNormalisation(t *testing.T) {
+	tcs := []struct {
+		s        string
+		expected Normalisation
+		errors   bool
+	}{
+		{"", 0, false},
+		{"eol", NormaliseLineEndings, false},
+		{"eol,trailing-space", NormaliseLineEndings | NormaliseTrailingSpace, false},
+		{"eol,unknown", 0, true},
+	}
+
+	for _, tc := range tcs {
+		n, err := ParseNormalisation(tc.s)
+		if (err != nil) != tc.errors {
+			t.Errorf("%q: unexpected error result: %v", tc.s, err)
+			continue
+		}
+		if n != tc.expected {
+			t.Errorf("%q: expected %v, got %v", tc.s, tc.expected, n)
+		}
+	}
+}
+
+func TestNormalisationApply(t *testing.T) {
+	all := NormaliseLineEndings | NormaliseTrailingSpace
+	tcs := []struct {
+		modes    Normalisation
+		content  string
+		expected string
+		changed  Normalisation
+	}{
+		{all, "a\nb\n", "a\nb\n", 0},
+		{all, "a\r\nb\r\n", "a\nb\n", NormaliseLineEndings},
+		{all, "a \nb\t\n", "a\nb\n", NormaliseTrailingSpace},
+		{all, "a \r\nb", "a\nb", all},
+		{NormaliseTrailingSpace, "a \r\nb \t", "a\r\nb", NormaliseTrailingSpace},
+		{NormaliseLineEndings, "a \r\n", "a \n", NormaliseLineEndings},
+	}
+
+	for _, tc := range tcs {
+		content, changed := tc.modes.apply([]byte(tc.content))
+		if string(content) != tc.expected {
+			t.Errorf("%q: expected %q, got %q", tc.content,
+				tc.expected, string(content))
+		}
+		if changed != tc.changed {
+			t.Errorf("%q: expected changed=%v, got %v", tc.content,
+				tc.changed, changed)
+		}
+	}
+}
+
+// mockNormaliseWorkingTree has a single tag, v1.0.0, whose files have
+// the contents in upstream.
+type mockNormaliseWorkingTree struct {
+	stubWorkingTree
+
+	upstream map[string]string
+}
+
+func (wt *mockNormaliseWorkingTree) VersionTags() ([]string, error) {
+	return []string{matchVersion}, nil
+}
+
+func (wt *mockNormaliseWorkingTree) RevisionFromTag(tag string) (string, error) {
+	return matchRevision, nil
+}
+
+func (wt *mockNormaliseWorkingTree) FileHashesFromRef(ref, _ string) (FileHashes, error) {
+	hashes := make(FileHashes)
+	if ref != matchVersion && ref != matchRevision {
+		return hashes, nil
+	}
+	for path, content := range wt.upstream {
+		h, err := wt.hashContent(path, strings.NewReader(content))
+		if err != nil {
+			return nil, err
+		}
+		hashes[path] = h
+	}
+	return hashes, nil
+}
+
+func (wt *mockNormaliseWorkingTree) ReadFile(path string) ([]byte, error) {
+	return []byte(wt.upstream[path]), nil
+}
+
+func TestDescribeProjectNormalise(t *testing.T) {
+	dir, err := ioutil.TempDir("", "retrodep-test.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	local := map[string]string{
+		"a.go": "package a \r\n",
+		"b.go": "package a\n",
+	}
+	for path, content := range local {
+		err = ioutil.WriteFile(filepath.Join(dir, path), []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	wt := &mockNormaliseWorkingTree{
+		upstream: map[string]string{
+			"a.go": "package a\n",
+			"b.go": "package a\n",
+		},
+	}
+	wt.hasher = &sha256Hasher{}
+	project := &RepoPath{RepoRoot: vcs.RepoRoot{Root: "example.com/a"}}
+
+	tcs := []struct {
+		modes      Normalisation
+		normalised []string
+		err        error
+	}{
+		{0, nil, ErrorVersionNotFound},
+		{NormaliseLineEndings, nil, ErrorVersionNotFound},
+		{
+			modes:      NormaliseLineEndings | NormaliseTrailingSpace,
+			normalised: []string{"line endings", "trailing whitespace"},
+		},
+	}
+
+	for _, tc := range tcs {
+		src, err := NewGoSource(dir, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		src.Normalise = tc.modes
+
+		ref, err := src.describeProject(context.Background(),
+			project, wt, dir, nil)
+		if err != tc.err {
+			t.Errorf("%v: expected error %v, got %v", tc.modes,
+				tc.err, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if ref.Ver != matchVersion {
+			t.Errorf("%v: expected %s, got %s", tc.modes,
+				matchVersion, ref.Ver)
+		}
+		if !reflect.DeepEqual(ref.Normalised, tc.normalised) {
+			t.Errorf("%v: expected %v, got %v", tc.modes,
+				tc.normalised, ref.Normalised)
+		}
+	}
+}
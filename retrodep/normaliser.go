@@ -0,0 +1,406 @@
+// Copyright (C) 2019 Tim Waugh
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package retrodep
+
+import (
+	"bytes"
+	"encoding/json"
+	"go/scanner"
+	"go/token"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// A Normaliser changes the content of upstream files in the same way
+// a vendoring tool does when copying them, so that they can be
+// compared with vendored copies.
+type Normaliser interface {
+	// Name describes the change made, for example "godep import
+	// comments".
+	Name() string
+
+	// Normalise returns content, from the upstream file path
+	// relative to the top-level of the vendored copy, changed in
+	// the same way as the vendoring tool. It returns false if the
+	// tool leaves the file out of vendored copies.
+	Normalise(path string, content []byte) ([]byte, bool)
+}
+
+// importCommentNormaliser removes import comments, as godep does.
+type importCommentNormaliser struct{}
+
+// Name implements the Normaliser interface.
+func (importCommentNormaliser) Name() string {
+	return "godep import comments"
+}
+
+// Normalise implements the Normaliser interface.
+func (importCommentNormaliser) Normalise(path string, content []byte) ([]byte, bool) {
+	if !strings.HasSuffix(path, ".go") {
+		return content, true
+	}
+	content, _ = stripImportComment(content)
+	return content, true
+}
+
+// importRewriter rewrites import paths in Go source files.
+type importRewriter struct {
+	name string
+
+	// rewrites maps import path prefixes to their replacements.
+	rewrites map[string]string
+}
+
+// Name implements the Normaliser interface.
+func (r *importRewriter) Name() string {
+	return r.name
+}
+
+// rewrite returns the replacement for the import path, and whether
+// there is one.
+func (r *importRewriter) rewrite(importPath string) (string, bool) {
+	for p := importPath; p != "." && p != "/"; p = path.Dir(p) {
+		if repl, ok := r.rewrites[p]; ok {
+			return repl + importPath[len(p):], true
+		}
+	}
+	return "", false
+}
+
+// Normalise implements the Normaliser interface.
+func (r *importRewriter) Normalise(path string, content []byte) ([]byte, bool) {
+	if !strings.HasSuffix(path, ".go") {
+		return content, true
+	}
+
+	// Find the import paths, which are the string literals in
+	// import declarations. These come before any other
+	// declarations.
+	type span struct {
+		offset, end int
+		repl        string
+	}
+	var spans []span
+	var s scanner.Scanner
+	fset := token.NewFileSet()
+	file := fset.AddFile(path, fset.Base(), len(content))
+	s.Init(file, content, nil, 0)
+	inImport, inGroup := false, false
+scan:
+	for {
+		pos, tok, lit := s.Scan()
+		switch tok {
+		case token.EOF, token.FUNC, token.TYPE, token.VAR, token.CONST:
+			break scan
+		case token.IMPORT:
+			inImport = true
+		case token.LPAREN:
+			inGroup = inImport
+		case token.RPAREN:
+			inImport, inGroup = false, false
+		case token.SEMICOLON:
+			if !inGroup {
+				inImport = false
+			}
+		case token.STRING:
+			if !inImport {
+				continue
+			}
+			importPath, err := strconv.Unquote(lit)
+			if err != nil {
+				continue
+			}
+			if repl, ok := r.rewrite(importPath); ok {
+				offset := file.Offset(pos)
+				spans = append(spans, span{
+					offset: offset,
+					end:    offset + len(lit),
+					repl:   strconv.Quote(repl),
+				})
+			}
+		}
+	}
+	if spans == nil {
+		return content, true
+	}
+
+	var b bytes.Buffer
+	last := 0
+	for _, sp := range spans {
+		b.Write(content[last:sp.offset])
+		b.WriteString(sp.repl)
+		last = sp.end
+	}
+	b.Write(content[last:])
+	return b.Bytes(), true
+}
+
+// buildTagNormaliser leaves out Go source files with build
+// constraints naming any of its tags.
+type buildTagNormaliser struct {
+	name string
+	tags map[string]struct{}
+}
+
+// Name implements the Normaliser interface.
+func (n *buildTagNormaliser) Name() string {
+	return n.name
+}
+
+// Normalise implements the Normaliser interface.
+func (n *buildTagNormaliser) Normalise(path string, content []byte) ([]byte, bool) {
+	if !strings.HasSuffix(path, ".go") {
+		return content, true
+	}
+	if _, ok := n.tags["test"]; ok && strings.HasSuffix(path, "_test.go") {
+		return content, false
+	}
+	for _, tag := range buildTags(content) {
+		if _, ok := n.tags[tag]; ok {
+			return content, false
+		}
+	}
+	return content, true
+}
+
+// buildTags returns the tags named, other than negated ones, in the
+// build constraints of Go source content.
+func buildTags(content []byte) []string {
+	var tags []string
+	for _, line := range bytes.Split(content, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		var expr string
+		switch {
+		case len(line) == 0:
+			continue
+		case bytes.HasPrefix(line, []byte("// +build ")):
+			expr = string(line[len("// +build "):])
+		case bytes.HasPrefix(line, []byte("//go:build ")):
+			expr = string(line[len("//go:build "):])
+		case bytes.HasPrefix(line, []byte("//")):
+			continue
+		default:
+			// Build constraints must come before the
+			// package clause.
+			return tags
+		}
+
+		fields := strings.FieldsFunc(expr, func(r rune) bool {
+			return strings.ContainsRune(" ,&|()", r)
+		})
+		for _, field := range fields {
+			if !strings.HasPrefix(field, "!") {
+				tags = append(tags, field)
+			}
+		}
+	}
+	return tags
+}
+
+// normalisersFor returns the normalisers to apply to upstream files
+// when comparing them with the files in dir. Files in the top-level
+// project are not changed by vendoring tools.
+func (src GoSource) normalisersFor(dir string) []Normaliser {
+	if dir == src.Path {
+		return nil
+	}
+	return src.Normalisers
+}
+
+// findNormalisers sets src.Normalisers according to the manifests of
+// the vendoring tools in use.
+func findNormalisers(src *GoSource) error {
+	src.Normalisers = nil
+	if src.usesGodep {
+		src.Normalisers = append(src.Normalisers, importCommentNormaliser{})
+		if err := findGodepWorkspaceNormaliser(src); err != nil {
+			return err
+		}
+	}
+	if err := findGovendorNormalisers(src); err != nil {
+		return err
+	}
+	return findGvtNormaliser(src)
+}
+
+// decodeManifest decodes the JSON file at path, within src.Path, into
+// v. It returns false if the file is missing or excluded.
+func decodeManifest(src *GoSource, path string, v interface{}) (bool, error) {
+	if src.isExcluded(path, false) {
+		return false, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	defer f.Close()
+
+	if err := json.NewDecoder(f).Decode(v); err != nil {
+		return false, errors.Wrapf(err, "decoding %s", path)
+	}
+	return true, nil
+}
+
+// newImportRewriter returns a Normaliser for the rewrites, or nil if
+// there are none.
+func newImportRewriter(name string, rewrites map[string]string) Normaliser {
+	if len(rewrites) == 0 {
+		return nil
+	}
+	var paths []string
+	for from, to := range rewrites {
+		paths = append(paths, from+" -> "+to)
+	}
+	sort.Strings(paths)
+	log.Debugf("%s: %s", name, strings.Join(paths, ", "))
+	return &importRewriter{name: name, rewrites: rewrites}
+}
+
+// findGodepWorkspaceNormaliser adds a Normaliser for 'godep save -r',
+// which rewrites imports of vendored packages to refer to their
+// copies in Godeps/_workspace.
+func findGodepWorkspaceNormaliser(src *GoSource) error {
+	workspace := filepath.Join(src.Path, "Godeps", "_workspace", "src")
+	if _, err := os.Stat(workspace); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	var godeps struct {
+		ImportPath string
+		Deps       []struct {
+			ImportPath string
+		}
+	}
+	conf := filepath.Join(src.Path, "Godeps", "Godeps.json")
+	if _, err := decodeManifest(src, conf, &godeps); err != nil {
+		return err
+	}
+
+	rewrites := make(map[string]string)
+	for _, dep := range godeps.Deps {
+		rewrites[dep.ImportPath] = path.Join(godeps.ImportPath,
+			"Godeps", "_workspace", "src", dep.ImportPath)
+	}
+	if n := newImportRewriter("godep import rewriting", rewrites); n != nil {
+		src.Normalisers = append(src.Normalisers, n)
+	}
+	return nil
+}
+
+// findGovendorNormalisers adds Normalisers for govendor, which
+// rewrites imports of packages copied from a different origin, and
+// leaves out files with the build tags it is told to ignore.
+func findGovendorNormalisers(src *GoSource) error {
+	var manifest struct {
+		Ignore  string
+		Package []struct {
+			Path   string
+			Origin string
+		}
+	}
+	conf := filepath.Join(src.Path, "vendor", "vendor.json")
+	found, err := decodeManifest(src, conf, &manifest)
+	if err != nil || !found {
+		return err
+	}
+
+	rewrites := make(map[string]string)
+	for _, pkg := range manifest.Package {
+		if pkg.Origin != "" && pkg.Origin != pkg.Path {
+			rewrites[pkg.Origin] = pkg.Path
+		}
+	}
+	if n := newImportRewriter("govendor import rewriting", rewrites); n != nil {
+		src.Normalisers = append(src.Normalisers, n)
+	}
+
+	// The ignore setting holds build tags, and import path
+	// prefixes which contain a slash.
+	tags := make(map[string]struct{})
+	for _, tag := range strings.Fields(manifest.Ignore) {
+		if !strings.Contains(tag, "/") {
+			tags[tag] = struct{}{}
+		}
+	}
+	if len(tags) > 0 {
+		src.Normalisers = append(src.Normalisers, &buildTagNormaliser{
+			name: "govendor ignored build tags",
+			tags: tags,
+		})
+	}
+	return nil
+}
+
+// findGvtNormaliser adds a Normaliser for gvt, which rewrites
+// imports of packages fetched from a repository whose import path
+// differs from the one they are vendored as.
+func findGvtNormaliser(src *GoSource) error {
+	var manifest struct {
+		Dependencies []struct {
+			ImportPath string
+			Repository string
+			Path       string
+		}
+	}
+	conf := filepath.Join(src.Path, "vendor", "manifest")
+	found, err := decodeManifest(src, conf, &manifest)
+	if err != nil || !found {
+		return err
+	}
+
+	rewrites := make(map[string]string)
+	for _, dep := range manifest.Dependencies {
+		origin := importPathFromRepository(dep.Repository)
+		if origin == "" {
+			continue
+		}
+		origin = path.Join(origin, dep.Path)
+		if origin != dep.ImportPath {
+			rewrites[origin] = dep.ImportPath
+		}
+	}
+	if n := newImportRewriter("gvt import rewriting", rewrites); n != nil {
+		src.Normalisers = append(src.Normalisers, n)
+	}
+	return nil
+}
+
+// importPathFromRepository returns the import path implied by a
+// repository URL, such as "github.com/foo/bar" for
+// "https://github.com/foo/bar.git", or "" if there is none.
+func importPathFromRepository(repo string) string {
+	scheme := strings.Index(repo, "://")
+	if scheme == -1 {
+		return ""
+	}
+	p := strings.TrimSuffix(repo[scheme+len("://"):], ".git")
+	if at := strings.Index(p, "@"); at != -1 {
+		p = p[at+1:]
+	}
+	return strings.TrimSuffix(p, "/")
+}
@@ -0,0 +1,262 @@
+// Copyright (C) 2019 Tim Waugh
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package retrodep
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"golang.org/x/tools/go/vcs"
+)
+
+func TestImportRewriter(t *testing.T) {
+	r := &importRewriter{
+		name: "rewrite",
+		rewrites: map[string]string{
+			"github.com/foo/bar": "example.com/vendored/bar",
+		},
+	}
+
+	tcs := []struct {
+		path, content, expected string
+	}{
+		{
+			"a.go",
+			"package a\n\nimport \"github.com/foo/bar\"\n",
+			"package a\n\nimport \"example.com/vendored/bar\"\n",
+		},
+		{
+			"a.go",
+			"package a\n\nimport (\n\t\"fmt\"\n\tb \"github.com/foo/bar/sub\"\n)\n\nvar s = \"github.com/foo/bar\"\n",
+			"package a\n\nimport (\n\t\"fmt\"\n\tb \"example.com/vendored/bar/sub\"\n)\n\nvar s = \"github.com/foo/bar\"\n",
+		},
+		{
+			// Only whole path elements match
+			"a.go",
+			"package a\n\nimport \"github.com/foo/barbaz\"\n",
+			"package a\n\nimport \"github.com/foo/barbaz\"\n",
+		},
+		{
+			// Only Go source is rewritten
+			"a.txt",
+			"import \"github.com/foo/bar\"\n",
+			"import \"github.com/foo/bar\"\n",
+		},
+	}
+
+	for _, tc := range tcs {
+		content, keep := r.Normalise(tc.path, []byte(tc.content))
+		if !keep {
+			t.Errorf("%q: not kept", tc.content)
+			continue
+		}
+		if string(content) != tc.expected {
+			t.Errorf("%q: expected %q, got %q", tc.content,
+				tc.expected, string(content))
+		}
+	}
+}
+
+func TestBuildTagNormaliser(t *testing.T) {
+	n := &buildTagNormaliser{
+		name: "tags",
+		tags: map[string]struct{}{"test": {}, "ignore": {}},
+	}
+
+	tcs := []struct {
+		path, content string
+		keep          bool
+	}{
+		{"a.go", "package a\n", true},
+		{"a_test.go", "package a\n", false},
+		{"a.go", "// +build ignore\n\npackage main\n", false},
+		{"a.go", "//go:build linux && ignore\n\npackage a\n", false},
+		{"a.go", "// +build !ignore\n\npackage a\n", true},
+		{"a.go", "// +build linux\n\npackage a\n", true},
+		{"a.go", "package a\n\n// +build ignore\n", true},
+		{"a.txt", "// +build ignore\n", true},
+	}
+
+	for _, tc := range tcs {
+		_, keep := n.Normalise(tc.path, []byte(tc.content))
+		if keep != tc.keep {
+			t.Errorf("%s %q: expected keep=%v", tc.path,
+				tc.content, tc.keep)
+		}
+	}
+}
+
+func TestImportCommentNormaliser(t *testing.T) {
+	var n importCommentNormaliser
+	content, keep := n.Normalise("a.go",
+		[]byte("package a // import \"example.com/a\"\n"))
+	if !keep {
+		t.Fatal("not kept")
+	}
+	if string(content) != "package a\n" {
+		t.Errorf("import comment not stripped: %q", string(content))
+	}
+}
+
+func TestFindNormalisers(t *testing.T) {
+	tcs := []struct {
+		dir      string
+		expected []Normaliser
+	}{
+		{"testdata/gosource", nil},
+		{
+			"testdata/godep",
+			[]Normaliser{importCommentNormaliser{}},
+		},
+		{
+			"testdata/godepworkspace",
+			[]Normaliser{
+				importCommentNormaliser{},
+				&importRewriter{
+					name: "godep import rewriting",
+					rewrites: map[string]string{
+						"github.com/foo/bar": "example.com/godepworkspace/Godeps/_workspace/src/github.com/foo/bar",
+					},
+				},
+			},
+		},
+		{
+			"testdata/govendor",
+			[]Normaliser{
+				&importRewriter{
+					name: "govendor import rewriting",
+					rewrites: map[string]string{
+						"github.com/fork/baz/vendor/github.com/foo/baz": "github.com/foo/baz",
+					},
+				},
+				&buildTagNormaliser{
+					name: "govendor ignored build tags",
+					tags: map[string]struct{}{
+						"test":      {},
+						"appengine": {},
+					},
+				},
+			},
+		},
+		{
+			"testdata/gvt",
+			[]Normaliser{
+				&importRewriter{
+					name: "gvt import rewriting",
+					rewrites: map[string]string{
+						"github.com/foo/baz": "gopkg.in/foo/baz.v1",
+					},
+				},
+			},
+		},
+	}
+
+	for _, tc := range tcs {
+		src, err := NewGoSource(tc.dir, nil)
+		if err != nil {
+			t.Errorf("%s: %s", tc.dir, err)
+			continue
+		}
+		if !reflect.DeepEqual(src.Normalisers, tc.expected) {
+			t.Errorf("%s: expected %#v, got %#v", tc.dir,
+				tc.expected, src.Normalisers)
+		}
+		if src.normalisersFor(src.Path) != nil {
+			t.Errorf("%s: normalisers used for top-level", tc.dir)
+		}
+	}
+}
+
+func TestDescribeProjectNormaliser(t *testing.T) {
+	dir, err := ioutil.TempDir("", "retrodep-test.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	err = ioutil.WriteFile(filepath.Join(dir, "a.go"),
+		[]byte("package a\n\nimport \"example.com/vendored/b\"\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wt := &mockNormaliseWorkingTree{
+		upstream: map[string]string{
+			"a.go":   "package a\n\nimport \"github.com/foo/b\"\n",
+			"gen.go": "// +build ignore\n\npackage main\n",
+		},
+	}
+	wt.hasher = &sha256Hasher{}
+	project := &RepoPath{RepoRoot: vcs.RepoRoot{Root: "example.com/a"}}
+	rewriter := &importRewriter{
+		name: "import rewriting",
+		rewrites: map[string]string{
+			"github.com/foo/b": "example.com/vendored/b",
+		},
+	}
+	dropIgnored := &buildTagNormaliser{
+		name: "ignored build tags",
+		tags: map[string]struct{}{"ignore": {}},
+	}
+
+	tcs := []struct {
+		normalisers []Normaliser
+		normalised  []string
+		err         error
+	}{
+		{nil, nil, ErrorVersionNotFound},
+		{[]Normaliser{rewriter}, nil, ErrorVersionNotFound},
+		{
+			normalisers: []Normaliser{dropIgnored, rewriter},
+			normalised:  []string{"ignored build tags", "import rewriting"},
+		},
+	}
+
+	for _, tc := range tcs {
+		src, err := NewGoSource(dir, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		src.Normalisers = tc.normalisers
+
+		// Normalisers are not used for the top-level project
+		_, err = src.describeProject(context.Background(),
+			project, wt, dir, nil)
+		if tc.normalisers != nil && err != ErrorVersionNotFound {
+			t.Errorf("%v: top-level matched", tc.normalised)
+		}
+
+		src.Path = filepath.Dir(dir)
+		ref, err := src.describeProject(context.Background(),
+			project, wt, dir, nil)
+		if err != tc.err {
+			t.Errorf("%v: expected error %v, got %v",
+				tc.normalised, tc.err, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if !reflect.DeepEqual(ref.Normalised, tc.normalised) {
+			t.Errorf("expected %v, got %v", tc.normalised,
+				ref.Normalised)
+		}
+	}
+}
@@ -0,0 +1,645 @@
+// Copyright (C) 2019 Tim Waugh
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package retrodep
+
+// This file contains support for matching identified versions
+// against advisories in the OSV format, https://ossf.github.io/osv-schema/
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/Masterminds/semver"
+	"github.com/pkg/errors"
+)
+
+// Severity is the severity of an Advisory.
+type Severity int
+
+const (
+	// SeverityUnknown is the severity of advisories which do
+	// not give one.
+	SeverityUnknown Severity = iota
+
+	// SeverityLow is a CVSS score below 4.0.
+	SeverityLow
+
+	// SeverityMedium is a CVSS score from 4.0 to 6.9.
+	SeverityMedium
+
+	// SeverityHigh is a CVSS score from 7.0 to 8.9.
+	SeverityHigh
+
+	// SeverityCritical is a CVSS score of 9.0 or more.
+	SeverityCritical
+)
+
+// severities holds the name of each Severity. Other names used by
+// advisory databases are given in severityAliases.
+var severities = []struct {
+	s    Severity
+	name string
+}{
+	{SeverityLow, "low"},
+	{SeverityMedium, "medium"},
+	{SeverityHigh, "high"},
+	{SeverityCritical, "critical"},
+}
+
+var severityAliases = map[string]Severity{
+	"moderate":  SeverityMedium,
+	"important": SeverityHigh,
+}
+
+// SeverityNames returns the names accepted by ParseSeverity.
+func SeverityNames() []string {
+	names := make([]string, 0, len(severities))
+	for _, sev := range severities {
+		names = append(names, sev.name)
+	}
+	return names
+}
+
+// ParseSeverity parses a severity name, as returned by
+// SeverityNames.
+func ParseSeverity(s string) (Severity, error) {
+	for _, sev := range severities {
+		if sev.name == strings.TrimSpace(s) {
+			return sev.s, nil
+		}
+	}
+	return SeverityUnknown, fmt.Errorf("unknown severity %q", s)
+}
+
+// String returns the name of the severity.
+func (s Severity) String() string {
+	for _, sev := range severities {
+		if sev.s == s {
+			return sev.name
+		}
+	}
+	return "unknown"
+}
+
+// AtLeast returns true if s is no less severe than threshold.
+// Advisories of unknown severity, such as those in the Go
+// vulnerability database, meet any threshold so that they are not
+// overlooked.
+func (s Severity) AtLeast(threshold Severity) bool {
+	return s == SeverityUnknown || s >= threshold
+}
+
+// severityFromName returns the Severity named by s, in any case, or
+// SeverityUnknown.
+func severityFromName(s string) Severity {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if sev, ok := severityAliases[s]; ok {
+		return sev
+	}
+	sev, err := ParseSeverity(s)
+	if err != nil {
+		return SeverityUnknown
+	}
+	return sev
+}
+
+// severityFromScore returns the Severity of a CVSS score.
+func severityFromScore(score float64) Severity {
+	switch {
+	case score >= 9.0:
+		return SeverityCritical
+	case score >= 7.0:
+		return SeverityHigh
+	case score >= 4.0:
+		return SeverityMedium
+	}
+	return SeverityLow
+}
+
+// cvss3Weights holds the weight of each value of the CVSS v3 base
+// metrics. The weights for PR:L and PR:H are higher when S:C.
+var cvss3Weights = map[string]map[string]float64{
+	"AV": {"N": 0.85, "A": 0.62, "L": 0.55, "P": 0.2},
+	"AC": {"L": 0.77, "H": 0.44},
+	"PR": {"N": 0.85, "L": 0.62, "H": 0.27},
+	"UI": {"N": 0.85, "R": 0.62},
+	"C":  {"H": 0.56, "L": 0.22, "N": 0},
+	"I":  {"H": 0.56, "L": 0.22, "N": 0},
+	"A":  {"H": 0.56, "L": 0.22, "N": 0},
+}
+
+// cvss3Roundup rounds x up to one decimal place, as defined by CVSS
+// v3.1.
+func cvss3Roundup(x float64) float64 {
+	i := int(math.Round(x * 100000))
+	if i%10000 == 0 {
+		return float64(i) / 100000
+	}
+	return float64(i/10000+1) / 10
+}
+
+// cvss3BaseScore returns the base score of a CVSS v3 vector such as
+// "CVSS:3.1/AV:N/AC:L/PR:N/UI:N/S:U/C:H/I:H/A:H".
+func cvss3BaseScore(vector string) (float64, error) {
+	fields := strings.Split(vector, "/")
+	if !strings.HasPrefix(fields[0], "CVSS:3.") {
+		return 0, fmt.Errorf("not a CVSS v3 vector: %q", vector)
+	}
+	metrics := make(map[string]string)
+	for _, field := range fields[1:] {
+		kv := strings.SplitN(field, ":", 2)
+		if len(kv) != 2 {
+			return 0, fmt.Errorf("invalid CVSS v3 vector: %q", vector)
+		}
+		metrics[kv[0]] = kv[1]
+	}
+
+	changed := false
+	switch metrics["S"] {
+	case "U":
+	case "C":
+		changed = true
+	default:
+		return 0, fmt.Errorf("invalid CVSS v3 vector: %q", vector)
+	}
+	w := make(map[string]float64)
+	for metric, weights := range cvss3Weights {
+		weight, ok := weights[metrics[metric]]
+		if !ok {
+			return 0, fmt.Errorf("invalid CVSS v3 vector: %q", vector)
+		}
+		w[metric] = weight
+	}
+	if changed {
+		switch metrics["PR"] {
+		case "L":
+			w["PR"] = 0.68
+		case "H":
+			w["PR"] = 0.5
+		}
+	}
+
+	iss := 1 - (1-w["C"])*(1-w["I"])*(1-w["A"])
+	impact := 6.42 * iss
+	if changed {
+		impact = 7.52*(iss-0.029) - 3.25*math.Pow(iss-0.02, 15)
+	}
+	if impact <= 0 {
+		return 0, nil
+	}
+	exploitability := 8.22 * w["AV"] * w["AC"] * w["PR"] * w["UI"]
+	if changed {
+		return cvss3Roundup(math.Min(1.08*(impact+exploitability), 10)), nil
+	}
+	return cvss3Roundup(math.Min(impact+exploitability, 10)), nil
+}
+
+// osvEvent is an event in an OSV affected range. Exactly one field
+// is set.
+type osvEvent struct {
+	Introduced   string `json:"introduced"`
+	Fixed        string `json:"fixed"`
+	LastAffected string `json:"last_affected"`
+	Limit        string `json:"limit"`
+}
+
+// osvRange is an OSV affected range, of versions or of commits.
+type osvRange struct {
+	Type   string     `json:"type"`
+	Repo   string     `json:"repo"`
+	Events []osvEvent `json:"events"`
+}
+
+// osvSpecific holds the fields of database_specific and
+// ecosystem_specific objects used by retrodep.
+type osvSpecific struct {
+	Severity string `json:"severity"`
+}
+
+// osvAffected describes a package affected by an OSV advisory.
+type osvAffected struct {
+	Package struct {
+		Ecosystem string `json:"ecosystem"`
+		Name      string `json:"name"`
+	} `json:"package"`
+	Ranges            []osvRange   `json:"ranges"`
+	Versions          []string     `json:"versions"`
+	EcosystemSpecific *osvSpecific `json:"ecosystem_specific"`
+	DatabaseSpecific  *osvSpecific `json:"database_specific"`
+}
+
+// osvEntry is an advisory in the OSV format.
+type osvEntry struct {
+	ID        string   `json:"id"`
+	Aliases   []string `json:"aliases"`
+	Summary   string   `json:"summary"`
+	Withdrawn string   `json:"withdrawn"`
+	Severity  []struct {
+		Type  string `json:"type"`
+		Score string `json:"score"`
+	} `json:"severity"`
+	Affected         []osvAffected `json:"affected"`
+	DatabaseSpecific *osvSpecific  `json:"database_specific"`
+}
+
+// severity returns the severity of the advisory, from its CVSS v3
+// vector if it has one, and otherwise from the severity named by the
+// database.
+func (e *osvEntry) severity() Severity {
+	for _, s := range e.Severity {
+		if s.Type != "CVSS_V3" {
+			continue
+		}
+		score, err := cvss3BaseScore(s.Score)
+		if err != nil {
+			log.Debugf("%s: %s", e.ID, err)
+			continue
+		}
+		return severityFromScore(score)
+	}
+
+	specific := []*osvSpecific{e.DatabaseSpecific}
+	for _, affected := range e.Affected {
+		specific = append(specific, affected.DatabaseSpecific,
+			affected.EcosystemSpecific)
+	}
+	sev := SeverityUnknown
+	for _, s := range specific {
+		if s == nil {
+			continue
+		}
+		if named := severityFromName(s.Severity); named > sev {
+			sev = named
+		}
+	}
+	return sev
+}
+
+// An Advisory is a vulnerability report from an OSV database.
+type Advisory struct {
+	// ID is the identifier of the advisory, such as GO-2020-0001
+	// or GHSA-xxxx-xxxx-xxxx.
+	ID string
+
+	// Aliases holds other identifiers for the same
+	// vulnerability, such as CVE IDs.
+	Aliases []string
+
+	// Summary is a one-line description of the vulnerability.
+	Summary string
+
+	// Severity is the severity of the vulnerability.
+	Severity Severity
+
+	affected []osvAffected
+}
+
+// AdvisoryDB is a set of advisories loaded from an OSV database.
+type AdvisoryDB struct {
+	// byPackage maps Go module paths, without any major version
+	// suffix, to the advisories affecting them.
+	byPackage map[string][]*Advisory
+
+	// byRepo maps repository URLs, as normalised by
+	// normaliseRepoURL, to the advisories with commit ranges in
+	// them.
+	byRepo map[string][]*Advisory
+}
+
+// majorVersionSuffix matches the major version suffix of a Go module
+// path.
+var majorVersionSuffix = regexp.MustCompile(`/v[0-9]+$`)
+
+// normaliseRepoURL returns the repository URL u in a form which can
+// be compared with other URLs for the same repository: without the
+// scheme, user, trailing slash or .git suffix, and in lower case.
+func normaliseRepoURL(u string) string {
+	u = strings.ToLower(strings.TrimSpace(u))
+	if i := strings.Index(u, "://"); i != -1 {
+		u = u[i+3:]
+	} else if i := strings.Index(u, ":"); i != -1 {
+		// scp-like syntax, user@host:path
+		u = u[:i] + "/" + u[i+1:]
+	}
+	if i := strings.Index(u, "@"); i != -1 && i < strings.Index(u+"/", "/") {
+		u = u[i+1:]
+	}
+	u = strings.TrimSuffix(u, "/")
+	return strings.TrimSuffix(u, ".git")
+}
+
+// LoadAdvisories reads the advisories from an OSV database at path,
+// which is either a directory of JSON files (searched recursively)
+// or a zip file of them, as published by osv.dev. Withdrawn
+// advisories are ignored.
+func LoadAdvisories(path string) (*AdvisoryDB, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "LoadAdvisories")
+	}
+
+	db := &AdvisoryDB{
+		byPackage: make(map[string][]*Advisory),
+		byRepo:    make(map[string][]*Advisory),
+	}
+	if info.IsDir() {
+		err = filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() || filepath.Ext(p) != ".json" {
+				return nil
+			}
+			data, err := ioutil.ReadFile(p)
+			if err != nil {
+				return err
+			}
+			return db.add(p, data)
+		})
+	} else {
+		err = db.loadZip(path)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "LoadAdvisories(%s)", path)
+	}
+	return db, nil
+}
+
+// loadZip reads the advisories from a zip file of JSON files.
+func (db *AdvisoryDB) loadZip(path string) error {
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	for _, f := range r.File {
+		if f.FileInfo().IsDir() || filepath.Ext(f.Name) != ".json" {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		data, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+		if err := db.add(f.Name, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// add parses the advisory in data, read from name, and indexes it.
+func (db *AdvisoryDB) add(name string, data []byte) error {
+	var entry osvEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return errors.Wrap(err, name)
+	}
+	if entry.ID == "" || entry.Withdrawn != "" {
+		return nil
+	}
+
+	adv := &Advisory{
+		ID:       entry.ID,
+		Aliases:  entry.Aliases,
+		Summary:  entry.Summary,
+		Severity: entry.severity(),
+		affected: entry.Affected,
+	}
+	pkgs := make(map[string]struct{})
+	repos := make(map[string]struct{})
+	for _, affected := range entry.Affected {
+		if affected.Package.Ecosystem == "Go" {
+			name := majorVersionSuffix.ReplaceAllString(affected.Package.Name, "")
+			pkgs[name] = struct{}{}
+		}
+		for _, r := range affected.Ranges {
+			if r.Type == "GIT" && r.Repo != "" {
+				repos[normaliseRepoURL(r.Repo)] = struct{}{}
+			}
+		}
+	}
+	for pkg := range pkgs {
+		db.byPackage[pkg] = append(db.byPackage[pkg], adv)
+	}
+	for repo := range repos {
+		db.byRepo[repo] = append(db.byRepo[repo], adv)
+	}
+	return nil
+}
+
+// Match returns the advisories, sorted by ID, which affect the
+// project version described by ref. Versions are compared with the
+// semantic version ranges of the advisories' Go modules, and
+// revisions are compared with their commit ranges using the
+// project's working tree wt.
+func (db *AdvisoryDB) Match(ref *Reference, wt WorkingTree) ([]*Advisory, error) {
+	candidates := make(map[*Advisory]struct{})
+	for _, adv := range db.byPackage[ref.Pkg] {
+		candidates[adv] = struct{}{}
+	}
+	repo := normaliseRepoURL(ref.Repo)
+	if ref.Repo != "" {
+		for _, adv := range db.byRepo[repo] {
+			candidates[adv] = struct{}{}
+		}
+	}
+
+	var matched []*Advisory
+	for adv := range candidates {
+		affected, err := adv.affects(ref, repo, wt)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s: %s", ref.Pkg, adv.ID)
+		}
+		if affected {
+			log.Debugf("%s: affected by %s", ref.Pkg, adv.ID)
+			matched = append(matched, adv)
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool {
+		return matched[i].ID < matched[j].ID
+	})
+	return matched, nil
+}
+
+// affects returns true if the advisory affects the project version
+// described by ref, whose normalised repository URL is repo.
+func (adv *Advisory) affects(ref *Reference, repo string, wt WorkingTree) (bool, error) {
+	for _, affected := range adv.affected {
+		name := majorVersionSuffix.ReplaceAllString(affected.Package.Name, "")
+		isPkg := affected.Package.Ecosystem == "Go" && name == ref.Pkg
+		if isPkg && ref.Ver != "" {
+			for _, v := range affected.Versions {
+				if strings.TrimPrefix(v, "v") == strings.TrimPrefix(ref.Ver, "v") {
+					return true, nil
+				}
+			}
+		}
+
+		for _, r := range affected.Ranges {
+			switch {
+			case r.Type == "GIT":
+				if ref.Rev == "" || wt == nil ||
+					normaliseRepoURL(r.Repo) != repo {
+					continue
+				}
+				in, err := commitInRange(r.Events, ref.Rev, wt)
+				if err != nil || in {
+					return in, err
+				}
+			case isPkg && (r.Type == "SEMVER" || r.Type == "ECOSYSTEM"):
+				if versionInRange(r.Events, ref.Ver) {
+					return true, nil
+				}
+			}
+		}
+	}
+	return false, nil
+}
+
+// versionInRange returns true if the semantic version ver, which may
+// be a pseudo-version, is within the range given by events.
+func versionInRange(events []osvEvent, ver string) bool {
+	v, err := semver.NewVersion(ver)
+	if err != nil {
+		return false
+	}
+
+	// Each event applies to the versions from its own onwards, so
+	// the latest event no later than v decides.
+	type versionEvent struct {
+		v        *semver.Version
+		affected bool
+
+		// lastAffected is true if v itself is still affected.
+		lastAffected bool
+	}
+	var sorted []versionEvent
+	for _, e := range events {
+		var ev versionEvent
+		var s string
+		switch {
+		case e.Introduced != "":
+			s, ev.affected = e.Introduced, true
+		case e.Fixed != "":
+			s = e.Fixed
+		case e.LastAffected != "":
+			s = e.LastAffected
+			ev.lastAffected = true
+		case e.Limit != "":
+			s = e.Limit
+		default:
+			continue
+		}
+		if s == "0" {
+			s = "0.0.0-0"
+		}
+		ev.v, err = semver.NewVersion(s)
+		if err != nil {
+			log.Debugf("ignoring event for version %q: %s", s, err)
+			continue
+		}
+		sorted = append(sorted, ev)
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].v.LessThan(sorted[j].v)
+	})
+
+	affected := false
+	for _, ev := range sorted {
+		cmp := ev.v.Compare(v)
+		if cmp < 0 || (cmp == 0 && !ev.lastAffected) {
+			affected = ev.affected
+		}
+	}
+	return affected
+}
+
+// commitInRange returns true if the revision rev is within the range
+// of commits given by events: descended from an introduced commit,
+// but not from a fixed or limit commit, nor strictly from a
+// last_affected commit. Commits unknown to wt are ignored.
+func commitInRange(events []osvEvent, rev string, wt WorkingTree) (bool, error) {
+	isAncestor := func(commit string) (bool, error) {
+		is, err := wt.IsAncestor(commit, rev)
+		if err == ErrorInvalidRef {
+			log.Debugf("%s: commit not found", commit)
+			return false, nil
+		}
+		return is, err
+	}
+
+	introduced := false
+	for _, e := range events {
+		if e.Introduced == "" {
+			continue
+		}
+		if e.Introduced == "0" {
+			introduced = true
+			break
+		}
+		is, err := isAncestor(e.Introduced)
+		if err != nil {
+			return false, err
+		}
+		if is {
+			introduced = true
+			break
+		}
+	}
+	if !introduced {
+		return false, nil
+	}
+
+	for _, e := range events {
+		commit := e.Fixed
+		if commit == "" {
+			commit = e.Limit
+		}
+		if commit == "" && e.LastAffected != "" &&
+			!strings.HasPrefix(rev, e.LastAffected) {
+			commit = e.LastAffected
+		}
+		if commit == "" {
+			continue
+		}
+		is, err := isAncestor(commit)
+		if err != nil || is {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// String returns the ID of the advisory, followed by any aliases.
+func (adv *Advisory) String() string {
+	if len(adv.Aliases) == 0 {
+		return adv.ID
+	}
+	return adv.ID + " (" + strings.Join(adv.Aliases, ", ") + ")"
+}
@@ -0,0 +1,320 @@
+// Copyright (C) 2019 Tim Waugh
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package retrodep
+
+import (
+	"archive/zip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+type mockAncestryWorkingTree struct {
+	stubWorkingTree
+
+	// ancestors maps each revision to its ancestors, and itself
+	ancestors map[string][]string
+}
+
+func (wt *mockAncestryWorkingTree) IsAncestor(ancestor, rev string) (bool, error) {
+	if _, ok := wt.ancestors[ancestor]; !ok {
+		return false, ErrorInvalidRef
+	}
+	for _, a := range wt.ancestors[rev] {
+		if a == ancestor {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func TestParseSeverity(t *testing.T) {
+	for _, name := range SeverityNames() {
+		s, err := ParseSeverity(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.String() != name {
+			t.Errorf("%s: parsed as %s", name, s)
+		}
+	}
+	if _, err := ParseSeverity("moderate"); err == nil {
+		t.Error("unexpected success")
+	}
+
+	if !SeverityUnknown.AtLeast(SeverityCritical) {
+		t.Error("unknown severity should meet any threshold")
+	}
+	if SeverityMedium.AtLeast(SeverityHigh) {
+		t.Error("medium should not meet high")
+	}
+}
+
+func TestCVSS3BaseScore(t *testing.T) {
+	tcs := []struct {
+		vector string
+		score  float64
+	}{
+		{"CVSS:3.1/AV:N/AC:L/PR:N/UI:N/S:U/C:H/I:H/A:H", 9.8},
+		{"CVSS:3.1/AV:N/AC:L/PR:N/UI:N/S:U/C:L/I:N/A:N", 5.3},
+		{"CVSS:3.0/AV:N/AC:L/PR:L/UI:R/S:C/C:L/I:L/A:N", 5.4},
+		{"CVSS:3.1/AV:L/AC:H/PR:H/UI:R/S:U/C:N/I:N/A:N", 0},
+		{"CVSS:3.1/AV:N/AC:L/PR:N/UI:N/S:C/C:H/I:H/A:H", 10},
+	}
+	for _, tc := range tcs {
+		score, err := cvss3BaseScore(tc.vector)
+		if err != nil {
+			t.Errorf("%s: %s", tc.vector, err)
+			continue
+		}
+		if score != tc.score {
+			t.Errorf("%s: expected %.1f, got %.1f", tc.vector,
+				tc.score, score)
+		}
+	}
+
+	for _, vector := range []string{
+		"AV:N/AC:L/Au:N/C:P/I:P/A:P",
+		"CVSS:3.1/AV:N/AC:L/PR:N/UI:N/S:X/C:H/I:H/A:H",
+		"CVSS:3.1/AV:N/AC:L/PR:N/UI:N/S:U/C:H/I:H",
+	} {
+		if _, err := cvss3BaseScore(vector); err == nil {
+			t.Errorf("%s: unexpected success", vector)
+		}
+	}
+}
+
+func TestVersionInRange(t *testing.T) {
+	events := []osvEvent{
+		{Introduced: "0"},
+		{Fixed: "1.2.0"},
+		{Introduced: "1.5.0"},
+		{LastAffected: "1.6.0"},
+	}
+	tcs := []struct {
+		ver      string
+		affected bool
+	}{
+		{"v0.0.0-0.20190101000000-0123456789ab", true},
+		{"v1.1.9", true},
+		{"v1.2.0-0.20190101000000-0123456789ab", true},
+		{"v1.2.0", false},
+		{"v1.4.0", false},
+		{"v1.5.0", true},
+		{"v1.6.0", true},
+		{"v1.6.1-0.20190101000000-0123456789ab", false},
+		{"not-a-version", false},
+	}
+	for _, tc := range tcs {
+		if affected := versionInRange(events, tc.ver); affected != tc.affected {
+			t.Errorf("%s: expected %t, got %t", tc.ver, tc.affected,
+				affected)
+		}
+	}
+}
+
+func TestCommitInRange(t *testing.T) {
+	wt := &mockAncestryWorkingTree{
+		ancestors: map[string][]string{
+			"aaa": {"aaa"},
+			"bbb": {"aaa", "bbb"},
+			"ccc": {"aaa", "bbb", "ccc"},
+			"ddd": {"aaa", "bbb", "ccc", "ddd"},
+		},
+	}
+	tcs := []struct {
+		events   []osvEvent
+		rev      string
+		affected bool
+	}{
+		{[]osvEvent{{Introduced: "bbb"}, {Fixed: "ddd"}}, "aaa", false},
+		{[]osvEvent{{Introduced: "bbb"}, {Fixed: "ddd"}}, "bbb", true},
+		{[]osvEvent{{Introduced: "bbb"}, {Fixed: "ddd"}}, "ccc", true},
+		{[]osvEvent{{Introduced: "bbb"}, {Fixed: "ddd"}}, "ddd", false},
+		{[]osvEvent{{Introduced: "0"}, {LastAffected: "bbb"}}, "bbb", true},
+		{[]osvEvent{{Introduced: "0"}, {LastAffected: "bbb"}}, "ccc", false},
+		{[]osvEvent{{Introduced: "0"}, {Limit: "ccc"}}, "ccc", false},
+
+		// Commits not in the repository are ignored
+		{[]osvEvent{{Introduced: "zzz"}}, "ccc", false},
+		{[]osvEvent{{Introduced: "aaa"}, {Fixed: "zzz"}}, "ccc", true},
+	}
+	for _, tc := range tcs {
+		affected, err := commitInRange(tc.events, tc.rev, wt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if affected != tc.affected {
+			t.Errorf("%v %s: expected %t, got %t", tc.events, tc.rev,
+				tc.affected, affected)
+		}
+	}
+}
+
+func TestNormaliseRepoURL(t *testing.T) {
+	for _, u := range []string{
+		"https://github.com/foo/bar",
+		"https://github.com/Foo/bar.git",
+		"git://github.com/foo/bar/",
+		"ssh://git@github.com/foo/bar.git",
+		"git@github.com:foo/bar.git",
+	} {
+		if n := normaliseRepoURL(u); n != "github.com/foo/bar" {
+			t.Errorf("%s: got %s", u, n)
+		}
+	}
+}
+
+// advisoryIDs returns the IDs of the advisories.
+func advisoryIDs(advisories []*Advisory) []string {
+	var ids []string
+	for _, adv := range advisories {
+		ids = append(ids, adv.ID)
+	}
+	return ids
+}
+
+func testAdvisoryDB(t *testing.T, db *AdvisoryDB) {
+	wt := &mockAncestryWorkingTree{
+		ancestors: map[string][]string{
+			"aaa": {"aaa"},
+			"bbb": {"aaa", "bbb"},
+			"ccc": {"aaa", "bbb", "ccc"},
+		},
+	}
+	repo := "https://github.com/foo/bar"
+	tcs := []struct {
+		ref      Reference
+		expected []string
+	}{
+		{
+			Reference{Pkg: "github.com/foo/bar", Repo: repo, Ver: "v1.1.0", Rev: "bbb"},
+			[]string{"GO-2021-0001", "OSV-2020-111"},
+		},
+		{
+			// Only the commit range applies to a fork
+			Reference{Pkg: "github.com/fork/bar", Repo: repo, Ver: "v1.1.0", Rev: "bbb"},
+			[]string{"OSV-2020-111"},
+		},
+		{
+			Reference{Pkg: "github.com/foo/bar", Repo: repo, Ver: "v1.2.0", Rev: "ccc"},
+			nil,
+		},
+		{
+			Reference{Pkg: "github.com/foo/bar", Ver: "v2.1.0"},
+			[]string{"GHSA-aaaa-bbbb-cccc"},
+		},
+		{
+			Reference{Pkg: "github.com/foo/bar", Ver: "v2.1.1"},
+			nil,
+		},
+		{
+			Reference{Pkg: "github.com/foo/baz", Ver: "v1.0.0"},
+			nil,
+		},
+	}
+	for _, tc := range tcs {
+		advisories, err := db.Match(&tc.ref, wt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := advisoryIDs(advisories)
+		if !reflect.DeepEqual(ids, tc.expected) {
+			t.Errorf("%s@%s: expected %v, got %v", tc.ref.Pkg,
+				tc.ref.Ver, tc.expected, ids)
+		}
+	}
+
+	severities := map[string]Severity{
+		"GO-2021-0001":        SeverityUnknown,
+		"GHSA-aaaa-bbbb-cccc": SeverityMedium,
+		"OSV-2020-111":        SeverityHigh,
+	}
+	for _, index := range []map[string][]*Advisory{db.byPackage, db.byRepo} {
+		for _, advisories := range index {
+			for _, adv := range advisories {
+				if adv.Severity != severities[adv.ID] {
+					t.Errorf("%s: expected severity %s, got %s",
+						adv.ID, severities[adv.ID], adv.Severity)
+				}
+			}
+		}
+	}
+}
+
+func TestLoadAdvisoriesDir(t *testing.T) {
+	db, err := LoadAdvisories("testdata/osv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testAdvisoryDB(t, db)
+}
+
+func TestLoadAdvisoriesZip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "retrodep-test.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "all.zip")
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(f)
+	files, err := filepath.Glob("testdata/osv/*.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files = append(files, "testdata/osv/git/OSV-2020-111.json")
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w, err := zw.Create(filepath.Base(file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := LoadAdvisories(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testAdvisoryDB(t, db)
+}
+
+func TestLoadAdvisoriesErrors(t *testing.T) {
+	if _, err := LoadAdvisories("testdata/osv/missing"); err == nil {
+		t.Error("missing database: unexpected success")
+	}
+	if _, err := LoadAdvisories("testdata/osv/README"); err == nil {
+		t.Error("not a zip file: unexpected success")
+	}
+}
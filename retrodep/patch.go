@@ -0,0 +1,89 @@
+// Copyright (C) 2019 Tim Waugh
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package retrodep
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// WritePatch writes (to out) a patch, in the style of git
+// format-patch, which turns the project's upstream files at ref into
+// the Go source code at dir. File names in the patch are relative to
+// the repository root, and its headers name the upstream repository
+// and ref. As with Diff, files which are only present upstream are
+// ignored unless src.ShowRemoved selects them. It returns false,
+// having written nothing, if there are no changes.
+func (src GoSource) WritePatch(project *RepoPath, wt WorkingTree, out io.Writer, dir string, ref *Reference) (bool, error) {
+	return src.writePatch(context.Background(), project, wt, out, dir, ref)
+}
+
+// WritePatchContext is like WritePatch but gives up, with ctx.Err(),
+// once ctx is done.
+func (src GoSource) WritePatchContext(ctx context.Context, project *RepoPath, wt WorkingTree, out io.Writer, dir string, ref *Reference) (bool, error) {
+	wt = WorkingTreeWithContext(ctx, wt)
+	return src.writePatch(ctx, project, wt, out, dir, ref)
+}
+
+func (src GoSource) writePatch(ctx context.Context, project *RepoPath, wt WorkingTree, out io.Writer, dir string, ref *Reference) (bool, error) {
+	fileDiffs, err := src.fileDiffs(ctx, project, wt, dir, ref.Rev,
+		DefaultDiffContext)
+	if err != nil {
+		return false, err
+	}
+	if len(fileDiffs) == 0 {
+		return false, nil
+	}
+
+	ver := ref.Ver
+	if ver == "" {
+		ver = ref.Rev
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From %s Mon Sep 17 00:00:00 2001\n", ref.Rev)
+	fmt.Fprintf(&b, "Subject: [PATCH] %s: local changes to %s\n\n",
+		project.Root, ver)
+	fmt.Fprintf(&b, "Upstream-Repository: %s\n", project.Repo)
+	fmt.Fprintf(&b, "Upstream-Ref: %s (%s)\n", ver, ref.Rev)
+	fmt.Fprintln(&b, "---")
+	for _, d := range fileDiffs {
+		d.WriteTo(&b)
+	}
+	fmt.Fprintln(&b, "-- ")
+	fmt.Fprintln(&b, "retrodep")
+	fmt.Fprintln(&b)
+
+	_, err = b.WriteTo(out)
+	return true, err
+}
+
+// PatchFileName returns the name, in the style of git format-patch,
+// for the nth patch, counting from 1, in a series. It is based on
+// name, such as a vendored project's import path.
+func PatchFileName(n int, name string) string {
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z',
+			r >= '0' && r <= '9', r == '.', r == '_':
+			return r
+		}
+		return '-'
+	}, name)
+	return fmt.Sprintf("%04d-%s.patch", n, name)
+}
@@ -0,0 +1,132 @@
+// Copyright (C) 2019 Tim Waugh
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package retrodep
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/tools/go/vcs"
+)
+
+func TestWritePatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "retrodep-test.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	local := map[string]string{
+		"a.go": "package a\n",
+		"b.go": "package a // changed\n",
+		"c.go": "package a // added\n",
+	}
+	for path, content := range local {
+		err = ioutil.WriteFile(filepath.Join(dir, path), []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	wt := &mockNormaliseWorkingTree{}
+	wt.upstream = map[string]string{
+		"a.go": "package a\n",
+		"b.go": "package a\n",
+	}
+	wt.hasher = &sha256Hasher{}
+	project := &RepoPath{
+		RepoRoot: vcs.RepoRoot{
+			Root: "example.com/a",
+			Repo: "https://example.com/a",
+		},
+	}
+	ref := &Reference{Ver: matchVersion, Rev: matchRevision}
+
+	src, err := NewGoSource(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	changes, err := src.WritePatch(project, wt, &out, dir, ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changes {
+		t.Fatal("no changes")
+	}
+
+	expected := strings.Join([]string{
+		"From " + matchRevision + " Mon Sep 17 00:00:00 2001",
+		"Subject: [PATCH] example.com/a: local changes to " + matchVersion,
+		"",
+		"Upstream-Repository: https://example.com/a",
+		"Upstream-Ref: " + matchVersion + " (" + matchRevision + ")",
+		"---",
+		"diff --git a/b.go b/b.go",
+		"--- a/b.go",
+		"+++ b/b.go",
+		"@@ -1 +1 @@",
+		"-package a",
+		"+package a // changed",
+		"diff --git a/c.go b/c.go",
+		"new file mode 100644",
+		"--- /dev/null",
+		"+++ b/c.go",
+		"@@ -0,0 +1 @@",
+		"+package a // added",
+		"-- ",
+		"retrodep",
+		"",
+		"",
+	}, "\n")
+	if out.String() != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, out.String())
+	}
+
+	// No patch for an exact match
+	wt.upstream = local
+	out.Reset()
+	changes, err = src.WritePatch(project, wt, &out, dir, ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changes || out.Len() > 0 {
+		t.Errorf("unexpected patch: %q", out.String())
+	}
+}
+
+func TestPatchFileName(t *testing.T) {
+	tcs := []struct {
+		n        int
+		name     string
+		expected string
+	}{
+		{1, "github.com/foo/bar", "0001-github.com-foo-bar.patch"},
+		{12, "example.com/a/vendor/gopkg.in/b.v1", "0012-example.com-a-vendor-gopkg.in-b.v1.patch"},
+	}
+
+	for _, tc := range tcs {
+		name := PatchFileName(tc.n, tc.name)
+		if name != tc.expected {
+			t.Errorf("%d %s: expected %s, got %s", tc.n, tc.name,
+				tc.expected, name)
+		}
+	}
+}
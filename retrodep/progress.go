@@ -0,0 +1,90 @@
+// Copyright (C) 2019 Tim Waugh
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package retrodep
+
+import "context"
+
+// ProgressKind identifies the stage a ProgressEvent reports.
+type ProgressKind string
+
+const (
+	// ProgressCloning is reported before cloning a repository.
+	ProgressCloning ProgressKind = "cloning"
+
+	// ProgressHashing is reported before hashing local files.
+	ProgressHashing ProgressKind = "hashing"
+
+	// ProgressTryingTag is reported before comparing with a tag.
+	ProgressTryingTag ProgressKind = "trying-tag"
+
+	// ProgressTryingRevision is reported before comparing with a
+	// revision.
+	ProgressTryingRevision ProgressKind = "trying-revision"
+
+	// ProgressMatched is reported when a project has been
+	// identified.
+	ProgressMatched ProgressKind = "matched"
+)
+
+// ProgressEvent describes progress made while identifying a project.
+type ProgressEvent struct {
+	// Kind is the stage reached.
+	Kind ProgressKind
+
+	// Project is the repository root import path.
+	Project string
+
+	// Ref is the tag or revision being tried, or the version
+	// matched.
+	Ref string `json:",omitempty"`
+
+	// N counts from 1 up to Total while trying tags or
+	// revisions.
+	N     int `json:",omitempty"`
+	Total int `json:",omitempty"`
+}
+
+// Progress is the interface which wraps the Progress method, called
+// as work is done. Calls are made from the goroutine doing the
+// work.
+type Progress interface {
+	Progress(ev ProgressEvent)
+}
+
+// ProgressFunc adapts an ordinary function to the Progress
+// interface.
+type ProgressFunc func(ev ProgressEvent)
+
+// Progress calls f(ev).
+func (f ProgressFunc) Progress(ev ProgressEvent) {
+	f(ev)
+}
+
+type progressKey struct{}
+
+// WithProgress returns a copy of ctx which causes the Context
+// variants of functions, such as DescribeProjectContext, to report
+// their progress to p.
+func WithProgress(ctx context.Context, p Progress) context.Context {
+	return context.WithValue(ctx, progressKey{}, p)
+}
+
+// reportProgress reports ev to the Progress in ctx, if there is one.
+func reportProgress(ctx context.Context, ev ProgressEvent) {
+	if p, ok := ctx.Value(progressKey{}).(Progress); ok {
+		p.Progress(ev)
+	}
+}
@@ -0,0 +1,163 @@
+// Copyright (C) 2019 Tim Waugh
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package retrodep
+
+import (
+	"path/filepath"
+	"sort"
+)
+
+// Provenance classifies where a local file came from.
+type Provenance string
+
+const (
+	// ProvenanceExact indicates the file is identical to the
+	// upstream file at the matched revision.
+	ProvenanceExact Provenance = "exact"
+
+	// ProvenanceOtherRevision indicates the file content is
+	// present upstream, but at a different revision from the one
+	// matched.
+	ProvenanceOtherRevision Provenance = "other-revision"
+
+	// ProvenanceModified indicates the file exists upstream but
+	// its content does not match any upstream revision.
+	ProvenanceModified Provenance = "modified"
+
+	// ProvenanceAbsent indicates the file has never existed
+	// upstream.
+	ProvenanceAbsent Provenance = "absent"
+)
+
+// FileProvenance describes the origin of a single local file.
+type FileProvenance struct {
+	// Path is the filename relative to the project directory.
+	Path string
+
+	// Provenance classifies where the file came from.
+	Provenance Provenance
+
+	// Rev is the upstream revision the file content was found
+	// in, for ProvenanceOtherRevision.
+	Rev string
+}
+
+// Provenance classifies each file in dir, which is a copy of
+// project, by comparing it with the upstream files at the revision
+// ref.Rev. If ref is nil or has no revision, no file is classified
+// as ProvenanceExact. Files which do not match are looked for
+// throughout the upstream history. The result is sorted by Path.
+//
+// When a vendoring tool has changed files, for example by stripping
+// import comments, they are compared with upstream files at ref.Rev
+// changed in the same way, and will be classified as
+// ProvenanceModified if they match nowhere else.
+//
+// If ref was returned by DescribeProject for the same dir, the file
+// hashes it computed are used again.
+func (src GoSource) Provenance(project *RepoPath, wt WorkingTree, dir string, ref *Reference) ([]FileProvenance, error) {
+	var hashes FileHashes
+	if ref != nil {
+		hashes = ref.hashes
+	}
+	if hashes == nil {
+		var err error
+		hashes, err = src.hashLocalFiles(wt, project, dir)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	subPath := project.SubPath
+	refHashes := make(FileHashes)
+	if ref != nil && ref.Rev != "" {
+		if ref.upstream != nil {
+			// Take a copy as normalisation changes it
+			for path, hash := range ref.upstream {
+				refHashes[path] = hash
+			}
+		} else {
+			var err error
+			refHashes, err = wt.FileHashesFromRef(ref.Rev, subPath)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		// Change the upstream files in the same way as the
+		// vendoring tool before comparing.
+		mismatches := hashes.Mismatches(refHashes, false)
+		normalisers := src.normalisersFor(dir)
+		if normalisers != nil && mismatches != nil {
+			var paths []string
+			for _, path := range mismatches {
+				if _, ok := refHashes[path]; ok {
+					paths = append(paths, path)
+				}
+			}
+			err := updateHashesAfterNormalise(refHashes, wt,
+				ref.Rev, subPath, paths, normalisers)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	var paths []string
+	for path := range hashes {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	result := make([]FileProvenance, 0, len(paths))
+	for _, path := range paths {
+		fp := FileProvenance{Path: path}
+		hash := hashes[path]
+		repoPath := filepath.Join(subPath, path)
+		refHash, inRef := refHashes[path]
+		if inRef && refHash == hash {
+			fp.Provenance = ProvenanceExact
+			result = append(result, fp)
+			continue
+		}
+
+		rev, err := wt.RevisionWithBlob(repoPath, hash)
+		switch err {
+		case nil:
+			fp.Provenance = ProvenanceOtherRevision
+			fp.Rev = rev
+		case ErrorVersionNotFound:
+			fp.Provenance = ProvenanceModified
+			if !inRef {
+				_, err = wt.RevisionWithPath(repoPath)
+				switch err {
+				case nil:
+				case ErrorVersionNotFound:
+					fp.Provenance = ProvenanceAbsent
+				default:
+					return nil, err
+				}
+			}
+		default:
+			return nil, err
+		}
+
+		log.Debugf("%s: %s %s", path, fp.Provenance, fp.Rev)
+		result = append(result, fp)
+	}
+
+	return result, nil
+}
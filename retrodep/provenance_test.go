@@ -0,0 +1,146 @@
+// Copyright (C) 2019 Tim Waugh
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package retrodep
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/pkg/errors"
+
+	"golang.org/x/tools/go/vcs"
+)
+
+type mockProvenanceWorkingTree struct{ mockWorkingTree }
+
+func (m *mockProvenanceWorkingTree) FileHashesFromRef(ref, subPath string) (FileHashes, error) {
+	hashes, err := m.mockWorkingTree.FileHashesFromRef(ref, subPath)
+	if err != nil {
+		return nil, err
+	}
+	hashes["importcomment.go"] = "0"
+	return hashes, nil
+}
+
+func (m *mockProvenanceWorkingTree) RevisionWithBlob(path string, hash FileHash) (string, error) {
+	if path == "nonl.go" {
+		return "abc", nil
+	}
+	return "", ErrorVersionNotFound
+}
+
+func (m *mockProvenanceWorkingTree) RevisionWithPath(path string) (string, error) {
+	if path == "nonl.txt" {
+		return "def", nil
+	}
+	return "", ErrorVersionNotFound
+}
+
+func TestProvenance(t *testing.T) {
+	dir := "testdata/godep"
+	src, err := NewGoSource(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	project := &RepoPath{
+		RepoRoot: vcs.RepoRoot{Root: "example.com/godep"},
+	}
+	wt := &mockProvenanceWorkingTree{}
+	wt.hasher = &sha256Hasher{}
+
+	expected := []FileProvenance{
+		{"Godeps/Godeps.json", ProvenanceAbsent, ""},
+		{"importcomment.go", ProvenanceModified, ""},
+		{"nl.go", ProvenanceExact, ""},
+		{"nonl.go", ProvenanceOtherRevision, "abc"},
+		{"nonl.txt", ProvenanceModified, ""},
+	}
+
+	got, err := src.Provenance(project, wt, dir, &Reference{Rev: "v1.0.0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(expected) {
+		t.Fatalf("got %v, want %v", got, expected)
+	}
+	for i, fp := range expected {
+		if got[i] != fp {
+			t.Errorf("got %v, want %v", got[i], fp)
+		}
+	}
+
+	// Without a matched revision nothing is exact.
+	got, err = src.Provenance(project, wt, dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fp := range got {
+		if fp.Provenance == ProvenanceExact {
+			t.Errorf("%s: unexpectedly exact", fp.Path)
+		}
+	}
+}
+
+type mockNoHashesWorkingTree struct{ mockProvenanceWorkingTree }
+
+func (m *mockNoHashesWorkingTree) FileHashesFromRef(ref, subPath string) (FileHashes, error) {
+	return nil, errors.New("unexpected FileHashesFromRef")
+}
+
+func (m *mockNoHashesWorkingTree) Hash(relativePath, absPath string) (FileHash, error) {
+	return "", errors.New("unexpected Hash")
+}
+
+func TestProvenanceReusesHashes(t *testing.T) {
+	dir := "testdata/godep"
+	src, err := NewGoSource(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	project := &RepoPath{
+		RepoRoot: vcs.RepoRoot{Root: "example.com/godep"},
+	}
+	wt := &mockProvenanceWorkingTree{}
+	wt.hasher = &sha256Hasher{}
+	hashes, err := src.hashLocalFiles(wt, project, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream, err := wt.FileHashesFromRef("v1.0.0", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref := &Reference{Rev: "v1.0.0", hashes: hashes, upstream: upstream}
+	expected, err := src.Provenance(project, wt, dir, &Reference{Rev: "v1.0.0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The hashes already computed are used instead of asking
+	// the working tree again.
+	got, err := src.Provenance(project, &mockNoHashesWorkingTree{*wt}, dir, ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("got %v, want %v", got, expected)
+	}
+	if len(ref.upstream) != len(upstream) || ref.upstream["importcomment.go"] != "0" {
+		t.Errorf("upstream hashes changed: %v", ref.upstream)
+	}
+}
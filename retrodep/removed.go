@@ -0,0 +1,135 @@
+// Copyright (C) 2019 Tim Waugh
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package retrodep
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// RemovedFiles selects which upstream files missing from the local
+// copy are shown, as deletions, when comparing with upstream. The
+// zero value shows none of them.
+type RemovedFiles uint
+
+const (
+	// ShowRemoved shows upstream files missing from the local
+	// copy.
+	ShowRemoved RemovedFiles = 1 << iota
+
+	// RemovedGoOnly restricts ShowRemoved to Go source files.
+	RemovedGoOnly
+
+	// RemovedPackagesOnly restricts ShowRemoved to files in
+	// directories which are present in the local copy.
+	RemovedPackagesOnly
+)
+
+// removedFilters holds the name of each selection of removed files.
+var removedFilters = []struct {
+	r    RemovedFiles
+	name string
+}{
+	{ShowRemoved, "all"},
+	{ShowRemoved | RemovedGoOnly, "go"},
+	{ShowRemoved | RemovedPackagesOnly, "packages"},
+}
+
+// RemovedFilesNames returns the names accepted by ParseRemovedFiles.
+func RemovedFilesNames() []string {
+	names := make([]string, 0, len(removedFilters))
+	for _, filter := range removedFilters {
+		names = append(names, filter.name)
+	}
+	return names
+}
+
+// ParseRemovedFiles parses a comma-separated list of names, as
+// returned by RemovedFilesNames. Restrictions such as "go" imply
+// "all", and combine so that only files allowed by each of them are
+// shown.
+func ParseRemovedFiles(s string) (RemovedFiles, error) {
+	var r RemovedFiles
+	if s == "" {
+		return r, nil
+	}
+	for _, name := range strings.Split(s, ",") {
+		found := false
+		for _, filter := range removedFilters {
+			if filter.name == strings.TrimSpace(name) {
+				r |= filter.r
+				found = true
+				break
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("unknown removed files %q", name)
+		}
+	}
+	return r, nil
+}
+
+// removedFiles returns the paths from refHashes, for the upstream
+// files missing from hashes of the local copy of project at dir,
+// which src.ShowRemoved selects. Files the local copy ignores, such
+// as vendored and excluded files, are never selected.
+func (src GoSource) removedFiles(project *RepoPath, dir string, hashes, refHashes FileHashes) ([]string, error) {
+	if src.ShowRemoved&ShowRemoved == 0 {
+		return nil, nil
+	}
+
+	excl, vendor, err := src.localExcludes(project, dir)
+	if err != nil {
+		return nil, err
+	}
+	vendor, err = filepath.Rel(dir, vendor)
+	if err != nil {
+		return nil, err
+	}
+
+	dirs := make(map[string]struct{})
+	for path := range hashes {
+		dirs[filepath.Dir(path)] = struct{}{}
+	}
+
+	var removed []string
+	for path := range refHashes {
+		if _, ok := hashes[path]; ok {
+			continue
+		}
+
+		// Ignore the same files as hashLocalFiles
+		if strings.HasPrefix(path, ".") || inVendorDir(path) ||
+			strings.HasPrefix(path, vendor+string(filepath.Separator)) ||
+			excl.Excluded(path, false) {
+			continue
+		}
+
+		if src.ShowRemoved&RemovedGoOnly != 0 &&
+			!strings.HasSuffix(path, ".go") {
+			continue
+		}
+		if src.ShowRemoved&RemovedPackagesOnly != 0 {
+			if _, ok := dirs[filepath.Dir(path)]; !ok {
+				continue
+			}
+		}
+
+		removed = append(removed, path)
+	}
+	return removed, nil
+}
@@ -0,0 +1,154 @@
+// Copyright (C) 2019 Tim Waugh
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package retrodep
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"golang.org/x/tools/go/vcs"
+)
+
+func TestParseRemovedFiles(t *testing.T) {
+	tcs := []struct {
+		s        string
+		expected RemovedFiles
+		errors   bool
+	}{
+		{"", 0, false},
+		{"all", ShowRemoved, false},
+		{"go", ShowRemoved | RemovedGoOnly, false},
+		{"go,packages", ShowRemoved | RemovedGoOnly | RemovedPackagesOnly, false},
+		{"go,unknown", 0, true},
+	}
+
+	for _, tc := range tcs {
+		r, err := ParseRemovedFiles(tc.s)
+		if (err != nil) != tc.errors {
+			t.Errorf("%q: unexpected error result: %v", tc.s, err)
+			continue
+		}
+		if r != tc.expected {
+			t.Errorf("%q: expected %v, got %v", tc.s, tc.expected, r)
+		}
+	}
+}
+
+func TestFileDiffsRemoved(t *testing.T) {
+	dir, err := ioutil.TempDir("", "retrodep-test.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	local := map[string]string{
+		"a.go":     "package a\n",
+		"sub/b.go": "package sub\n",
+	}
+	for path, content := range local {
+		path = filepath.Join(dir, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	wt := &mockNormaliseWorkingTree{
+		upstream: map[string]string{
+			"a.go":          "package a\n",
+			"a_linux.go":    "package a\n",
+			"a_test.go":     "package a\n",
+			"LICENSE":       "licence\n",
+			".travis.yml":   "language: go\n",
+			"other/d.go":    "package other\n",
+			"sub/b.go":      "package sub\n",
+			"sub/c.go":      "package sub\n",
+			"vendor/x/x.go": "package x\n",
+		},
+	}
+	wt.hasher = &sha256Hasher{}
+	project := &RepoPath{RepoRoot: vcs.RepoRoot{Root: "example.com/a"}}
+	dropTests := &buildTagNormaliser{
+		name: "ignored build tags",
+		tags: map[string]struct{}{"test": {}},
+	}
+
+	tcs := []struct {
+		removed     RemovedFiles
+		normalisers []Normaliser
+		expected    []string
+	}{
+		{0, nil, nil},
+		{
+			ShowRemoved, nil,
+			[]string{"LICENSE", "a_linux.go", "a_test.go", "other/d.go", "sub/c.go"},
+		},
+		{
+			ShowRemoved | RemovedGoOnly, nil,
+			[]string{"a_linux.go", "a_test.go", "other/d.go", "sub/c.go"},
+		},
+		{
+			ShowRemoved | RemovedPackagesOnly, nil,
+			[]string{"LICENSE", "a_linux.go", "a_test.go", "sub/c.go"},
+		},
+		{
+			ShowRemoved | RemovedGoOnly | RemovedPackagesOnly, nil,
+			[]string{"a_linux.go", "a_test.go", "sub/c.go"},
+		},
+		{
+			// Files removed by the vendoring tool are not shown
+			ShowRemoved | RemovedGoOnly | RemovedPackagesOnly,
+			[]Normaliser{dropTests},
+			[]string{"a_linux.go", "sub/c.go"},
+		},
+	}
+
+	for _, tc := range tcs {
+		src, err := NewGoSource(dir, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		src.ShowRemoved = tc.removed
+		if tc.normalisers != nil {
+			// Normalisers are only used for vendored projects
+			src.Normalisers = tc.normalisers
+			src.Path = filepath.Dir(dir)
+		}
+
+		diffs, err := src.FileDiffs(project, wt, dir, matchVersion,
+			DefaultDiffContext)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var paths []string
+		for _, d := range diffs {
+			if !d.Removed {
+				t.Errorf("%v: %s not removed", tc.removed, d.Path)
+			}
+			paths = append(paths, d.Path)
+		}
+		if !reflect.DeepEqual(paths, tc.expected) {
+			t.Errorf("%v: expected %v, got %v", tc.removed,
+				tc.expected, paths)
+		}
+	}
+}
@@ -0,0 +1,312 @@
+// Copyright (C) 2019 Tim Waugh
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package retrodep
+
+import (
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"golang.org/x/tools/go/vcs"
+)
+
+// Resolver is the interface which wraps the RepoRootForImportPath
+// method.
+type Resolver interface {
+	// RepoRootForImportPath returns the repository root for the
+	// import path.
+	RepoRootForImportPath(importPath string) (*vcs.RepoRoot, error)
+}
+
+// ResolverFunc adapts an ordinary function to the Resolver
+// interface.
+type ResolverFunc func(importPath string) (*vcs.RepoRoot, error)
+
+// RepoRootForImportPath calls f(importPath).
+func (f ResolverFunc) RepoRootForImportPath(importPath string) (*vcs.RepoRoot, error) {
+	return f(importPath)
+}
+
+// VCSResolver uses golang.org/x/tools/go/vcs to resolve import
+// paths, in the same way as 'go get'.
+var VCSResolver Resolver = ResolverFunc(func(importPath string) (*vcs.RepoRoot, error) {
+	return vcs.RepoRootForImportPath(importPath, false)
+})
+
+// ErrorUnresolved indicates a Resolver has no information about an
+// import path.
+var ErrorUnresolved = errors.New("import path not resolved")
+
+// resolver returns the Resolver to use for src.
+func (src GoSource) resolver() Resolver {
+	if src.Resolver != nil {
+		return src.Resolver
+	}
+	return VCSResolver
+}
+
+// MultiResolver returns a Resolver which tries each of resolvers in
+// turn, returning the first successful result. If none succeed, the
+// error from the last is returned.
+func MultiResolver(resolvers ...Resolver) Resolver {
+	return ResolverFunc(func(importPath string) (*vcs.RepoRoot, error) {
+		err := ErrorUnresolved
+		for _, r := range resolvers {
+			var root *vcs.RepoRoot
+			root, err = r.RepoRootForImportPath(importPath)
+			if err == nil {
+				return root, nil
+			}
+		}
+		return nil, err
+	})
+}
+
+// StaticResolver resolves import paths from a fixed mapping of
+// import path prefixes to repositories.
+type StaticResolver struct {
+	// Roots maps import path prefixes to repository roots.
+	Roots map[string]*vcs.RepoRoot
+}
+
+// LoadStaticResolver reads a mapping of import path prefixes to
+// repositories. Each line has the same form as the content of a
+// go-import meta tag:
+//
+//	import-prefix vcs repo-url
+//
+// Blank lines, and lines beginning with "#", are ignored.
+func LoadStaticResolver(r io.Reader) (*StaticResolver, error) {
+	s := &StaticResolver{Roots: make(map[string]*vcs.RepoRoot)}
+	scanner := bufio.NewScanner(r)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		root, err := parseImportContent(line)
+		if err != nil {
+			return nil, errors.Wrapf(err, "line %d", lineno)
+		}
+		s.Roots[root.Root] = root
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// parseImportContent parses "import-prefix vcs repo-url".
+func parseImportContent(content string) (*vcs.RepoRoot, error) {
+	fields := strings.Fields(content)
+	if len(fields) != 3 {
+		return nil, fmt.Errorf("expected 3 fields: %q", content)
+	}
+	v := vcs.ByCmd(fields[1])
+	if v == nil {
+		return nil, fmt.Errorf("unknown VCS %q", fields[1])
+	}
+	return &vcs.RepoRoot{
+		VCS:  v,
+		Repo: fields[2],
+		Root: fields[0],
+	}, nil
+}
+
+// longestPrefix returns the key of roots which is the longest prefix
+// of importPath, ending at a path separator, or "" if there is none.
+func longestPrefix(roots map[string]*vcs.RepoRoot, importPath string) string {
+	var best string
+	for prefix := range roots {
+		if len(prefix) <= len(best) {
+			continue
+		}
+		if importPath == prefix ||
+			strings.HasPrefix(importPath, prefix+"/") {
+			best = prefix
+		}
+	}
+	return best
+}
+
+// RepoRootForImportPath implements the Resolver interface. It
+// returns ErrorUnresolved if no prefix matches.
+func (s *StaticResolver) RepoRootForImportPath(importPath string) (*vcs.RepoRoot, error) {
+	prefix := longestPrefix(s.Roots, importPath)
+	if prefix == "" {
+		return nil, ErrorUnresolved
+	}
+	root := *s.Roots[prefix]
+	return &root, nil
+}
+
+// MetaResolver resolves import paths by fetching go-import meta
+// tags, in the same way as 'go get', using a configurable HTTP
+// client.
+type MetaResolver struct {
+	// Client is the HTTP client to use. If nil,
+	// http.DefaultClient is used.
+	Client *http.Client
+
+	// Insecure allows fetching meta tags using plain HTTP.
+	Insecure bool
+}
+
+// RepoRootForImportPath implements the Resolver interface.
+func (m *MetaResolver) RepoRootForImportPath(importPath string) (*vcs.RepoRoot, error) {
+	client := m.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	scheme := "https"
+	if m.Insecure {
+		scheme = "http"
+	}
+
+	url := scheme + "://" + importPath + "?go-get=1"
+	log.Debugf("fetching %s", url)
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, errors.Wrapf(err, "fetching %s", url)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s: %s", url, resp.Status)
+	}
+
+	roots, err := parseMetaImports(resp.Body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parsing %s", url)
+	}
+	prefix := longestPrefix(roots, importPath)
+	if prefix == "" {
+		return nil, fmt.Errorf("%s: no go-import meta tag for %s",
+			url, importPath)
+	}
+	return roots[prefix], nil
+}
+
+// parseMetaImports returns the go-import meta tags found in the
+// head of an HTML document, indexed by import prefix.
+func parseMetaImports(r io.Reader) (map[string]*vcs.RepoRoot, error) {
+	d := xml.NewDecoder(r)
+	d.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		switch strings.ToLower(charset) {
+		case "utf-8", "ascii":
+			return input, nil
+		}
+		return nil, fmt.Errorf("can't decode XML document using charset %q", charset)
+	}
+	d.Strict = false
+	d.AutoClose = xml.HTMLAutoClose
+	d.Entity = xml.HTMLEntity
+
+	roots := make(map[string]*vcs.RepoRoot)
+	for {
+		t, err := d.RawToken()
+		if err != nil {
+			if err == io.EOF || len(roots) > 0 {
+				break
+			}
+			return nil, err
+		}
+		if e, ok := t.(xml.StartElement); ok && strings.EqualFold(e.Name.Local, "body") {
+			break
+		}
+		if e, ok := t.(xml.EndElement); ok && strings.EqualFold(e.Name.Local, "head") {
+			break
+		}
+		e, ok := t.(xml.StartElement)
+		if !ok || !strings.EqualFold(e.Name.Local, "meta") {
+			continue
+		}
+		if attrValue(e.Attr, "name") != "go-import" {
+			continue
+		}
+		root, err := parseImportContent(attrValue(e.Attr, "content"))
+		if err != nil {
+			log.Debugf("ignoring go-import meta tag: %s", err)
+			continue
+		}
+		roots[root.Root] = root
+	}
+	return roots, nil
+}
+
+// attrValue returns the value of the named attribute, or "".
+func attrValue(attrs []xml.Attr, name string) string {
+	for _, a := range attrs {
+		if strings.EqualFold(a.Name.Local, name) {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// CachingResolver remembers the results from another Resolver. Once
+// a repository root is known, import paths within it are resolved
+// without consulting the other Resolver. It is safe for concurrent
+// use.
+type CachingResolver struct {
+	resolver Resolver
+
+	mu     sync.Mutex
+	roots  map[string]*vcs.RepoRoot
+	errors map[string]error
+}
+
+// NewCachingResolver returns a CachingResolver for r.
+func NewCachingResolver(r Resolver) *CachingResolver {
+	return &CachingResolver{
+		resolver: r,
+		roots:    make(map[string]*vcs.RepoRoot),
+		errors:   make(map[string]error),
+	}
+}
+
+// RepoRootForImportPath implements the Resolver interface.
+func (c *CachingResolver) RepoRootForImportPath(importPath string) (*vcs.RepoRoot, error) {
+	c.mu.Lock()
+	if err, ok := c.errors[importPath]; ok {
+		c.mu.Unlock()
+		return nil, err
+	}
+	if prefix := longestPrefix(c.roots, importPath); prefix != "" {
+		root := *c.roots[prefix]
+		c.mu.Unlock()
+		return &root, nil
+	}
+	c.mu.Unlock()
+
+	root, err := c.resolver.RepoRootForImportPath(importPath)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err != nil {
+		c.errors[importPath] = err
+		return nil, err
+	}
+	cached := *root
+	c.roots[root.Root] = &cached
+	return root, nil
+}
@@ -0,0 +1,163 @@
+// Copyright (C) 2019 Tim Waugh
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package retrodep
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/tools/go/vcs"
+)
+
+func TestStaticResolver(t *testing.T) {
+	mapping := `
+# Private hosts
+example.com/foo git https://git.example.com/foo.git
+example.com/foo/bar hg https://hg.example.com/bar
+`
+	s, err := LoadStaticResolver(strings.NewReader(mapping))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tcases := []struct {
+		importPath string
+		root       string
+		repo       string
+		vcs        string
+	}{
+		{"example.com/foo", "example.com/foo", "https://git.example.com/foo.git", "git"},
+		{"example.com/foo/baz", "example.com/foo", "https://git.example.com/foo.git", "git"},
+		{"example.com/foo/bar/sub", "example.com/foo/bar", "https://hg.example.com/bar", "hg"},
+	}
+	for _, tc := range tcases {
+		root, err := s.RepoRootForImportPath(tc.importPath)
+		if err != nil {
+			t.Errorf("%s: %s", tc.importPath, err)
+			continue
+		}
+		if root.Root != tc.root || root.Repo != tc.repo || root.VCS.Cmd != tc.vcs {
+			t.Errorf("%s: got %v", tc.importPath, root)
+		}
+	}
+
+	for _, importPath := range []string{"example.com/foobar", "example.org/foo"} {
+		if _, err := s.RepoRootForImportPath(importPath); err != ErrorUnresolved {
+			t.Errorf("%s: got %v, want ErrorUnresolved", importPath, err)
+		}
+	}
+
+	_, err = LoadStaticResolver(strings.NewReader("example.com/foo git"))
+	if err == nil {
+		t.Error("invalid mapping not reported")
+	}
+}
+
+func TestMetaResolver(t *testing.T) {
+	var host string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("go-get") != "1" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprintf(w, `<!DOCTYPE html>
+<html><head>
+<meta name="go-import" content="%s/vanity git https://git.example.com/vanity">
+<meta name="go-source" content="ignored">
+</head><body>Nothing to see here</body></html>
+`, host)
+	}))
+	defer server.Close()
+	host = strings.TrimPrefix(server.URL, "http://")
+
+	m := &MetaResolver{Client: server.Client(), Insecure: true}
+	root, err := m.RepoRootForImportPath(host + "/vanity/sub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root.Root != host+"/vanity" || root.Repo != "https://git.example.com/vanity" {
+		t.Errorf("unexpected root: %v", root)
+	}
+
+	_, err = m.RepoRootForImportPath(host + "/other")
+	if err == nil {
+		t.Error("missing go-import tag not reported")
+	}
+}
+
+func TestCachingResolver(t *testing.T) {
+	calls := 0
+	r := NewCachingResolver(ResolverFunc(func(importPath string) (*vcs.RepoRoot, error) {
+		calls++
+		if importPath == "example.com/bad" {
+			return nil, ErrorUnresolved
+		}
+		return &vcs.RepoRoot{Root: "example.com/foo"}, nil
+	}))
+
+	for _, importPath := range []string{
+		"example.com/foo/bar",
+		"example.com/foo",
+		"example.com/foo/baz",
+	} {
+		root, err := r.RepoRootForImportPath(importPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if root.Root != "example.com/foo" {
+			t.Errorf("%s: got %v", importPath, root)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := r.RepoRootForImportPath("example.com/bad"); err != ErrorUnresolved {
+			t.Errorf("got %v, want ErrorUnresolved", err)
+		}
+	}
+
+	if calls != 2 {
+		t.Errorf("wrapped resolver called %d times, want 2", calls)
+	}
+}
+
+func TestMultiResolver(t *testing.T) {
+	static := &StaticResolver{Roots: map[string]*vcs.RepoRoot{
+		"example.com/foo": &vcs.RepoRoot{Root: "example.com/foo"},
+	}}
+	fallback := ResolverFunc(func(importPath string) (*vcs.RepoRoot, error) {
+		return &vcs.RepoRoot{Root: importPath, Repo: "fallback"}, nil
+	})
+	r := MultiResolver(static, fallback)
+
+	root, err := r.RepoRootForImportPath("example.com/foo/bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root.Repo == "fallback" {
+		t.Error("static mapping not used")
+	}
+
+	root, err = r.RepoRootForImportPath("example.org/bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root.Repo != "fallback" {
+		t.Error("fallback not used")
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright (C) 2019 Tim Waugh
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package retrodep
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/tools/go/vcs"
+)
+
+// Rule rewrites import paths to repositories. Exactly one of Prefix
+// and Regexp is set.
+type Rule struct {
+	// Prefix is an import path prefix. It matches the import path
+	// itself and any import path beneath it, and is the
+	// repository root.
+	Prefix string
+
+	// Regexp matches the start of import paths. The text it
+	// matches, which must end at a path separator, is the
+	// repository root.
+	Regexp *regexp.Regexp
+
+	// Repo is the repository URL. For Regexp rules, $1 etc. are
+	// expanded from the submatches.
+	Repo string
+
+	// VCS is the version control system used by Repo.
+	VCS *vcs.Cmd
+
+	// Source describes where the rule was defined, e.g. "rules:3".
+	Source string
+}
+
+// String returns the rule's Source.
+func (r *Rule) String() string {
+	return r.Source
+}
+
+// match returns the repository root for importPath if the rule
+// applies to it, or nil if not.
+func (r *Rule) match(importPath string) *vcs.RepoRoot {
+	root := &vcs.RepoRoot{VCS: r.VCS}
+	if r.Regexp == nil {
+		if importPath != r.Prefix &&
+			!strings.HasPrefix(importPath, r.Prefix+"/") {
+			return nil
+		}
+		root.Root = r.Prefix
+		root.Repo = r.Repo
+		return root
+	}
+
+	m := r.Regexp.FindStringSubmatchIndex(importPath)
+	if m == nil || m[0] != 0 {
+		return nil
+	}
+	end := m[1]
+	if end != len(importPath) && importPath[end] != '/' {
+		return nil
+	}
+	root.Root = importPath[:end]
+	root.Repo = string(r.Regexp.ExpandString(nil, r.Repo, importPath, m))
+	return root
+}
+
+// Rules is an ordered list of Rule.
+type Rules []*Rule
+
+// LoadRules reads rules from r, naming each Rule's Source after name
+// and the line number. Each line has one of these forms:
+//
+//	prefix import-prefix vcs repo-url
+//	regexp pattern vcs repo-url
+//
+// Blank lines, and lines beginning with "#", are ignored.
+func LoadRules(r io.Reader, name string) (Rules, error) {
+	var rules Rules
+	scanner := bufio.NewScanner(r)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		source := fmt.Sprintf("%s:%d", name, lineno)
+		fields := strings.Fields(line)
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("%s: expected 4 fields", source)
+		}
+		rule := &Rule{
+			Repo:   fields[3],
+			VCS:    vcs.ByCmd(fields[2]),
+			Source: source,
+		}
+		if rule.VCS == nil {
+			return nil, fmt.Errorf("%s: unknown VCS %q", source, fields[2])
+		}
+		switch fields[0] {
+		case "prefix":
+			rule.Prefix = strings.TrimSuffix(fields[1], "/")
+		case "regexp":
+			pattern := fields[1]
+			if !strings.HasPrefix(pattern, "^") {
+				pattern = "^" + pattern
+			}
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return nil, errors.Wrap(err, source)
+			}
+			rule.Regexp = re
+		default:
+			return nil, fmt.Errorf("%s: unknown rule type %q",
+				source, fields[0])
+		}
+		rules = append(rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// Match returns the repository root for importPath from the first
+// rule which applies to it, along with that rule. If no rule applies
+// it returns nil, nil.
+func (rules Rules) Match(importPath string) (*vcs.RepoRoot, *Rule) {
+	for _, rule := range rules {
+		if root := rule.match(importPath); root != nil {
+			log.Debugf("%s: rewritten by %s", importPath, rule)
+			return root, rule
+		}
+	}
+	return nil, nil
+}
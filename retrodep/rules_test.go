@@ -0,0 +1,122 @@
+// Copyright (C) 2019 Tim Waugh
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package retrodep
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/tools/go/vcs"
+)
+
+const testRules = `
+# Moved from Google Code
+prefix code.google.com/p/go-uuid git https://github.com/pborman/uuid
+
+# Converted from hg
+regexp bitbucket\.org/([^/]+)/([^/]+) git https://github.com/$1/$2.git
+`
+
+func TestRules(t *testing.T) {
+	rules, err := LoadRules(strings.NewReader(testRules), "rules")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tcases := []struct {
+		importPath string
+		root       string
+		repo       string
+		source     string
+	}{
+		{
+			"code.google.com/p/go-uuid/uuid",
+			"code.google.com/p/go-uuid",
+			"https://github.com/pborman/uuid",
+			"rules:3",
+		},
+		{
+			"bitbucket.org/ww/goautoneg",
+			"bitbucket.org/ww/goautoneg",
+			"https://github.com/ww/goautoneg.git",
+			"rules:6",
+		},
+		{
+			"bitbucket.org/ww/goautoneg/sub",
+			"bitbucket.org/ww/goautoneg",
+			"https://github.com/ww/goautoneg.git",
+			"rules:6",
+		},
+		{"code.google.com/p/go-uuidx", "", "", ""},
+		{"github.com/foo/bar", "", "", ""},
+	}
+	for _, tc := range tcases {
+		root, rule := rules.Match(tc.importPath)
+		if tc.source == "" {
+			if root != nil || rule != nil {
+				t.Errorf("%s: unexpected match: %v", tc.importPath, rule)
+			}
+			continue
+		}
+		if root == nil {
+			t.Errorf("%s: no match", tc.importPath)
+			continue
+		}
+		if root.Root != tc.root || root.Repo != tc.repo || root.VCS.Cmd != vcsGit {
+			t.Errorf("%s: got %v", tc.importPath, root)
+		}
+		if rule.Source != tc.source {
+			t.Errorf("%s: Source: got %q, want %q", tc.importPath, rule.Source, tc.source)
+		}
+	}
+
+	for _, invalid := range []string{
+		"prefix example.com/foo git",
+		"prefix example.com/foo cvs https://example.com/foo",
+		"glob example.com/* git https://example.com/foo",
+		"regexp example.com/( git https://example.com/foo",
+	} {
+		if _, err := LoadRules(strings.NewReader(invalid), "rules"); err == nil {
+			t.Errorf("%q: error not reported", invalid)
+		}
+	}
+}
+
+func TestRepoPathForImportPathRules(t *testing.T) {
+	src, err := NewGoSource("testdata/gosource", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src.Rules, err = LoadRules(strings.NewReader(testRules), "rules")
+	if err != nil {
+		t.Fatal(err)
+	}
+	src.Resolver = ResolverFunc(func(importPath string) (*vcs.RepoRoot, error) {
+		t.Errorf("%s: resolver consulted", importPath)
+		return nil, ErrorUnresolved
+	})
+
+	repoPath, err := src.RepoPathForImportPath("code.google.com/p/go-uuid/uuid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if repoPath.Repo != "https://github.com/pborman/uuid" {
+		t.Errorf("Repo: got %q", repoPath.Repo)
+	}
+	if repoPath.Rule != "rules:3" {
+		t.Errorf("Rule: got %q", repoPath.Rule)
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright (C) 2019 Tim Waugh
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package retrodep
+
+// FileChangeKind says how a local file differs from upstream.
+type FileChangeKind string
+
+const (
+	// FileAdded means the file is not present upstream.
+	FileAdded FileChangeKind = "added"
+
+	// FileModified means the file's content differs from upstream.
+	FileModified FileChangeKind = "modified"
+
+	// FileRemoved means the upstream file is not present locally.
+	FileRemoved FileChangeKind = "removed"
+)
+
+// A FileChange summarises a FileDiff, for machine-readable output.
+type FileChange struct {
+	// Path is the slash-separated name of the file, relative to
+	// the repository root.
+	Path string
+
+	Change FileChangeKind
+
+	// LinesAdded and LinesRemoved count the lines changed. They
+	// are zero for binary files.
+	LinesAdded   int
+	LinesRemoved int
+
+	Binary            bool `json:",omitempty"`
+	WhitespaceOnly    bool `json:",omitempty"`
+	ImportCommentOnly bool `json:",omitempty"`
+}
+
+// Summary returns a summary of the differences in d.
+func (d *FileDiff) Summary() FileChange {
+	c := FileChange{
+		Path:              d.Path,
+		Change:            FileModified,
+		Binary:            d.Binary,
+		WhitespaceOnly:    d.WhitespaceOnly,
+		ImportCommentOnly: d.ImportCommentOnly,
+	}
+	switch {
+	case d.Added:
+		c.Change = FileAdded
+	case d.Removed:
+		c.Change = FileRemoved
+	}
+	for _, h := range d.Hunks {
+		for _, line := range h.Lines {
+			switch line.Kind {
+			case DiffAdded:
+				c.LinesAdded++
+			case DiffRemoved:
+				c.LinesRemoved++
+			}
+		}
+	}
+	return c
+}
@@ -0,0 +1,98 @@
+// Copyright (C) 2019 Tim Waugh
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package retrodep
+
+import (
+	"testing"
+)
+
+func TestFileDiffSummary(t *testing.T) {
+	tcs := []struct {
+		path     string
+		old, new *string
+		expected FileChange
+	}{
+		{
+			"a.go",
+			strPtr("package a\n\nvar x = 1\n"),
+			strPtr("package a\n\nvar x = 2\nvar y = 3\n"),
+			FileChange{Change: FileModified, LinesAdded: 2, LinesRemoved: 1},
+		},
+		{
+			"a.go",
+			strPtr("package a\n\nvar x = 1\n"),
+			strPtr("package a\r\n\r\nvar x =  1"),
+			FileChange{
+				Change:         FileModified,
+				LinesAdded:     3,
+				LinesRemoved:   3,
+				WhitespaceOnly: true,
+			},
+		},
+		{
+			"a.go",
+			strPtr("package a // import \"example.com/a\"\n"),
+			strPtr("package a\n"),
+			FileChange{
+				Change:            FileModified,
+				LinesAdded:        1,
+				LinesRemoved:      1,
+				ImportCommentOnly: true,
+			},
+		},
+		{
+			// Only Go source files have import comments
+			"a.txt",
+			strPtr("package a // import \"example.com/a\"\n"),
+			strPtr("package a\n"),
+			FileChange{Change: FileModified, LinesAdded: 1, LinesRemoved: 1},
+		},
+		{
+			"a.go",
+			nil,
+			strPtr("package a\n\nvar x = 1\n"),
+			FileChange{Change: FileAdded, LinesAdded: 3},
+		},
+		{
+			"a.go",
+			strPtr("package a\n"),
+			nil,
+			FileChange{Change: FileRemoved, LinesRemoved: 1},
+		},
+		{
+			"a.bin",
+			strPtr("\x00"),
+			strPtr("\x01\x00"),
+			FileChange{Change: FileModified, Binary: true},
+		},
+	}
+
+	for _, tc := range tcs {
+		var old, new []byte
+		if tc.old != nil {
+			old = []byte(*tc.old)
+		}
+		if tc.new != nil {
+			new = []byte(*tc.new)
+		}
+		tc.expected.Path = tc.path
+		summary := NewFileDiff(tc.path, old, new, DefaultDiffContext).Summary()
+		if summary != tc.expected {
+			t.Errorf("%s: expected %#v, got %#v", tc.path,
+				tc.expected, summary)
+		}
+	}
+}
@@ -0,0 +1 @@
+package govendor // import "example.com/govendor"
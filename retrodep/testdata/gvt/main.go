@@ -0,0 +1 @@
+package gvt // import "example.com/gvt"
@@ -0,0 +1,435 @@
+// Copyright (C) 2019 Tim Waugh
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package retrodep
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// DefaultDiffContext is the number of unchanged lines shown around
+// each change, as for 'diff -u'.
+const DefaultDiffContext = 3
+
+// DiffLineKind says whether a line in a Hunk is unchanged, removed or
+// added. Its value is the character which prefixes the line in
+// unified diff format.
+type DiffLineKind byte
+
+const (
+	// DiffContext marks an unchanged line.
+	DiffContext DiffLineKind = ' '
+
+	// DiffRemoved marks a line only present in the old version.
+	DiffRemoved DiffLineKind = '-'
+
+	// DiffAdded marks a line only present in the new version.
+	DiffAdded DiffLineKind = '+'
+)
+
+// A DiffLine is a single line of a Hunk.
+type DiffLine struct {
+	Kind DiffLineKind
+
+	// Text is the content of the line, without its line ending.
+	Text string
+
+	// NoNewline is true for a final line with no line ending.
+	NoNewline bool
+}
+
+// A Hunk is a run of changed lines, with unchanged lines around them
+// for context. Line numbers count from 1.
+type Hunk struct {
+	OldStart, OldLines int
+	NewStart, NewLines int
+	Lines              []DiffLine
+}
+
+// A FileDiff describes the differences between the old (upstream)
+// and new (local) versions of a file.
+type FileDiff struct {
+	// Path is the slash-separated name of the file, relative to
+	// the repository root.
+	Path string
+
+	// Added is true if there is no old version, and Removed is
+	// true if there is no new version.
+	Added, Removed bool
+
+	// Binary is true if either version is binary, in which case
+	// there are no Hunks.
+	Binary bool
+
+	// WhitespaceOnly is true if the versions only differ in
+	// whitespace, and ImportCommentOnly is true if they otherwise
+	// only differ in the import comment of a Go source file.
+	WhitespaceOnly, ImportCommentOnly bool
+
+	Hunks []Hunk
+}
+
+// NewFileDiff compares the old and new content of the file path,
+// showing context unchanged lines around each change. A nil old or
+// new means that version of the file is not present. It returns nil
+// if the contents are the same.
+func NewFileDiff(path string, old, new []byte, context int) *FileDiff {
+	if old != nil && new != nil && string(old) == string(new) {
+		return nil
+	}
+
+	d := &FileDiff{
+		Path:    path,
+		Added:   old == nil,
+		Removed: new == nil,
+	}
+	if isBinary(old) || isBinary(new) {
+		d.Binary = true
+		return d
+	}
+	if old != nil && new != nil {
+		d.WhitespaceOnly = bytes.Equal(removeSpace(old), removeSpace(new))
+		if !d.WhitespaceOnly && strings.HasSuffix(path, ".go") {
+			oldStripped, _ := stripImportComment(old)
+			newStripped, _ := stripImportComment(new)
+			d.ImportCommentOnly = bytes.Equal(oldStripped, newStripped)
+		}
+	}
+	d.Hunks = diffHunks(splitLines(old), splitLines(new), context)
+	return d
+}
+
+// removeSpace returns content without any white space.
+func removeSpace(content []byte) []byte {
+	return bytes.Join(bytes.Fields(content), nil)
+}
+
+// names returns the names of the old and new versions, with git's
+// "a/" and "b/" prefixes, or "/dev/null" if not present.
+func (d *FileDiff) names() (string, string) {
+	oldName, newName := "a/"+d.Path, "b/"+d.Path
+	if d.Added {
+		oldName = "/dev/null"
+	}
+	if d.Removed {
+		newName = "/dev/null"
+	}
+	return oldName, newName
+}
+
+// WriteTo writes the differences to w in the unified diff format
+// used by git.
+func (d *FileDiff) WriteTo(w io.Writer) (int64, error) {
+	bw := &countingWriter{w: bufio.NewWriter(w)}
+	fmt.Fprintf(bw, "diff --git a/%s b/%s\n", d.Path, d.Path)
+	switch {
+	case d.Added:
+		fmt.Fprintln(bw, "new file mode 100644")
+	case d.Removed:
+		fmt.Fprintln(bw, "deleted file mode 100644")
+	}
+	oldName, newName := d.names()
+	if d.Binary {
+		fmt.Fprintf(bw, "Binary files %s and %s differ\n", oldName,
+			newName)
+	} else {
+		writeUnified(bw, oldName, newName, d.Hunks)
+	}
+	return bw.n, bw.flush()
+}
+
+// writeUnified writes hunks to w in unified diff format, with headers
+// naming the old and new versions.
+func writeUnified(w io.Writer, oldName, newName string, hunks []Hunk) {
+	fmt.Fprintf(w, "--- %s\n+++ %s\n", oldName, newName)
+	for _, h := range hunks {
+		fmt.Fprintf(w, "@@ -%s +%s @@\n", hunkRange(h.OldStart, h.OldLines),
+			hunkRange(h.NewStart, h.NewLines))
+		for _, line := range h.Lines {
+			fmt.Fprintf(w, "%c%s\n", line.Kind, line.Text)
+			if line.NoNewline {
+				fmt.Fprintln(w, `\ No newline at end of file`)
+			}
+		}
+	}
+}
+
+// hunkRange formats the start and length of a hunk's lines, leaving
+// out a length of 1.
+func hunkRange(start, lines int) string {
+	if lines == 1 {
+		return fmt.Sprintf("%d", start)
+	}
+	return fmt.Sprintf("%d,%d", start, lines)
+}
+
+// countingWriter counts the bytes written to a *bufio.Writer,
+// remembering the first error.
+type countingWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	if cw.err != nil {
+		return 0, cw.err
+	}
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	cw.err = err
+	return n, err
+}
+
+func (cw *countingWriter) flush() error {
+	if cw.err != nil {
+		return cw.err
+	}
+	return cw.w.Flush()
+}
+
+// splitLines returns the lines of content, each with its line ending.
+func splitLines(content []byte) []string {
+	s := string(content)
+	var lines []string
+	for s != "" {
+		end := strings.IndexByte(s, '\n') + 1
+		if end == 0 {
+			end = len(s)
+		}
+		lines = append(lines, s[:end])
+		s = s[end:]
+	}
+	return lines
+}
+
+// diffLine returns the DiffLine of kind for line, which includes its
+// line ending if it has one.
+func diffLine(kind DiffLineKind, line string) DiffLine {
+	text := strings.TrimSuffix(line, "\n")
+	return DiffLine{
+		Kind:      kind,
+		Text:      text,
+		NoNewline: len(text) == len(line),
+	}
+}
+
+// diffHunks returns the hunks which change lines a into lines b, with
+// context unchanged lines around each change.
+func diffHunks(a, b []string, context int) []Hunk {
+	if context < 0 {
+		context = 0
+	}
+
+	// Mark the lines which differ
+	m := &lineMatcher{
+		a:        a,
+		b:        b,
+		aChanged: make([]bool, len(a)),
+		bChanged: make([]bool, len(b)),
+	}
+	m.compare(0, len(a), 0, len(b))
+
+	// Walk both sequences in step, collecting runs of changes
+	// along with their context.
+	var hunks []Hunk
+	var h *Hunk
+	i, j := 0, 0
+	unchanged := 0 // unchanged lines since the last change
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && m.aChanged[i], j < len(b) && m.bChanged[j]:
+			if h == nil {
+				// Start a new hunk, with leading context
+				before := context
+				if before > i {
+					before = i
+				}
+				if before > j {
+					before = j
+				}
+				hunks = append(hunks, Hunk{
+					OldStart: i - before + 1,
+					NewStart: j - before + 1,
+				})
+				h = &hunks[len(hunks)-1]
+				for k := before; k > 0; k-- {
+					h.Lines = append(h.Lines,
+						diffLine(DiffContext, a[i-k]))
+				}
+				h.OldLines, h.NewLines = before, before
+			} else if unchanged > 0 {
+				// Include the unchanged lines between
+				// changes
+				for k := unchanged; k > 0; k-- {
+					h.Lines = append(h.Lines,
+						diffLine(DiffContext, a[i-k]))
+				}
+				h.OldLines += unchanged
+				h.NewLines += unchanged
+			}
+			unchanged = 0
+
+			if i < len(a) && m.aChanged[i] {
+				h.Lines = append(h.Lines, diffLine(DiffRemoved, a[i]))
+				h.OldLines++
+				i++
+			} else {
+				h.Lines = append(h.Lines, diffLine(DiffAdded, b[j]))
+				h.NewLines++
+				j++
+			}
+		default:
+			i++
+			j++
+			if h == nil {
+				continue
+			}
+			unchanged++
+			if unchanged > 2*context {
+				// End the hunk, with trailing context
+				finishHunk(h, a, i-unchanged, context)
+				h = nil
+				unchanged = 0
+			}
+		}
+	}
+	if h != nil {
+		n := unchanged
+		if n > context {
+			n = context
+		}
+		finishHunk(h, a, i-unchanged, n)
+	}
+	return hunks
+}
+
+// finishHunk adds n lines of trailing context, from a starting at
+// index start, to h. Empty ranges are numbered from the line before.
+func finishHunk(h *Hunk, a []string, start, n int) {
+	for k := 0; k < n; k++ {
+		h.Lines = append(h.Lines, diffLine(DiffContext, a[start+k]))
+	}
+	h.OldLines += n
+	h.NewLines += n
+	if h.OldLines == 0 {
+		h.OldStart--
+	}
+	if h.NewLines == 0 {
+		h.NewStart--
+	}
+}
+
+// lineMatcher finds the lines to change to turn a into b, using
+// the linear space variant of Myers' algorithm.
+type lineMatcher struct {
+	a, b               []string
+	aChanged, bChanged []bool
+}
+
+// compare marks the lines which differ between a[aLo:aHi] and
+// b[bLo:bHi].
+func (m *lineMatcher) compare(aLo, aHi, bLo, bHi int) {
+	// Skip the common prefix and suffix
+	for aLo < aHi && bLo < bHi && m.a[aLo] == m.b[bLo] {
+		aLo++
+		bLo++
+	}
+	for aLo < aHi && bLo < bHi && m.a[aHi-1] == m.b[bHi-1] {
+		aHi--
+		bHi--
+	}
+
+	switch {
+	case aLo == aHi:
+		for ; bLo < bHi; bLo++ {
+			m.bChanged[bLo] = true
+		}
+	case bLo == bHi:
+		for ; aLo < aHi; aLo++ {
+			m.aChanged[aLo] = true
+		}
+	default:
+		x, y := m.middleSnake(aLo, aHi, bLo, bHi)
+		m.compare(aLo, x, bLo, y)
+		m.compare(x, aHi, y, bHi)
+	}
+}
+
+// middleSnake returns a point on a shortest edit path from
+// (aLo, bLo) to (aHi, bHi) which divides it in two, found by
+// searching forwards and backwards at the same time.
+func (m *lineMatcher) middleSnake(aLo, aHi, bLo, bHi int) (int, int) {
+	n, mm := aHi-aLo, bHi-bLo
+	max := (n + mm + 1) / 2
+	delta := n - mm
+	odd := delta%2 != 0
+
+	// vf holds the furthest x reached going forwards on each
+	// diagonal k = x - y. vb holds the furthest distance from the
+	// end reached going backwards on each diagonal c, which is
+	// diagonal delta - c going forwards.
+	off := max + 1
+	vf := make([]int, 2*max+3)
+	vb := make([]int, 2*max+3)
+	for d := 0; d <= max; d++ {
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && vf[off+k-1] < vf[off+k+1]) {
+				x = vf[off+k+1]
+			} else {
+				x = vf[off+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < mm && m.a[aLo+x] == m.b[bLo+y] {
+				x++
+				y++
+			}
+			vf[off+k] = x
+
+			c := delta - k
+			if odd && c >= -(d-1) && c <= d-1 && x+vb[off+c] >= n {
+				return aLo + x, bLo + y
+			}
+		}
+
+		for c := -d; c <= d; c += 2 {
+			var x int
+			if c == -d || (c != d && vb[off+c-1] < vb[off+c+1]) {
+				x = vb[off+c+1]
+			} else {
+				x = vb[off+c-1] + 1
+			}
+			y := x - c
+			for x < n && y < mm && m.a[aHi-x-1] == m.b[bHi-y-1] {
+				x++
+				y++
+			}
+			vb[off+c] = x
+
+			k := delta - c
+			if !odd && k >= -d && k <= d && x+vf[off+k] >= n {
+				return aHi - x, bHi - y
+			}
+		}
+	}
+
+	// Not reached: the paths always meet by max
+	panic("no middle snake")
+}
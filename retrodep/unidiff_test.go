@@ -0,0 +1,158 @@
+// Copyright (C) 2019 Tim Waugh
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package retrodep
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFileDiff(t *testing.T) {
+	lines := func(n int) string {
+		var b strings.Builder
+		for i := 1; i <= n; i++ {
+			b.WriteString(strings.Repeat("x", i) + "\n")
+		}
+		return b.String()
+	}
+
+	tcs := []struct {
+		name     string
+		old, new *string
+		context  int
+		expected string
+	}{
+		{
+			name:     "same",
+			old:      strPtr("a\n"),
+			new:      strPtr("a\n"),
+			context:  3,
+			expected: "",
+		},
+		{
+			name:     "changed",
+			old:      strPtr("a\nb\nc\n"),
+			new:      strPtr("a\nB\nc\n"),
+			context:  3,
+			expected: "diff --git a/f b/f\n--- a/f\n+++ b/f\n@@ -1,3 +1,3 @@\n a\n-b\n+B\n c\n",
+		},
+		{
+			name:     "no context",
+			old:      strPtr("a\nb\nc\n"),
+			new:      strPtr("a\nB\nc\n"),
+			context:  0,
+			expected: "diff --git a/f b/f\n--- a/f\n+++ b/f\n@@ -2 +2 @@\n-b\n+B\n",
+		},
+		{
+			name:     "insertion without context",
+			old:      strPtr("a\nc\n"),
+			new:      strPtr("a\nb\nc\n"),
+			context:  0,
+			expected: "diff --git a/f b/f\n--- a/f\n+++ b/f\n@@ -1,0 +2 @@\n+b\n",
+		},
+		{
+			name:     "separate hunks",
+			old:      strPtr(lines(10)),
+			new:      strPtr(strings.Replace(strings.Replace(lines(10), "x\n", "y\n", 1), "xxxxxxxxxx\n", "z\n", 1)),
+			context:  2,
+			expected: "diff --git a/f b/f\n--- a/f\n+++ b/f\n@@ -1,3 +1,3 @@\n-x\n+y\n xx\n xxx\n@@ -8,3 +8,3 @@\n xxxxxxxx\n xxxxxxxxx\n-xxxxxxxxxx\n+z\n",
+		},
+		{
+			name:     "joined hunks",
+			old:      strPtr(lines(5)),
+			new:      strPtr(strings.Replace(strings.Replace(lines(5), "x\n", "y\n", 1), "xxxxx\n", "z\n", 1)),
+			context:  2,
+			expected: "diff --git a/f b/f\n--- a/f\n+++ b/f\n@@ -1,5 +1,5 @@\n-x\n+y\n xx\n xxx\n xxxx\n-xxxxx\n+z\n",
+		},
+		{
+			name:     "no newline",
+			old:      strPtr("a\nb"),
+			new:      strPtr("a\nb\n"),
+			context:  3,
+			expected: "diff --git a/f b/f\n--- a/f\n+++ b/f\n@@ -1,2 +1,2 @@\n a\n-b\n\\ No newline at end of file\n+b\n",
+		},
+		{
+			name:     "added",
+			old:      nil,
+			new:      strPtr("a\n"),
+			context:  3,
+			expected: "diff --git a/f b/f\nnew file mode 100644\n--- /dev/null\n+++ b/f\n@@ -0,0 +1 @@\n+a\n",
+		},
+		{
+			name:     "removed",
+			old:      strPtr("a\nb\n"),
+			new:      nil,
+			context:  3,
+			expected: "diff --git a/f b/f\ndeleted file mode 100644\n--- a/f\n+++ /dev/null\n@@ -1,2 +0,0 @@\n-a\n-b\n",
+		},
+		{
+			name:     "binary",
+			old:      strPtr("a\x00"),
+			new:      strPtr("b\x00"),
+			context:  3,
+			expected: "diff --git a/f b/f\nBinary files a/f and b/f differ\n",
+		},
+	}
+
+	for _, tc := range tcs {
+		var old, new []byte
+		if tc.old != nil {
+			old = []byte(*tc.old)
+		}
+		if tc.new != nil {
+			new = []byte(*tc.new)
+		}
+		d := NewFileDiff("f", old, new, tc.context)
+		if d == nil {
+			if tc.expected != "" {
+				t.Errorf("%s: no differences", tc.name)
+			}
+			continue
+		}
+
+		var b strings.Builder
+		n, err := d.WriteTo(&b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int(n) != b.Len() {
+			t.Errorf("%s: wrote %d bytes, counted %d", tc.name,
+				b.Len(), n)
+		}
+		if b.String() != tc.expected {
+			t.Errorf("%s: expected:\n%s\ngot:\n%s", tc.name,
+				tc.expected, b.String())
+		}
+	}
+}
+
+func TestDiffHunksMinimal(t *testing.T) {
+	a := strings.Split("a b c a b b a", " ")
+	b := strings.Split("c b a b a c", " ")
+	hunks := diffHunks(a, b, 0)
+	changes := 0
+	for _, h := range hunks {
+		changes += h.OldLines + h.NewLines
+	}
+	// The shortest edit script for this pair has length 5
+	if changes != 5 {
+		t.Errorf("expected 5 changes, got %d: %v", changes, hunks)
+	}
+}
+
+func strPtr(s string) *string {
+	return &s
+}
@@ -16,10 +16,11 @@
 package retrodep
 
 import (
-	"bytes"
-	"io/ioutil"
+	"context"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
 	"strings"
 
 	"github.com/Masterminds/semver"
@@ -36,9 +37,16 @@ type vendoredSearch struct {
 	// Path to the "vendor" directory
 	vendor string
 
+	// Import paths of the vendored projects through which this
+	// "vendor" directory is reached, outermost first
+	chain []string
+
 	// Path to last project identified
 	lastdir string
 
+	// Last project identified
+	last *RepoPath
+
 	// Vendored packages, indexed by Root
 	vendored map[string]*RepoPath
 }
@@ -47,31 +55,115 @@ func (s *vendoredSearch) inLastDir(pth string) bool {
 	return s.lastdir != "" && pathStartsWith(pth, s.lastdir)
 }
 
-func processVendoredSource(src *GoSource, search *vendoredSearch, pth string) error {
-	// For .go source files, see which directory they are in
-	rel, err := filepath.Rel(search.vendor, pth)
+// addPackage records the package containing the file pth as being
+// present in the last project identified.
+func (s *vendoredSearch) addPackage(pth string) error {
+	rel, err := filepath.Rel(s.vendor, pth)
+	if err != nil {
+		return err
+	}
+	if !isPackageSource(rel) {
+		return nil
+	}
+	pkg := filepath.ToSlash(filepath.Dir(rel))
+	for _, p := range s.last.Packages {
+		if p == pkg {
+			return nil
+		}
+	}
+	s.last.Packages = append(s.last.Packages, pkg)
+	return nil
+}
+
+// addNested searches the "vendor" directory pth within the last
+// project identified, and adds the projects found there. They are
+// indexed by their path relative to the outer "vendor" directory.
+func (s *vendoredSearch) addNested(src *GoSource, pth string) error {
+	chain := make([]string, len(s.chain), len(s.chain)+1)
+	copy(chain, s.chain)
+	chain = append(chain, s.last.Root)
+	nested, err := src.vendoredProjects(pth, chain)
+	if err != nil {
+		return err
+	}
+
+	rel, err := filepath.Rel(s.vendor, pth)
+	if err != nil {
+		return err
+	}
+	for key, project := range nested {
+		s.vendored[path.Join(filepath.ToSlash(rel), key)] = project
+	}
+	return nil
+}
+
+// identify records the project containing the directory dir as the
+// last project identified.
+func (s *vendoredSearch) identify(src *GoSource, dir string) error {
+	rel, err := filepath.Rel(s.vendor, dir)
 	if err != nil {
 		return err
 	}
-	thisImport := filepath.ToSlash(filepath.Dir(rel))
+	thisImport := filepath.ToSlash(rel)
 	repoPath, err := src.RepoPathForImportPath(thisImport)
 	if err != nil {
-		search.vendored[thisImport] = &RepoPath{RepoRoot: vcs.RepoRoot{Root: thisImport}, Err: err}
-		return nil
+		return err
 	}
 
-	// The project name is relative to the vendor dir
-	search.vendored[repoPath.Root] = repoPath
-	search.lastdir = filepath.Join(search.vendor,
-		filepath.FromSlash(repoPath.Root))
+	// The project name is relative to the vendor dir. Take a
+	// copy of the RepoPath as it may be shared with the Go source
+	// configuration.
+	project := *repoPath
+	project.Chain = s.chain
+	project.Dir = filepath.Join(s.vendor, filepath.FromSlash(project.Root))
+	s.vendored[project.Root] = &project
+	s.last = &project
+	s.lastdir = project.Dir
 	return nil
 }
 
+func processVendoredSource(src *GoSource, search *vendoredSearch, pth string) error {
+	// For .go source files, see which directory they are in
+	dir := filepath.Dir(pth)
+	if err := search.identify(src, dir); err != nil {
+		rel, relErr := filepath.Rel(search.vendor, dir)
+		if relErr != nil {
+			return relErr
+		}
+		thisImport := filepath.ToSlash(rel)
+		search.vendored[thisImport] = &RepoPath{
+			RepoRoot: vcs.RepoRoot{Root: thisImport},
+			Chain:    search.chain,
+			Dir:      dir,
+			Err:      err,
+		}
+		return nil
+	}
+
+	return search.addPackage(pth)
+}
+
 // VendoredProjects return a map of project import names to information
 // about those projects, including which version control system they use.
+//
+// Projects found in "vendor" directories within vendored projects are
+// also included. These are indexed by their path relative to the
+// top-level "vendor" directory, e.g. "example.com/a/vendor/example.com/b",
+// and their RepoPath.Chain describes how they are reached.
 func (src GoSource) VendoredProjects() (map[string]*RepoPath, error) {
+	if _, err := os.Stat(src.Path); err != nil {
+		return nil, err
+	}
+
+	return src.vendoredProjects(src.Vendor(), nil)
+}
+
+// vendoredProjects searches the "vendor" directory at vendor for
+// projects, which are reached through the vendored projects in chain.
+func (src GoSource) vendoredProjects(vendor string, chain []string) (map[string]*RepoPath, error) {
 	search := vendoredSearch{
-		vendor:   src.Vendor(),
+		vendor:   vendor,
+		chain:    chain,
 		vendored: make(map[string]*RepoPath),
 	}
 	walkfn := func(pth string, info os.FileInfo, err error) error {
@@ -80,24 +172,49 @@ func (src GoSource) VendoredProjects() (map[string]*RepoPath, error) {
 			return err
 		}
 
-		// Ignore paths within the last project we identified
-		if search.inLastDir(pth) {
+		// Excluded paths are not part of any project
+		if pth != search.vendor && src.isExcluded(pth, info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
 			return nil
 		}
 
-		// Ignore anything except Go source
-		if !info.Mode().IsRegular() || !strings.HasSuffix(pth, ".go") {
+		// Vendored projects may have "vendor" directories of
+		// their own. The walk may reach one before any of the
+		// project's other files, so identify the project from
+		// the directory containing it.
+		if info.IsDir() && info.Name() == "vendor" && pth != search.vendor {
+			if !search.inLastDir(pth) {
+				err := search.identify(&src, filepath.Dir(pth))
+				if err != nil {
+					log.Debugf("%s: %s", pth, err)
+				}
+			}
+			if search.inLastDir(pth) {
+				if err := search.addNested(&src, pth); err != nil {
+					return err
+				}
+				return filepath.SkipDir
+			}
+		}
+
+		// Ignore anything except Go source, the other files
+		// built into packages, and interface definitions
+		if !info.Mode().IsRegular() || !isProjectFile(pth) {
 			return nil
 		}
 
+		// Paths within the last project we identified only
+		// tell us which of its packages are present
+		if search.inLastDir(pth) {
+			return search.addPackage(pth)
+		}
+
 		// Identify the project
 		return processVendoredSource(&src, &search, pth)
 	}
 
-	if _, err := os.Stat(src.Path); err != nil {
-		return nil, err
-	}
-
 	_, err := os.Stat(search.vendor)
 	if err != nil {
 		if !os.IsNotExist(err) {
@@ -110,99 +227,37 @@ func (src GoSource) VendoredProjects() (map[string]*RepoPath, error) {
 		}
 	}
 
-	return search.vendored, nil
-}
-
-// updateHashesAfterStrip syncs the tree to tag or revision ref and
-// recalculates file hashes for the provided paths based on stripping
-// import comments (in the same way as godep).  The boolean return
-// value indicates whether any of the supplied hashes were modified as
-// a result.
-func updateHashesAfterStrip(hashes FileHashes, wt WorkingTree, ref string, paths []string) (bool, error) {
-	// Update working tree to match the ref
-	err := wt.RevSync(ref)
-	if err != nil {
-		return false, errors.Wrapf(err, "RevSync to %s", ref)
+	for _, project := range search.vendored {
+		sort.Strings(project.Packages)
 	}
 
-	anyChanged := false
-	for _, path := range paths {
-		w := bytes.NewBuffer(nil)
-		changed, err := wt.StripImportComment(path, w)
-		if err != nil {
-			return false, err
-		}
-		if !changed {
-			continue
-		}
-
-		// Write the altered content out to a file
-		f, err := ioutil.TempFile("", "retrodep-strip.")
-		if err != nil {
-			return anyChanged, errors.Wrap(err, "updating hash")
-		}
-
-		// Remove the new file after we've hashed it
-		defer os.Remove(f.Name())
-
-		// Write to the file and close it, checking for errors
-		_, err = w.WriteTo(f)
-		if err != nil {
-			f.Close() // ignore any secondary error
-			return anyChanged, errors.Wrap(err, "updating hash")
-		}
-
-		if err = f.Close(); err != nil {
-			return anyChanged, errors.Wrap(err, "updating hash")
-		}
-
-		// Re-hash the altered file
-		h, err := wt.Hash(path, f.Name())
-		if err != nil {
-			return anyChanged, err
-		}
-		hashes[path] = h
-		anyChanged = true
-
-	}
-
-	return anyChanged, nil
+	return search.vendored, nil
 }
 
-func matchFromRefs(strip bool, hashes FileHashes, wt WorkingTree, subPath string, refs []string) ([]string, error) {
-	var paths []string
-	if strip {
-		for path := range hashes {
-			paths = append(paths, filepath.Join(subPath, path))
-		}
-	}
-
+// matchFromRefs returns the run of refs, in the order given, whose
+// files in subPath match hashes. If norm is not nil, files which do
+// not match are compared again after normalisation.
+func matchFromRefs(ctx context.Context, ev ProgressEvent, norm *normalisedMatch, hashes FileHashes, wt WorkingTree, subPath string, refs []string) ([]string, error) {
 	matchFromRef := func(th FileHashes, ref string) (bool, error) {
-		if hashes.IsSubsetOf(th) {
+		// Packages may be omitted (for example, by pruning the
+		// vendor tree) but those present must be complete.
+		if hashes.MissingFromPackages(th) == nil && hashes.IsSubsetOf(th) {
 			return true, nil
 		}
 
-		if !strip {
+		if norm == nil {
 			return false, nil
 		}
-
-		for _, path := range paths {
-			if _, ok := th[path]; !ok {
-				// File missing from revision
-				return false, nil
-			}
-		}
-
-		changed, err := updateHashesAfterStrip(th, wt, ref, paths)
-		if err != nil {
-			return false, err
-		}
-
-		return changed && hashes.IsSubsetOf(th), nil
+		return norm.match(th, wt, ref, subPath)
 	}
 
 	matches := make([]string, 0)
-	for _, ref := range refs {
+	for i, ref := range refs {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		ev.Ref, ev.N, ev.Total = ref, i+1, len(refs)
+		reportProgress(ctx, ev)
 		log.Debugf("%s: trying match", ref)
 		refHashes, err := wt.FileHashesFromRef(ref, subPath)
 		if err != nil {
@@ -240,6 +295,11 @@ type Reference struct {
 	// defined.
 	TopVer string
 
+	// Chain holds the import paths of the vendored projects
+	// through which Pkg is vendored into TopPkg, outermost
+	// first. It is empty if Pkg is vendored directly into TopPkg.
+	Chain []string
+
 	// Pkg is the name of the package this Reference relates to.
 	Pkg string
 
@@ -258,6 +318,69 @@ type Reference struct {
 	// Ver is the semantic version or pseudo-version for the
 	// commit named in Reference. This is Tag if Tag is not "".
 	Ver string
+
+	// Rule is the Source of the Rule used to find Repo, or "" if
+	// none was used.
+	Rule string
+
+	// Packages holds the import paths of the packages present in
+	// the local copy of the project.
+	Packages []string
+
+	// OmittedPackages holds the import paths of packages in the
+	// upstream revision which are not present in the local copy,
+	// for instance because the vendor tree was pruned.
+	OmittedPackages []string
+
+	// Normalised holds descriptions of the normalisations, such
+	// as "line endings", needed for the local copy to match the
+	// upstream revision. It is empty if they match exactly.
+	Normalised []string
+
+	// Binaries holds the paths, within the project's import path,
+	// of binary files in the local copy, such as .syso objects.
+	// They should be reviewed as their source is not available.
+	Binaries []string
+
+	// Licenses holds the SPDX identifiers of the licenses found in
+	// the local copy, in license files such as LICENSE and COPYING
+	// and in the headers of Go source files.
+	Licenses []string
+
+	// MissingLicenseFiles holds the paths, within the project's
+	// import path, of license files in the upstream revision which
+	// are not present in the local copy.
+	MissingLicenseFiles []string
+
+	// hashes holds the hashes of the local files the Reference
+	// was described from, and upstream those at Rev, so they
+	// need not be computed again.
+	hashes, upstream FileHashes
+}
+
+// importPaths converts directories relative to the top-level of a
+// package with import path base into import paths.
+func importPaths(base string, dirs []string) []string {
+	var paths []string
+	for _, dir := range dirs {
+		paths = append(paths, path.Join(base, filepath.ToSlash(dir)))
+	}
+	return paths
+}
+
+// compareWithUpstream fills in ref.OmittedPackages and
+// ref.MissingLicenseFiles by comparing the packages and license files
+// in hashes with those at the upstream tag or revision match.
+func compareWithUpstream(ref *Reference, base string, hashes FileHashes, wt WorkingTree, subPath, match string) error {
+	refHashes, err := wt.FileHashesFromRef(match, subPath)
+	if err != nil {
+		return err
+	}
+	ref.upstream = refHashes
+	ref.OmittedPackages = importPaths(base, hashes.OmittedPackages(refHashes))
+	ref.MissingLicenseFiles = importPaths(base,
+		missingLicenseFiles(hashes, refHashes))
+	return nil
 }
 
 // chooseBestTag takes a sorted list of tags and returns the oldest
@@ -281,14 +404,13 @@ func chooseBestTag(tags []string) string {
 }
 
 func (src GoSource) hashLocalFiles(hasher Hasher, project *RepoPath, dir string) (FileHashes, error) {
-	// Make a local copy of src.excludes we can add keys to
-	excludes := make(map[string]struct{})
-	for key := range src.excludes {
-		excludes[key] = struct{}{}
+	excl, vendor, err := src.localExcludes(project, dir)
+	if err != nil {
+		return nil, err
+	}
+	excludes := map[string]struct{}{
+		vendor: struct{}{},
 	}
-
-	// Ignore vendor directory
-	excludes[filepath.Join(dir, "vendor")] = struct{}{}
 
 	// Work out the sub-directory within the repository root to
 	// use for comparison.
@@ -297,14 +419,15 @@ func (src GoSource) hashLocalFiles(hasher Hasher, project *RepoPath, dir string)
 	log.Debugf("describing %s compared to %s", dir, projDir)
 
 	// Compute the hashes of the local files
-	hashes, err := NewFileHashes(hasher, dir, excludes)
+	hashes, err := newFileHashes(hasher, dir, excludes, excl)
 	if err != nil {
 		return nil, err
 	}
 
 	for path := range hashes {
-		// Ignore dot files (e.g. .git)
-		if strings.HasPrefix(path, ".") {
+		// Ignore dot files (e.g. .git), and vendor directories
+		// nested within sub-directories
+		if strings.HasPrefix(path, ".") || inVendorDir(path) {
 			delete(hashes, path)
 		}
 	}
@@ -316,6 +439,28 @@ func (src GoSource) hashLocalFiles(hasher Hasher, project *RepoPath, dir string)
 	return hashes, nil
 }
 
+// localExcludes returns the exclusion patterns, relative to dir, for
+// the local copy of project in dir, and the vendor directory to
+// ignore there.
+func (src GoSource) localExcludes(project *RepoPath, dir string) (*Excludes, string, error) {
+	// Make a copy of src.excludes relative to dir, which we can
+	// add the project's own patterns to
+	rel, err := filepath.Rel(src.Path, dir)
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "Rel(%q, %q)", src.Path, dir)
+	}
+	excl := src.excludes.sub(rel)
+	excl.Add(project.Exclude...)
+
+	// Ignore vendor directory, which for the top-level project
+	// depends on the vendoring tool
+	vendor := filepath.Join(dir, "vendor")
+	if dir == src.Path {
+		vendor = src.Vendor()
+	}
+	return excl, vendor, nil
+}
+
 // DescribeProject attempts to identify the tag in the version control
 // system which corresponds to the project, available in the working
 // tree wt, based on comparison with files in dir. Vendored files and
@@ -328,6 +473,35 @@ func (src GoSource) DescribeProject(
 	dir string,
 	top *Reference,
 ) (*Reference, error) {
+	return src.describeProject(context.Background(), project, wt, dir, top)
+}
+
+// DescribeProjectContext is like DescribeProject but gives up, with
+// ctx.Err(), once ctx is done. Commands run in wt are killed at that
+// point. Progress is reported to any Progress in ctx (see
+// WithProgress).
+func (src GoSource) DescribeProjectContext(
+	ctx context.Context,
+	project *RepoPath,
+	wt WorkingTree,
+	dir string,
+	top *Reference,
+) (*Reference, error) {
+	wt = WorkingTreeWithContext(ctx, wt)
+	return src.describeProject(ctx, project, wt, dir, top)
+}
+
+func (src GoSource) describeProject(
+	ctx context.Context,
+	project *RepoPath,
+	wt WorkingTree,
+	dir string,
+	top *Reference,
+) (*Reference, error) {
+	reportProgress(ctx, ProgressEvent{
+		Kind:    ProgressHashing,
+		Project: project.Root,
+	})
 	hashes, err := src.hashLocalFiles(wt, project, dir)
 	if err != nil {
 		return nil, err
@@ -339,27 +513,33 @@ func (src GoSource) DescribeProject(
 	projDir := filepath.Join(project.Root, subPath)
 	log.Debugf("describing %s compared to %s", dir, projDir)
 
-	// If godep is in use, strip import comments from the
-	// project's vendored files (but not files from the top-level
-	// project).
-	strip := src.usesGodep && dir != src.Path
+	// Files which do not match exactly are compared again after
+	// any normalisations requested, and after changing upstream
+	// files in the same way as the vendoring tool.
+	norm := newNormalisedMatch(src.Normalise, src.normalisersFor(dir),
+		wt, dir, hashes)
 
-	var toppkg, topver string
-	if top != nil {
-		toppkg = top.Pkg
-		topver = top.Ver
+	trying := func(kind ProgressKind) ProgressEvent {
+		return ProgressEvent{Kind: kind, Project: project.Root}
+	}
+	matched := func(ver string) {
+		reportProgress(ctx, ProgressEvent{
+			Kind:    ProgressMatched,
+			Project: project.Root,
+			Ref:     ver,
+		})
 	}
 
-	ref := &Reference{
-		TopPkg: toppkg,
-		TopVer: topver,
-		Pkg:    project.Root,
-		Repo:   project.Repo,
+	base := path.Join(project.Root, project.SubPath)
+	ref, err := newReference(project, top, dir, hashes)
+	if err != nil {
+		return nil, err
 	}
 
 	// First try to match against a specific version, if specified
 	if project.Version != "" {
-		matches, err := matchFromRefs(strip, hashes, wt,
+		matches, err := matchFromRefs(ctx,
+			trying(ProgressTryingRevision), norm, hashes, wt,
 			subPath, []string{project.Version})
 		switch err {
 		case nil:
@@ -370,9 +550,15 @@ func (src GoSource) DescribeProject(
 			if err != nil {
 				return nil, err
 			}
+			err = compareWithUpstream(ref, base, hashes, wt, subPath, match)
+			if err != nil {
+				return nil, err
+			}
 
 			ref.Rev = match
 			ref.Ver = ver
+			ref.Normalised = norm.descriptions(match)
+			matched(ver)
 			return ref, nil
 		case ErrorVersionNotFound:
 			// No match, carry on
@@ -388,7 +574,8 @@ func (src GoSource) DescribeProject(
 		return ref, err
 	}
 
-	matches, err := matchFromRefs(strip, hashes, wt, subPath, tags)
+	matches, err := matchFromRefs(ctx, trying(ProgressTryingTag),
+		norm, hashes, wt, subPath, tags)
 	switch err {
 	case nil:
 		// Found a match
@@ -397,10 +584,16 @@ func (src GoSource) DescribeProject(
 		if err != nil {
 			return nil, err
 		}
+		err = compareWithUpstream(ref, base, hashes, wt, subPath, match)
+		if err != nil {
+			return nil, err
+		}
 
 		ref.Tag = match
 		ref.Rev = rev
 		ref.Ver = match
+		ref.Normalised = norm.descriptions(match)
+		matched(match)
 		return ref, nil
 	case ErrorVersionNotFound:
 		// No match, carry on
@@ -415,7 +608,8 @@ func (src GoSource) DescribeProject(
 		return ref, err
 	}
 
-	matches, err = matchFromRefs(strip, hashes, wt, subPath, revs)
+	matches, err = matchFromRefs(ctx, trying(ProgressTryingRevision),
+		norm, hashes, wt, subPath, revs)
 	if err != nil {
 		return ref, err
 	}
@@ -426,22 +620,145 @@ func (src GoSource) DescribeProject(
 	if err != nil {
 		return ref, err
 	}
+	err = compareWithUpstream(ref, base, hashes, wt, subPath, rev)
+	if err != nil {
+		return ref, err
+	}
 
 	ref.Rev = rev
 	ref.Ver = ver
+	ref.Normalised = norm.descriptions(rev)
+	matched(ver)
 	return ref, nil
 }
 
+// newReference returns a *Reference, without a version, for the
+// project vendored into top (if not nil), whose local files in dir
+// have hashes.
+func newReference(project *RepoPath, top *Reference, dir string, hashes FileHashes) (*Reference, error) {
+	var toppkg, topver string
+	if top != nil {
+		toppkg = top.Pkg
+		topver = top.Ver
+	}
+
+	binaries, err := binaryFiles(dir, hashes)
+	if err != nil {
+		return nil, err
+	}
+	licenses, err := detectLicenses(dir, hashes)
+	if err != nil {
+		return nil, err
+	}
+
+	base := path.Join(project.Root, project.SubPath)
+	return &Reference{
+		TopPkg:   toppkg,
+		TopVer:   topver,
+		Chain:    project.Chain,
+		Pkg:      project.Root,
+		Repo:     project.Repo,
+		Rule:     project.Rule,
+		Packages: importPaths(base, hashes.Packages()),
+		Binaries: importPaths(base, binaries),
+		Licenses: licenses,
+		hashes:   hashes,
+	}, nil
+}
+
 // DescribeVendoredProject attempts to identify the tag in the version
 // control system which corresponds to the vendored copy of the
-// project.
+// project, found using VendoredDir.
+//
+// If no match is found in wt, each of the project's Forks is tried in
+// turn, using working trees from src.OpenWorkingTree. The Reference
+// for a match found in a fork has that fork's Repo.
 func (src GoSource) DescribeVendoredProject(
 	project *RepoPath,
 	wt WorkingTree,
 	top *Reference,
 ) (*Reference, error) {
-	projRootImportPath := filepath.FromSlash(project.Root)
-	projDir := filepath.Join(src.Vendor(), projRootImportPath)
-	ref, err := src.DescribeProject(project, wt, projDir, top)
+	return src.describeVendoredProject(context.Background(), project,
+		wt, top)
+}
+
+// DescribeVendoredProjectContext is like DescribeVendoredProject but
+// gives up, with ctx.Err(), once ctx is done.
+func (src GoSource) DescribeVendoredProjectContext(
+	ctx context.Context,
+	project *RepoPath,
+	wt WorkingTree,
+	top *Reference,
+) (*Reference, error) {
+	wt = WorkingTreeWithContext(ctx, wt)
+	return src.describeVendoredProject(ctx, project, wt, top)
+}
+
+func (src GoSource) describeVendoredProject(
+	ctx context.Context,
+	project *RepoPath,
+	wt WorkingTree,
+	top *Reference,
+) (*Reference, error) {
+	projDir := src.VendoredDir(project)
+	ref, err := src.describeProject(ctx, project, wt, projDir, top)
+	if err != ErrorVersionNotFound {
+		return ref, err
+	}
+
+	for _, repo := range project.Forks {
+		fork := *project
+		fork.Repo = repo
+		fref, ferr := src.describeFork(ctx, &fork, projDir, top)
+		switch {
+		case ferr == nil:
+			log.Infof("%s: found in fork %s", project.Root, repo)
+			return fref, nil
+		case ferr == ErrorVersionNotFound:
+		case ctx.Err() != nil:
+			return nil, ctx.Err()
+		default:
+			log.Errorf("%s: %s: %s", project.Root, repo, ferr)
+		}
+	}
+
 	return ref, err
 }
+
+// describeFork is like describeProject for the fork, whose working
+// tree is obtained using src.OpenWorkingTree.
+func (src GoSource) describeFork(
+	ctx context.Context,
+	fork *RepoPath,
+	dir string,
+	top *Reference,
+) (*Reference, error) {
+	var wt WorkingTree
+	var err error
+	if src.OpenWorkingTree != nil {
+		wt, err = src.OpenWorkingTree(ctx, &fork.RepoRoot)
+	} else {
+		wt, err = NewWorkingTreeContext(ctx, &fork.RepoRoot)
+		if err == nil {
+			defer wt.Close()
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debugf("%s: trying fork %s", fork.Root, fork.Repo)
+	wt = WorkingTreeWithContext(ctx, wt)
+	return src.describeProject(ctx, fork, wt, dir, top)
+}
+
+// VendoredDir returns the filepath of the vendored copy of the
+// project. This is project.Dir if set, otherwise the project's
+// location in the top-level vendor directory.
+func (src GoSource) VendoredDir(project *RepoPath) string {
+	if project.Dir != "" {
+		return project.Dir
+	}
+	projRootImportPath := filepath.FromSlash(project.Root)
+	return filepath.Join(src.Vendor(), projRootImportPath)
+}
@@ -16,7 +16,15 @@
 package retrodep
 
 import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
 	"testing"
+
+	"github.com/pkg/errors"
+	"golang.org/x/tools/go/vcs"
 )
 
 func TestVendoredProjects(t *testing.T) {
@@ -48,6 +56,20 @@ func TestVendoredProjects(t *testing.T) {
 	if !matched {
 		t.Errorf("%v != %v", got, expected)
 	}
+
+	// github.com/eggs/ham/spam has only ignored.go, which is
+	// still a package source file.
+	pkgs := got["github.com/eggs/ham"].Packages
+	expPkgs := []string{"github.com/eggs/ham", "github.com/eggs/ham/spam"}
+	if len(pkgs) != len(expPkgs) {
+		t.Fatalf("Packages: got %v, want %v", pkgs, expPkgs)
+	}
+	for i, pkg := range expPkgs {
+		if pkgs[i] != pkg {
+			t.Errorf("Packages: got %v, want %v", pkgs, expPkgs)
+			break
+		}
+	}
 }
 
 func TestChooseBestTag(t *testing.T) {
@@ -140,3 +162,299 @@ func TestDescribeProject(t *testing.T) {
 		t.Errorf("Revision: got %s but expected %s", ref.Rev, matchRevision)
 	}
 }
+
+func TestDescribeProjectContextCanceled(t *testing.T) {
+	src, err := NewGoSource("testdata/gosource", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proj, err := src.Project("github.com/foo/bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wt := &mockVendorWorkingTree{}
+	wt.hasher = &dummyHasher{}
+	wt.localHashes, err = src.hashLocalFiles(wt, proj, src.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = src.DescribeProjectContext(ctx, proj, wt, src.Path, nil)
+	if err != context.Canceled {
+		t.Errorf("got %v, expected %v", err, context.Canceled)
+	}
+}
+
+func TestHashLocalFilesExcludes(t *testing.T) {
+	tcs := []struct {
+		name     string
+		patterns []string
+		exclude  []string
+		expected []string
+	}{
+		{"none", nil, nil, []string{"ham.go", "spam/ignored.go"}},
+		{"top-level", []string{"**/spam/"}, nil, []string{"ham.go"}},
+		{"project", nil, []string{"/ham.go"}, []string{"spam/ignored.go"}},
+		{
+			name:     "negated",
+			patterns: []string{"*.go"},
+			exclude:  []string{"!ham.go"},
+			expected: []string{"ham.go"},
+		},
+	}
+
+	for _, tc := range tcs {
+		src, err := NewGoSourceWithExcludes("testdata/gosource",
+			NewExcludes(tc.patterns))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		proj := &RepoPath{
+			RepoRoot: vcs.RepoRoot{Root: "github.com/eggs/ham"},
+			Exclude:  tc.exclude,
+		}
+		hashes, err := src.hashLocalFiles(&gitHasher{}, proj,
+			src.VendoredDir(proj))
+		if err != nil {
+			t.Errorf("%s: %s", tc.name, err)
+			continue
+		}
+
+		var files []string
+		for file := range hashes {
+			files = append(files, file)
+		}
+		sort.Strings(files)
+		if !reflect.DeepEqual(files, tc.expected) {
+			t.Errorf("%s: expected %v, got %v", tc.name,
+				tc.expected, files)
+		}
+	}
+}
+
+func TestVendoredProjectsExcluded(t *testing.T) {
+	excl := NewExcludes([]string{"vendor/github.com/foo/", "spam"})
+	src, err := NewGoSourceWithExcludes("testdata/gosource", excl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := src.VendoredProjects()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := got["github.com/foo/bar"]; ok || len(got) != 1 {
+		t.Fatalf("expected only github.com/eggs/ham: %v", got)
+	}
+
+	// Excluded packages are not present either
+	pkgs := got["github.com/eggs/ham"].Packages
+	if !reflect.DeepEqual(pkgs, []string{"github.com/eggs/ham"}) {
+		t.Errorf("Packages: got %v", pkgs)
+	}
+}
+
+func TestVendoredProjectsNested(t *testing.T) {
+	src, err := NewGoSource("testdata/nested", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := src.VendoredProjects()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 4 {
+		t.Fatalf("got %d projects, want 4: %v", len(got), got)
+	}
+
+	// The "vendor" directory in github.com/foo/zed is reached
+	// before any of its Go source files.
+	for _, root := range []string{"github.com/foo/bar", "github.com/foo/zed"} {
+		outer, ok := got[root]
+		if !ok {
+			t.Fatalf("%s not returned: %v", root, got)
+		}
+		if len(outer.Chain) != 0 {
+			t.Errorf("%s: unexpected chain %v", root, outer.Chain)
+		}
+		if len(outer.Packages) != 1 {
+			t.Errorf("%s: unexpected packages %v", root, outer.Packages)
+		}
+
+		key := root + "/vendor/github.com/baz/qux"
+		nested, ok := got[key]
+		if !ok {
+			t.Fatalf("%s not returned: %v", key, got)
+		}
+		if nested.Root != "github.com/baz/qux" {
+			t.Errorf("%s: Root: got %q", key, nested.Root)
+		}
+		if len(nested.Chain) != 1 || nested.Chain[0] != root {
+			t.Errorf("%s: Chain: got %v", key, nested.Chain)
+		}
+		expDir := "testdata/nested/vendor/" + key
+		if nested.Dir != expDir {
+			t.Errorf("%s: Dir: got %q, want %q", key, nested.Dir, expDir)
+		}
+	}
+}
+
+func TestDescribeVendoredProjectFork(t *testing.T) {
+	src, err := NewGoSource("testdata/gosource", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vendored, err := src.VendoredProjects()
+	if err != nil {
+		t.Fatal(err)
+	}
+	project := vendored["github.com/foo/bar"]
+	project.Repo = "https://github.com/foo/bar"
+	project.Forks = []string{
+		"https://github.com/broken/bar",
+		"https://github.com/fork/bar",
+	}
+
+	// Nothing matches upstream, but the second fork matches.
+	upstream := &mockVendorWorkingTree{localHashes: make(FileHashes)}
+	upstream.hasher = &dummyHasher{}
+	fork := &mockVendorWorkingTree{}
+	fork.hasher = &dummyHasher{}
+	fork.localHashes, err = src.hashLocalFiles(fork, project,
+		src.VendoredDir(project))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var opened []string
+	src.OpenWorkingTree = func(ctx context.Context, root *vcs.RepoRoot) (WorkingTree, error) {
+		opened = append(opened, root.Repo)
+		if root.Repo != "https://github.com/fork/bar" {
+			return nil, errors.New("clone failed")
+		}
+		return fork, nil
+	}
+
+	ref, err := src.DescribeVendoredProject(project, upstream, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ref.Repo != "https://github.com/fork/bar" || ref.Ver != matchVersion {
+		t.Errorf("unexpected reference: %v", ref)
+	}
+	if !reflect.DeepEqual(opened, project.Forks) {
+		t.Errorf("opened %v", opened)
+	}
+
+	// Without forks the version is not found.
+	project.Forks = nil
+	_, err = src.DescribeVendoredProject(project, upstream, nil)
+	if err != ErrorVersionNotFound {
+		t.Errorf("got %v, expected %v", err, ErrorVersionNotFound)
+	}
+}
+
+func TestDescribeProjectProgress(t *testing.T) {
+	src, err := NewGoSource("testdata/gosource", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proj, err := src.Project("github.com/foo/bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wt := &mockVendorWorkingTree{}
+	wt.hasher = &dummyHasher{}
+	wt.localHashes, err = src.hashLocalFiles(wt, proj, src.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var events []ProgressEvent
+	ctx := WithProgress(context.Background(),
+		ProgressFunc(func(ev ProgressEvent) {
+			events = append(events, ev)
+		}))
+	_, err = src.DescribeProjectContext(ctx, proj, wt, src.Path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []ProgressEvent{
+		{Kind: ProgressHashing, Project: proj.Root},
+		{Kind: ProgressTryingTag, Project: proj.Root, Ref: "v2.0.0", N: 1, Total: 2},
+		{Kind: ProgressTryingTag, Project: proj.Root, Ref: "v1.0.0", N: 2, Total: 2},
+		{Kind: ProgressMatched, Project: proj.Root, Ref: matchVersion},
+	}
+	if len(events) != len(expected) {
+		t.Fatalf("got %v, expected %v", events, expected)
+	}
+	for i := range expected {
+		if events[i] != expected[i] {
+			t.Errorf("%d: got %v, expected %v", i, events[i], expected[i])
+		}
+	}
+}
+
+func TestVendorDir(t *testing.T) {
+	tcs := []struct {
+		dir, vendorDir string
+	}{
+		{"testdata/nested", "vendor"},
+		{"testdata/godep", "vendor"},
+		{"testdata/godepworkspace", "Godeps/_workspace/src"},
+		{"testdata/gb", "vendor/src"},
+		{"testdata/underscorevendor", "_vendor"},
+	}
+
+	for _, tc := range tcs {
+		src, err := NewGoSource(tc.dir, nil)
+		if err != nil {
+			t.Errorf("%s: %s", tc.dir, err)
+			continue
+		}
+		vendorDir := filepath.FromSlash(tc.vendorDir)
+		if src.VendorDir != vendorDir {
+			t.Errorf("%s: expected %s, got %s", tc.dir, vendorDir,
+				src.VendorDir)
+		}
+		if tc.dir == "testdata/godep" {
+			continue
+		}
+
+		// The vendor directory is not part of the top-level
+		// project
+		hashes, err := src.hashLocalFiles(&sha256Hasher{},
+			&RepoPath{}, src.Path)
+		if err != nil && err != ErrorNoFiles {
+			t.Errorf("%s: %s", tc.dir, err)
+			continue
+		}
+		for path := range hashes {
+			if strings.HasSuffix(path, "bar.go") {
+				t.Errorf("%s: %s hashed", tc.dir, path)
+			}
+		}
+
+		got, err := src.VendoredProjects()
+		if err != nil {
+			t.Errorf("%s: %s", tc.dir, err)
+			continue
+		}
+		project, ok := got["github.com/foo/bar"]
+		if !ok {
+			t.Errorf("%s: unexpected projects %v", tc.dir, got)
+			continue
+		}
+		expDir := filepath.Join(tc.dir, vendorDir, "github.com/foo/bar")
+		if src.VendoredDir(project) != expDir {
+			t.Errorf("%s: expected %s, got %s", tc.dir, expDir,
+				src.VendoredDir(project))
+		}
+	}
+}
@@ -16,8 +16,9 @@
 package retrodep
 
 import (
-	"bufio"
 	"bytes"
+	"context"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
@@ -26,7 +27,6 @@ import (
 	"regexp"
 	"sort"
 	"strings"
-	"syscall"
 	"time"
 
 	"github.com/Masterminds/semver"
@@ -34,7 +34,7 @@ import (
 	"golang.org/x/tools/go/vcs"
 )
 
-var execCommand = exec.Command
+var execCommandContext = exec.CommandContext
 
 // Describable is the interface which capture the methods required for
 // creating a pseudo-version from a revision.
@@ -81,6 +81,25 @@ type WorkingTree interface {
 	// RevisionFromTag returns the revision ID from the tag.
 	RevisionFromTag(tag string) (string, error)
 
+	// IsAncestor returns true if the revision ancestor is rev or
+	// one of its ancestors.
+	IsAncestor(ancestor, rev string) (bool, error)
+
+	// ParentRevision returns the first parent of the revision rev,
+	// or "" if it has none.
+	ParentRevision(rev string) (string, error)
+
+	// RevisionWithBlob returns a revision in which the file at
+	// path (relative to the repository root) has the content whose
+	// hash is hash. It returns ErrorVersionNotFound if there is no
+	// such revision.
+	RevisionWithBlob(path string, hash FileHash) (string, error)
+
+	// RevisionWithPath returns a revision in which path
+	// (relative to the repository root) exists. It returns
+	// ErrorVersionNotFound if there is no such revision.
+	RevisionWithPath(path string) (string, error)
+
 	// StripImportComment removes import comments from package
 	// declarations in the same way godep does, writing the result
 	// (if changed) to w. It returns a boolean indicating whether
@@ -89,9 +108,14 @@ type WorkingTree interface {
 	// The file content may be written to w even if no change was made.
 	StripImportComment(path string, w io.Writer) (bool, error)
 
-	// Diff writes output to out from 'diff -u' comparing the
-	// path within the working tree with the localFile. It returns
-	// true if changes were found and false if not.
+	// ReadFile returns the content of path, relative to the
+	// repository root, as synced by TagSync or RevSync.
+	ReadFile(path string) ([]byte, error)
+
+	// Diff writes output to out, in unified diff format,
+	// comparing the path within the working tree with the
+	// localFile. It returns true if changes were found and false
+	// if not.
 	Diff(out io.Writer, path, localFile string) (bool, error)
 }
 
@@ -102,37 +126,94 @@ type anyWorkingTree struct {
 	Dir    string
 	VCS    *vcs.Cmd
 	hasher Hasher
+
+	// ctx limits the lifetime of commands run in the working
+	// tree. If nil, context.Background() is used.
+	ctx context.Context
 }
 
 // NewWorkingTree creates a local checkout of the version control
 // system for a Go project.
 func NewWorkingTree(project *vcs.RepoRoot) (WorkingTree, error) {
+	return NewWorkingTreeContext(context.Background(), project)
+}
+
+// NewWorkingTreeContext is like NewWorkingTree but the commands it
+// runs, both to create the checkout and later when using the
+// returned WorkingTree, are killed once ctx is done. The local
+// checkout is removed if it cannot be completed. Cloning is reported
+// to any Progress in ctx.
+func NewWorkingTreeContext(ctx context.Context, project *vcs.RepoRoot) (WorkingTree, error) {
+	wt := anyWorkingTree{
+		VCS: project.VCS,
+		ctx: ctx,
+	}
+	switch project.VCS.Cmd {
+	case vcsGit:
+		wt.hasher = &gitHasher{ctx: ctx}
+	case vcsHg:
+		wt.hasher = &sha256Hasher{}
+	default:
+		return nil, ErrorUnknownVCS
+	}
+
 	dir, err := ioutil.TempDir("", "retrodep.")
 	if err != nil {
 		return nil, err
 	}
 
-	err = project.VCS.Create(dir, project.Repo)
+	wt.Dir = dir
+	reportProgress(ctx, ProgressEvent{
+		Kind:    ProgressCloning,
+		Project: project.Root,
+	})
+	_, err = wt.runCmdline(project.VCS.CreateCmd,
+		"dir", dir, "repo", project.Repo)
 	if err != nil {
 		os.RemoveAll(dir)
 		return nil, err
 	}
 
-	wt := anyWorkingTree{
-		Dir: dir,
-		VCS: project.VCS,
-	}
-	switch project.VCS.Cmd {
-	case vcsGit:
-		wt.hasher = &gitHasher{}
-		return &gitWorkingTree{anyWorkingTree: wt}, nil
-	case vcsHg:
-		wt.hasher = &sha256Hasher{}
+	if project.VCS.Cmd == vcsHg {
 		return &hgWorkingTree{anyWorkingTree: wt}, nil
 	}
+	return &gitWorkingTree{anyWorkingTree: wt}, nil
+}
+
+// context returns the Context for commands run in the working tree.
+func (wt *anyWorkingTree) context() context.Context {
+	if wt.ctx == nil {
+		return context.Background()
+	}
+	return wt.ctx
+}
+
+// withContext returns a shallow copy of the working tree which uses
+// ctx for the commands it runs.
+func (wt *anyWorkingTree) withContext(ctx context.Context) anyWorkingTree {
+	c := *wt
+	c.ctx = ctx
+	if _, ok := c.hasher.(*gitHasher); ok {
+		c.hasher = &gitHasher{ctx: ctx}
+	}
+	return c
+}
+
+// contextual is implemented by working trees which can run their
+// commands using a different Context.
+type contextual interface {
+	withContext(ctx context.Context) WorkingTree
+}
 
-	wt.Close()
-	return nil, ErrorUnknownVCS
+// WorkingTreeWithContext returns a WorkingTree which shares the local
+// checkout of wt but runs its commands using ctx, if wt supports
+// that. Otherwise wt is returned. This allows a WorkingTree to be
+// reused after the Context it was created with is done.
+func WorkingTreeWithContext(ctx context.Context, wt WorkingTree) WorkingTree {
+	if c, ok := wt.(contextual); ok {
+		return c.withContext(ctx)
+	}
+	return wt
 }
 
 // Close removes the local checkout.
@@ -140,14 +221,54 @@ func (wt *anyWorkingTree) Close() error {
 	return os.RemoveAll(wt.Dir)
 }
 
+// TagSync syncs the repo to the named tag, in the same way as
+// vcs.Cmd.TagSync.
 func (wt *anyWorkingTree) TagSync(tag string) error {
-	return wt.VCS.TagSync(wt.Dir, tag)
+	if wt.VCS.TagSyncCmd == "" {
+		return nil
+	}
+	if tag != "" {
+		for _, tc := range wt.VCS.TagLookupCmd {
+			out, err := wt.runCmdline(tc.Cmd, "tag", tag)
+			if err != nil {
+				return err
+			}
+			re := regexp.MustCompile(`(?m-s)` + tc.Pattern)
+			m := re.FindStringSubmatch(out.String())
+			if len(m) > 1 {
+				tag = m[1]
+				break
+			}
+		}
+	}
+	if tag == "" && wt.VCS.TagSyncDefault != "" {
+		_, err := wt.runCmdline(wt.VCS.TagSyncDefault)
+		return err
+	}
+	_, err := wt.runCmdline(wt.VCS.TagSyncCmd, "tag", tag)
+	return err
+}
+
+// tags returns all the tags, in the same way as vcs.Cmd.Tags.
+func (wt *anyWorkingTree) tags() ([]string, error) {
+	var tags []string
+	for _, tc := range wt.VCS.TagCmd {
+		out, err := wt.runCmdline(tc.Cmd)
+		if err != nil {
+			return nil, err
+		}
+		re := regexp.MustCompile(`(?m-s)` + tc.Pattern)
+		for _, m := range re.FindAllStringSubmatch(out.String(), -1) {
+			tags = append(tags, m[1])
+		}
+	}
+	return tags, nil
 }
 
 // VersionTags returns the tags that are parseable as semantic tags,
 // e.g. v1.1.0.
 func (wt *anyWorkingTree) VersionTags() ([]string, error) {
-	tags, err := wt.VCS.Tags(wt.Dir)
+	tags, err := wt.tags()
 	if err != nil {
 		return nil, err
 	}
@@ -172,7 +293,7 @@ func (wt *anyWorkingTree) VersionTags() ([]string, error) {
 // run runs the VCS command with the provided args
 // and returns stdout and stderr (as bytes.Buffer).
 func (wt *anyWorkingTree) run(args ...string) (*bytes.Buffer, *bytes.Buffer, error) {
-	p := execCommand(wt.VCS.Cmd, args...)
+	p := execCommandContext(wt.context(), wt.VCS.Cmd, args...)
 	var stdout, stderr bytes.Buffer
 	p.Stdout = &stdout
 	p.Stderr = &stderr
@@ -181,6 +302,29 @@ func (wt *anyWorkingTree) run(args ...string) (*bytes.Buffer, *bytes.Buffer, err
 	return &stdout, &stderr, err
 }
 
+// runCmdline runs a command line in the format used by vcs.Cmd,
+// expanding "{key}" using the key/value pairs in keyval. On failure,
+// the command's output is written to os.Stderr.
+func (wt *anyWorkingTree) runCmdline(cmdline string, keyval ...string) (*bytes.Buffer, error) {
+	args := strings.Fields(cmdline)
+	for i := range args {
+		for j := 0; j+1 < len(keyval); j += 2 {
+			args[i] = strings.Replace(args[i],
+				"{"+keyval[j]+"}", keyval[j+1], -1)
+		}
+	}
+	stdout, stderr, err := wt.run(args...)
+	if err != nil {
+		wt.showOutput(stdout, stderr)
+		if ctxErr := wt.context().Err(); ctxErr != nil {
+			err = ctxErr
+		}
+		return nil, errors.Wrapf(err, "%s %s", wt.VCS.Cmd,
+			strings.Join(args, " "))
+	}
+	return stdout, nil
+}
+
 // showOutput writes stdout to os.Stdout and stderr to os.Stderr.
 func (wt *anyWorkingTree) showOutput(stdout, stderr *bytes.Buffer) {
 	os.Stdout.Write(stdout.Bytes())
@@ -252,44 +396,43 @@ func (wt *anyWorkingTree) StripImportComment(path string, w io.Writer) (bool, er
 	if !strings.HasSuffix(path, ".go") {
 		return false, nil
 	}
-	path = filepath.Join(wt.Dir, path)
-	r, err := os.Open(path)
+	content, err := ioutil.ReadFile(filepath.Join(wt.Dir, path))
 	if err != nil {
 		return false, errors.Wrap(err, "StripImportComment")
 	}
-	defer r.Close()
 
-	b := bufio.NewReader(r)
+	content, changed := stripImportComment(content)
+	if _, err := w.Write(content); err != nil {
+		return false, errors.Wrap(err, "StripImportComment")
+	}
+	return changed, nil
+}
+
+// stripImportComment removes import comments from package
+// declarations in content in the same way godep does, and ensures
+// the content ends with a newline. It returns the result and whether
+// it differs from content.
+func stripImportComment(content []byte) ([]byte, bool) {
+	var out bytes.Buffer
 	changed := false
-	eof := false
-	for !eof {
-		line, err := b.ReadBytes('\n')
-		if err != nil {
-			if err == io.EOF {
-				eof = true
-			} else {
-				return false, errors.Wrap(err, "StripImportComment")
-			}
+	for len(content) > 0 {
+		var line []byte
+		if nl := bytes.IndexByte(content, '\n'); nl != -1 {
+			line, content = content[:nl], content[nl+1:]
+		} else {
+			// There was no newline but we'll add one
+			line, content = content, nil
+			changed = true
 		}
-		if len(line) > 0 {
-			nonl := bytes.TrimRight(line, "\n")
-			if len(nonl) == len(line) {
-				// There was no newline but we'll add one
-				changed = true
-			}
-			repl := removeImportComment(nonl)
-			if repl != nil {
-				nonl = repl
-				changed = true
-			}
 
-			if _, err := w.Write(append(nonl, '\n')); err != nil {
-				return false, errors.Wrap(err, "StripImportComment")
-			}
+		if repl := removeImportComment(line); repl != nil {
+			line = repl
+			changed = true
 		}
+		out.Write(line)
+		out.WriteByte('\n')
 	}
-
-	return changed, nil
+	return out.Bytes(), changed
 }
 
 // Hash returns the file hash for the filename absPath, hashed as
@@ -298,36 +441,62 @@ func (wt *anyWorkingTree) Hash(relativePath, absPath string) (FileHash, error) {
 	return wt.hasher.Hash(relativePath, absPath)
 }
 
-// Diff writes output to stdout from 'diff -u' comparing the
-// path within the working tree with the localFile. It returns
-// true if changes were found and false if not.
-func (wt *anyWorkingTree) Diff(out io.Writer, path, localFile string) (bool, error) {
-	if path == "" {
-		path = "/dev/null"
-	} else if path[0] != '/' {
-		path = filepath.Join(wt.Dir, path)
+// hashContent implements the contentHasher interface using the
+// working tree's Hasher.
+func (wt *anyWorkingTree) hashContent(relativePath string, r io.Reader) (FileHash, error) {
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return FileHash(""), err
 	}
+	return hashBytes(wt.hasher, relativePath, content)
+}
 
-	p := execCommand("diff", "-u", path, localFile)
-	p.Stdout = out
-	err := p.Run()
-
-	changes := false
+// ReadFile returns the content of path, relative to the repository
+// root, as synced by TagSync or RevSync.
+func (wt *anyWorkingTree) ReadFile(path string) ([]byte, error) {
+	content, err := ioutil.ReadFile(filepath.Join(wt.Dir, path))
 	if err != nil {
-		// Find the exit code from an exec.ExitError by using
-		// the embedded os.ProcessState's Sys method.
-		if exitErr, ok := err.(*exec.ExitError); ok {
-			if waitStatus, ok := exitErr.Sys().(syscall.WaitStatus); ok {
-				// Exit codes for diff are:
-				// 0: no differences were found
-				// 1: some differences were found
-				// >1: trouble
-				if waitStatus.Exited() && waitStatus.ExitStatus() == 1 {
-					return true, nil
-				}
-			}
+		return nil, errors.Wrap(err, "ReadFile")
+	}
+	return content, nil
+}
+
+// Diff writes output to out, in unified diff format, comparing the
+// path within the working tree with the localFile. If path is "" the
+// comparison is with an empty file. It returns true if changes were
+// found and false if not.
+func (wt *anyWorkingTree) Diff(out io.Writer, path, localFile string) (bool, error) {
+	oldName := "/dev/null"
+	var old []byte
+	if path != "" {
+		oldName = path
+		var err error
+		if filepath.IsAbs(path) {
+			old, err = ioutil.ReadFile(path)
+		} else {
+			old, err = wt.ReadFile(path)
+		}
+		if err != nil {
+			return false, err
 		}
 	}
 
-	return changes, err
+	new, err := ioutil.ReadFile(localFile)
+	if err != nil {
+		return false, errors.Wrap(err, "Diff")
+	}
+
+	d := NewFileDiff(localFile, old, new, DefaultDiffContext)
+	if d == nil {
+		return false, nil
+	}
+
+	var b bytes.Buffer
+	if d.Binary {
+		fmt.Fprintf(&b, "Binary files %s and %s differ\n", oldName, localFile)
+	} else {
+		writeUnified(&b, oldName, localFile, d.Hunks)
+	}
+	_, err = b.WriteTo(out)
+	return true, err
 }
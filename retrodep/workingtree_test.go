@@ -17,11 +17,16 @@ package retrodep
 
 import (
 	"bytes"
+	"context"
 	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/pkg/errors"
 	"golang.org/x/tools/go/vcs"
 )
 
@@ -182,6 +187,22 @@ func (wt *stubWorkingTree) RevisionFromTag(tag string) (string, error) {
 	return "", nil
 }
 
+func (wt *stubWorkingTree) IsAncestor(ancestor, rev string) (bool, error) {
+	return ancestor == rev, nil
+}
+
+func (wt *stubWorkingTree) ParentRevision(rev string) (string, error) {
+	return "", nil
+}
+
+func (wt *stubWorkingTree) RevisionWithBlob(path string, hash FileHash) (string, error) {
+	return "", ErrorVersionNotFound
+}
+
+func (wt *stubWorkingTree) RevisionWithPath(path string) (string, error) {
+	return "", ErrorVersionNotFound
+}
+
 func (wt *stubWorkingTree) ReachableTag(rev string) (string, error) {
 	return "", nil
 }
@@ -258,30 +279,92 @@ func TestStripImportCommentNewline(t *testing.T) {
 }
 
 func TestDiff(t *testing.T) {
-	defer mockExecCommand()()
+	dir, err := ioutil.TempDir("", "retrodep-test.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	err = ioutil.WriteFile(filepath.Join(dir, "a.go"),
+		[]byte("package a\n\nvar foo = 1\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := filepath.Join(dir, "local.go")
+	err = ioutil.WriteFile(local, []byte("package a\n\nvar foo = 2\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	wt := &gitWorkingTree{
 		anyWorkingTree: anyWorkingTree{
-			Dir: "testdata/gosource",
+			Dir: dir,
 			VCS: vcs.ByCmd("git"),
 		},
 	}
 
-	// This will be the file contents *and* the output of 'diff -u'.
-	mockedStdout = "--- ignored.go\n+++ignored.go\n@@ -0,0 +1 @@\n+foo\n"
-	mockedExitStatus = 1
+	tcs := []struct {
+		path     string
+		expected string
+	}{
+		{
+			"a.go",
+			"--- a.go\n+++ " + local + "\n@@ -1,3 +1,3 @@\n package a\n \n-var foo = 1\n+var foo = 2\n",
+		},
+		{
+			"",
+			"--- /dev/null\n+++ " + local + "\n@@ -0,0 +1,3 @@\n+package a\n+\n+var foo = 2\n",
+		},
+		{"local.go", ""},
+	}
+
+	for _, tc := range tcs {
+		captured := &strings.Builder{}
+		changes, err := wt.Diff(captured, tc.path, local)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if changes != (tc.expected != "") {
+			t.Errorf("%q: changes: got %t", tc.path, changes)
+		}
 
-	captured := &strings.Builder{}
-	changes, err := wt.Diff(captured, "ignored.go", "ignored.go")
+		if captured.String() != tc.expected {
+			t.Errorf("%q: got %q, wanted %q", tc.path,
+				captured.String(), tc.expected)
+		}
+	}
+}
+
+func TestNewWorkingTreeContextCanceled(t *testing.T) {
+	defer mockExecCommand()()
+
+	tmpdir, err := ioutil.TempDir("", "retrodep-test.")
 	if err != nil {
 		t.Fatal(err)
 	}
-
-	if changes != true {
-		t.Errorf("changes: got %t, expected %t", changes, true)
+	defer os.RemoveAll(tmpdir)
+	defer os.Setenv("TMPDIR", os.Getenv("TMPDIR"))
+	os.Setenv("TMPDIR", tmpdir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	project := &vcs.RepoRoot{
+		VCS:  vcs.ByCmd("git"),
+		Repo: "https://example.com/foo/bar",
+		Root: "example.com/foo/bar",
+	}
+	_, err = NewWorkingTreeContext(ctx, project)
+	if errors.Cause(err) != context.Canceled {
+		t.Errorf("got %v, expected %v", err, context.Canceled)
 	}
 
-	if captured.String() != mockedStdout {
-		t.Errorf("got %q, wanted %q", captured.String(), mockedStdout)
+	// The partial checkout should have been removed.
+	entries, err := ioutil.ReadDir(tmpdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("temporary directory not removed")
 	}
 }